@@ -2,34 +2,98 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os" // Add this import
 
 	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/audit"
 	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/cli"
+	"gcp-instance-explorer/internal/pricing"
 	"gcp-instance-explorer/internal/ui"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run starts a subcommand or the interactive menu and returns the exit status. Exiting only
+// after run returns lets deferred cleanup, such as closing the audit log, always happen.
+func run() int {
 	ctx := context.Background()
 
+	// Global flags apply to the interactive menu and to every subcommand
+	mappingsFile := flag.String("mappings", "", "YAML file with extra license mapping rules")
+	auditFile := flag.String("audit-log", audit.DefaultPath, "Append a hash-chained record of every change to this file (\"\" to disable)")
+	pricesFile := flag.String("prices", "", "YAML price table used to estimate monthly license costs of a plan")
+	var authOptions auth.Options
+	flag.StringVar(&authOptions.CredentialsFile, "credentials-file", "", "Credentials file to use instead of application default credentials")
+	flag.StringVar(&authOptions.ImpersonateServiceAccount, "impersonate-service-account", "",
+		"Act as this service account with short-lived tokens (comma-separated for a delegation chain)")
+	flag.StringVar(&authOptions.QuotaProject, "quota-project", "", "Project billed for API quota")
+	flag.Usage = cli.Usage
+	flag.Parse()
+
+	auth.SetOptions(authOptions)
+
+	if *mappingsFile != "" {
+		if err := api.LoadMappingsFile(*mappingsFile); err != nil {
+			log.Printf("Failed to load license mappings: %v", err)
+			return 1
+		}
+	}
+
+	if *pricesFile != "" {
+		if err := pricing.LoadPriceFile(*pricesFile); err != nil {
+			log.Printf("Failed to load price table: %v", err)
+			return 1
+		}
+	}
+
+	if *auditFile != "" {
+		auditLog := audit.New(*auditFile)
+		defer auditLog.Close()
+		api.SetAuditLog(auditLog)
+	}
+
+	// Run a subcommand non-interactively when one is given
+	if flag.NArg() > 0 {
+		return cli.Run(ctx, flag.Args())
+	}
+
+	// Otherwise fall back to the interactive menu
 	// Authenticate the user and retrieve API services
 	fmt.Println("Authenticating with GCP...")
-	_, computeService, err := auth.Authenticate()
+	session, err := auth.NewSession()
 	if err != nil {
-		log.Fatalf("Authentication failed: %v", err)
+		log.Printf("Authentication failed: %v", err)
+		return 1
 	}
+	computeService := session.Compute
+	api.SetAlphaClient(session.HTTPClient)
+	api.AuditLog().SetPrincipal(func() string {
+		return session.ResolvePrincipal(ctx)
+	})
 
 	fmt.Println("Authentication successful!")
 
+	// Say which identity every change will be made as
+	principal := session.ResolvePrincipal(ctx)
+	if principal == "" {
+		principal = "an unknown account"
+	}
+	fmt.Printf("Authenticated as %s using %s\n", principal, session.CredentialSource())
+
 	// Skip listing all projects - go directly to project selection
 	var projects []api.Project
 
 	// Let the user enter a project ID directly
 	selectedProject, err := ui.SelectProject(projects)
 	if err != nil {
-		log.Fatalf("Project selection failed: %v", err)
+		log.Printf("Project selection failed: %v", err)
+		return 1
 	}
 
 	fmt.Printf("Using project: %s\n", selectedProject.ID)
@@ -40,7 +104,8 @@ func main() {
 		fmt.Printf("Fetching instances for project %s...\n", selectedProject.ID)
 		instances, err := api.ListInstances(ctx, selectedProject.ID, computeService)
 		if err != nil {
-			log.Fatalf("Failed to list instances: %v", err)
+			log.Printf("Failed to list instances: %v", err)
+			return 1
 		}
 
 		// Output the instances using the simplified display format
@@ -55,13 +120,20 @@ func main() {
 		fmt.Println() // Add a blank line for better spacing
 
 		// Present the management menu
-		refreshNeeded := ui.ManageInstances(ctx, instances, computeService, selectedProject.ID)
+		refreshNeeded := ui.ManageInstances(ctx, instances, session, selectedProject.ID)
 
 		// Exit if user chose to exit (option 0)
 		if !refreshNeeded {
-			fmt.Println("Goodbye!")
 			break
 		}
 		// Otherwise loop continues with a refreshed instance list
 	}
+
+	// Changes missing from the audit log fail the session, as they fail a subcommand
+	if err := api.AuditLog().Err(); err != nil {
+		log.Printf("Not every change was recorded in the audit log: %v", err)
+		return 1
+	}
+	fmt.Println("Goodbye!")
+	return 0
 }
@@ -5,6 +5,7 @@ go 1.23.0
 toolchain go1.23.6
 
 require (
+	cloud.google.com/go/compute/metadata v0.6.0
 	golang.org/x/oauth2 v0.27.0
 	google.golang.org/api v0.223.0
 	gopkg.in/yaml.v2 v2.4.0
@@ -14,7 +15,6 @@ require (
 require (
 	cloud.google.com/go/auth v0.15.0 // indirect
 	cloud.google.com/go/auth/oauth2adapt v0.2.7 // indirect
-	cloud.google.com/go/compute/metadata v0.6.0 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
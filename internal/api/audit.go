@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+
+	"gcp-instance-explorer/internal/audit"
+)
+
+// Audited actions
+const (
+	AuditStartInstance   = "instances.start"
+	AuditStopInstance    = "instances.stop"
+	AuditLicenseMetadata = "instances.setMetadata.license"
+	AuditDiskLicenses    = "disks.updateLicenses"
+)
+
+// auditLog receives a record of every change made through this package
+var auditLog = struct {
+	sync.Mutex
+	log *audit.Log
+}{}
+
+// SetAuditLog records every start, stop and license change in log. A nil log records nothing.
+func SetAuditLog(log *audit.Log) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	auditLog.log = log
+}
+
+// AuditLog returns the log set with SetAuditLog, or nil
+func AuditLog() *audit.Log {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	return auditLog.log
+}
+
+// auditAction appends a record to the audit log. A failed write is reported but never hides
+// the outcome of the action itself; the log keeps the error so the command can fail with it.
+func auditAction(rec audit.Record, err error) {
+	rec.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		rec.Outcome = audit.OutcomeFailure
+		rec.Error = err.Error()
+	}
+
+	if err := AuditLog().Record(rec); err != nil {
+		progressf("⚠️ Audit log: %v\n", err)
+	}
+}
+
+// instanceResource is the resource name of an instance in audit records
+func instanceResource(instance Instance) string {
+	return fmt.Sprintf("projects/%s/zones/%s/instances/%s", instance.Project, instance.Zone, instance.Name)
+}
+
+// diskResource is the resource name of a disk in audit records
+func diskResource(project, zone, disk string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, disk)
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// EditLicenses is the direction of plans that add or remove individual licenses on a disk
+const EditLicenses ConversionDirection = "edit"
+
+// DiskSelector chooses which disks of an instance a license change applies to.
+// The zero value selects the boot disk.
+type DiskSelector struct {
+	Name string // Select the disk with this name
+	All  bool   // Select every disk
+}
+
+// String describes the selection for messages
+func (s DiskSelector) String() string {
+	switch {
+	case s.All:
+		return "all disks"
+	case s.Name != "":
+		return "disk " + s.Name
+	default:
+		return "boot disk"
+	}
+}
+
+// Select returns the names of the selected disks, boot disk first
+func (s DiskSelector) Select(instance Instance) ([]string, error) {
+	bootDisk := instance.BootDisk()
+	if bootDisk == nil {
+		return nil, fmt.Errorf("instance has no disks")
+	}
+
+	switch {
+	case s.All:
+		names := []string{bootDisk.Name}
+		for _, disk := range instance.Disks {
+			if disk.Name != bootDisk.Name {
+				names = append(names, disk.Name)
+			}
+		}
+		return names, nil
+	case s.Name != "":
+		for _, disk := range instance.Disks {
+			if disk.Name == s.Name {
+				return []string{disk.Name}, nil
+			}
+		}
+		return nil, fmt.Errorf("disk %s is not attached to the instance", s.Name)
+	default:
+		return []string{bootDisk.Name}, nil
+	}
+}
+
+// LicenseEdit adds and removes individual licenses. Licenses are project:code values or URLs.
+type LicenseEdit struct {
+	Add    []string
+	Remove []string
+}
+
+// String describes the edit, e.g. "+rhel-cloud:rhel-9-server -rhel-cloud:rhel-9-byos"
+func (e LicenseEdit) String() string {
+	var parts []string
+	for _, license := range e.Add {
+		parts = append(parts, "+"+licenseCodeFromURL(licenseURLFromCode(license)))
+	}
+	for _, license := range e.Remove {
+		parts = append(parts, "-"+licenseCodeFromURL(licenseURLFromCode(license)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Apply returns the license URLs a disk carries after the edit. Removing a license the
+// disk does not carry is an error so a mistyped code never goes unnoticed.
+func (e LicenseEdit) Apply(current []string) ([]string, error) {
+	remove := make(map[string]bool)
+	for _, license := range e.Remove {
+		code := licenseCodeFromURL(licenseURLFromCode(license))
+		found := false
+		for _, existing := range current {
+			if licenseCodeFromURL(existing) == code {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("disk does not carry %s", code)
+		}
+		remove[code] = true
+	}
+
+	result := []string{}
+	present := make(map[string]bool)
+	for _, existing := range current {
+		code := licenseCodeFromURL(existing)
+		if remove[code] {
+			continue
+		}
+		result = append(result, existing)
+		present[code] = true
+	}
+
+	for _, license := range e.Add {
+		url := licenseURLFromCode(license)
+		if !present[licenseCodeFromURL(url)] {
+			result = append(result, url)
+			present[licenseCodeFromURL(url)] = true
+		}
+	}
+
+	return result, nil
+}
+
+// diskPlanFunc decides the new licenses of one disk. It returns the new licenses and the
+// rule or edit that chose them, or a reason to skip the disk.
+type diskPlanFunc func(disk *compute.Disk, boot bool) (newLicenses []string, rule, target, skipped string)
+
+// planDisks builds a plan with one item per selected disk of every instance
+func planDisks(ctx context.Context, instances []Instance, direction ConversionDirection, selector DiskSelector,
+	computeService *compute.Service, decide diskPlanFunc) (*ConversionPlan, error) {
+	plan := &ConversionPlan{Direction: direction, CreatedAt: time.Now().UTC()}
+
+	for _, instance := range instances {
+		if plan.Project == "" {
+			plan.Project = instance.Project
+		}
+
+		item := PlanItem{
+			Instance:    instance.Name,
+			Zone:        instance.Zone,
+			Project:     instance.Project,
+			Status:      instance.Status,
+			MachineType: instance.MachineType,
+		}
+
+		// Get the instance object to find disk details
+		instanceObj, err := computeService.Instances.Get(instance.Project, instance.Zone, instance.Name).Context(ctx).Do()
+		if err != nil {
+			item.Skipped = fmt.Sprintf("error getting instance details: %v", err)
+			plan.Items = append(plan.Items, item)
+			continue
+		}
+
+		// Select disks through the same model used for display and export
+		live := instanceFromAPI(instance.Project, instance.Zone, instanceObj, nil)
+		diskNames, err := selector.Select(live)
+		if err != nil {
+			item.Skipped = err.Error()
+			plan.Items = append(plan.Items, item)
+			continue
+		}
+
+		for i, diskName := range diskNames {
+			diskItem := item
+			diskItem.Disk = diskName
+			boot := i == 0 && live.BootDisk().Name == diskName
+
+			// Read the disk itself so the plan records its real current licenses
+			disk, err := computeService.Disks.Get(instance.Project, instance.Zone, diskName).Context(ctx).Do()
+			if err != nil {
+				diskItem.Skipped = fmt.Sprintf("error getting disk details: %v", err)
+				plan.Items = append(plan.Items, diskItem)
+				continue
+			}
+			diskItem.CurrentLicenses = disk.Licenses
+
+			newLicenses, rule, target, skipped := decide(disk, boot)
+			if skipped != "" {
+				// With -all-disks only the boot disk is reported when nothing applies
+				if selector.All && !boot {
+					continue
+				}
+				diskItem.Skipped = skipped
+				plan.Items = append(plan.Items, diskItem)
+				continue
+			}
+
+			// Disks that would change go through the safety checks; a block keeps them out of the run
+			diskItem.Checks = RunSafetyChecks(SafetyTarget{Direction: direction, Instance: instanceObj, Disk: disk, Boot: boot})
+			if blocked := blockReason(diskItem.Checks); blocked != "" {
+				diskItem.Skipped = blocked
+				plan.Items = append(plan.Items, diskItem)
+				continue
+			}
+
+			// Use paths=licenses so only the licenses field is replaced
+			body, err := json.Marshal(diskPatchBody{Name: diskName, Licenses: newLicenses})
+			if err != nil {
+				return nil, fmt.Errorf("failed to build request body for %s: %v", instance.Name, err)
+			}
+
+			diskItem.TargetLicense = target
+			diskItem.NewLicenses = newLicenses
+			diskItem.Rule = rule
+			diskItem.Method = "PATCH"
+			diskItem.URL = diskPatchURL(instance.Project, instance.Zone, diskName)
+			diskItem.Body = string(body)
+			plan.Items = append(plan.Items, diskItem)
+		}
+	}
+
+	return plan, nil
+}
+
+// PlanLicenseEdit plans adding and removing individual licenses on the selected disks.
+// The plan is applied with ApplyPlan, so it is journaled, verified and can be rolled back.
+func PlanLicenseEdit(ctx context.Context, instances []Instance, selector DiskSelector, edit LicenseEdit,
+	computeService *compute.Service) (*ConversionPlan, error) {
+	if len(edit.Add) == 0 && len(edit.Remove) == 0 {
+		return nil, fmt.Errorf("no licenses to add or remove")
+	}
+
+	return planDisks(ctx, instances, EditLicenses, selector, computeService,
+		func(disk *compute.Disk, boot bool) ([]string, string, string, string) {
+			newLicenses, err := edit.Apply(disk.Licenses)
+			if err != nil {
+				return nil, "", "", err.Error()
+			}
+			if sameLicenses(newLicenses, disk.Licenses) {
+				return nil, "", "", "disk already has the requested licenses"
+			}
+			return newLicenses, "edit " + edit.String(), "", ""
+		})
+}
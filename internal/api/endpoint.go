@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultAlphaEndpoint is where disk license PATCH requests go unless SetAlphaEndpoint overrides it
+const defaultAlphaEndpoint = "https://www.googleapis.com/compute/alpha/"
+
+// alphaEndpoint holds the base URL and HTTP client used for the alpha disk API
+var alphaEndpoint = struct {
+	sync.RWMutex
+	baseURL string
+	client  *http.Client
+}{baseURL: defaultAlphaEndpoint}
+
+// SetAlphaEndpoint points disk license updates at another server, such as a local fake in tests.
+// An empty baseURL restores the public endpoint and a nil client clears the client.
+func SetAlphaEndpoint(baseURL string, client *http.Client) {
+	if baseURL == "" {
+		baseURL = defaultAlphaEndpoint
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	alphaEndpoint.Lock()
+	defer alphaEndpoint.Unlock()
+	alphaEndpoint.baseURL = baseURL
+	alphaEndpoint.client = client
+}
+
+// SetAlphaClient sets the authorized client for disk license updates and keeps the endpoint.
+// It should share its token source with the Compute service so both act as the same account.
+func SetAlphaClient(client *http.Client) {
+	alphaEndpoint.Lock()
+	defer alphaEndpoint.Unlock()
+	alphaEndpoint.client = client
+}
+
+// diskPatchURL is the alpha URL that replaces only the licenses field of a disk
+func diskPatchURL(project, zone, disk string) string {
+	alphaEndpoint.RLock()
+	defer alphaEndpoint.RUnlock()
+	return fmt.Sprintf("%sprojects/%s/zones/%s/disks/%s?paths=licenses", alphaEndpoint.baseURL, project, zone, disk)
+}
+
+// alphaHTTPClient returns the client set with SetAlphaClient or SetAlphaEndpoint. There is no
+// fallback to application default credentials, so a change never runs as a different account.
+func alphaHTTPClient() (*http.Client, error) {
+	alphaEndpoint.RLock()
+	defer alphaEndpoint.RUnlock()
+
+	if alphaEndpoint.client == nil {
+		return nil, fmt.Errorf("no authorized HTTP client for the alpha disk API; call SetAlphaClient first")
+	}
+	return alphaEndpoint.client, nil
+}
@@ -3,46 +3,236 @@ package api
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-// InstanceExport represents the simplified instance data for export
+// ExportSchemaVersion is the version of the export document written by ExportInstancesToYAML.
+// Files with a newer version are refused rather than misread.
+const ExportSchemaVersion = 1
+
+// ToolVersion is recorded in export headers. Release builds set it with
+// -ldflags "-X gcp-instance-explorer/internal/api.ToolVersion=<version>".
+var ToolVersion = "dev"
+
+// ExportHeader describes where and when an export was taken
+type ExportHeader struct {
+	SchemaVersion int       `yaml:"schemaVersion" json:"schemaVersion"`
+	Project       string    `yaml:"project" json:"project"`
+	ExportedAt    time.Time `yaml:"exportedAt" json:"exportedAt"`
+	ToolVersion   string    `yaml:"toolVersion" json:"toolVersion"`
+	Principal     string    `yaml:"principal,omitempty" json:"principal,omitempty"`
+	Filter        string    `yaml:"filter,omitempty" json:"filter,omitempty"` // -filter expression the instances were selected with
+}
+
+// NewExportHeader returns the header of an export of a project taken now
+func NewExportHeader(projectID, principal, filter string) ExportHeader {
+	return ExportHeader{
+		SchemaVersion: ExportSchemaVersion,
+		Project:       projectID,
+		ExportedAt:    time.Now().UTC().Truncate(time.Second),
+		ToolVersion:   ToolVersion,
+		Principal:     principal,
+		Filter:        filter,
+	}
+}
+
+// Validate checks that an export can drive a change in a project: it has a header this version
+// understands, belongs to the project and, when maxAge is not zero, is no older than maxAge
+func (h ExportHeader) Validate(projectID string, maxAge time.Duration, now time.Time) error {
+	switch {
+	case h.SchemaVersion == 0:
+		return fmt.Errorf("file has no export header; export the instance list again")
+	case h.SchemaVersion > ExportSchemaVersion:
+		return fmt.Errorf("file has export schema version %d, this version of the tool reads up to %d",
+			h.SchemaVersion, ExportSchemaVersion)
+	case h.Project != projectID:
+		return fmt.Errorf("file is an export of project %s, not %s", h.Project, projectID)
+	case maxAge > 0 && now.Sub(h.ExportedAt) > maxAge:
+		return fmt.Errorf("export was taken %s ago at %s, more than the allowed %s; export the instance list again",
+			now.Sub(h.ExportedAt).Round(time.Minute), h.ExportedAt.Format(time.RFC3339), maxAge)
+	}
+	return nil
+}
+
+// String describes the header in one line
+func (h ExportHeader) String() string {
+	if h.SchemaVersion == 0 {
+		return "no export header"
+	}
+	description := fmt.Sprintf("project %s exported at %s by %s with version %s", h.Project,
+		h.ExportedAt.Format(time.RFC3339), orDash(h.Principal), h.ToolVersion)
+	if h.Filter != "" {
+		description += fmt.Sprintf(", filter %q", h.Filter)
+	}
+	return description
+}
+
+// InstanceExportDocument is an export file: the header followed by the instances
+type InstanceExportDocument struct {
+	Header    ExportHeader     `yaml:"header" json:"header"`
+	Instances []InstanceExport `yaml:"instances" json:"instances"`
+}
+
+// DefaultExportFile is the export file of a project that the Mass Mover reads
+func DefaultExportFile(projectID string) string {
+	return fmt.Sprintf("%s-instances.yml", projectID)
+}
+
+// TimestampedFile inserts the time before the extension, e.g. p-instances-20250101-120000.yml
+func TimestampedFile(filename string, t time.Time) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + t.UTC().Format("20060102-150405") + ext
+}
+
+// InstanceExport represents the instance data for export. Licenses are those of the boot disk;
+// every disk, including its licenses, is listed under Disks.
 type InstanceExport struct {
-	Name        string   `yaml:"name"`
-	Zone        string   `yaml:"zone"`
-	MachineType string   `yaml:"machineType"`
-	Status      string   `yaml:"status"`
-	Licenses    []string `yaml:"licenses,omitempty"`
+	Project           string            `yaml:"project,omitempty" json:"project,omitempty"`
+	Name              string            `yaml:"name" json:"name"`
+	Zone              string            `yaml:"zone" json:"zone"`
+	ID                string            `yaml:"id,omitempty" json:"id,omitempty"`
+	SelfLink          string            `yaml:"selfLink,omitempty" json:"selfLink,omitempty"`
+	MachineType       string            `yaml:"machineType" json:"machineType"`
+	Status            string            `yaml:"status" json:"status"`
+	CPUPlatform       string            `yaml:"cpuPlatform,omitempty" json:"cpuPlatform,omitempty"`
+	CreationTimestamp string            `yaml:"creationTimestamp,omitempty" json:"creationTimestamp,omitempty"`
+	SourceImage       string            `yaml:"sourceImage,omitempty" json:"sourceImage,omitempty"`
+	Licenses          []string          `yaml:"licenses,omitempty" json:"licenses,omitempty"`
+	MappingRule       string            `yaml:"mappingRule,omitempty" json:"mappingRule,omitempty"`
+	GuestOSFeatures   []string          `yaml:"guestOsFeatures,omitempty" json:"guestOsFeatures,omitempty"`
+	Labels            map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	MetadataKeys      []string          `yaml:"metadataKeys,omitempty" json:"metadataKeys,omitempty"`
+	ServiceAccounts   []string          `yaml:"serviceAccounts,omitempty" json:"serviceAccounts,omitempty"`
+	Disks             []DiskExport      `yaml:"disks,omitempty" json:"disks,omitempty"`
+	ManagedBy         string            `yaml:"managedBy,omitempty" json:"managedBy,omitempty"`
 }
 
-// ExportInstancesToYAML exports instances to a YAML file with selected fields only
-func ExportInstancesToYAML(instances []Instance, projectID string) error {
-	// Create filename based on project ID
-	filename := fmt.Sprintf("%s-instances.yml", projectID)
+// DiskExport is one attached disk in an instance export
+type DiskExport struct {
+	Name        string   `yaml:"name" json:"name"`
+	Boot        bool     `yaml:"boot" json:"boot"`
+	Type        string   `yaml:"type,omitempty" json:"type,omitempty"`
+	Mode        string   `yaml:"mode,omitempty" json:"mode,omitempty"`
+	SizeGB      int64    `yaml:"sizeGb" json:"sizeGb"`
+	SourceImage string   `yaml:"sourceImage,omitempty" json:"sourceImage,omitempty"`
+	Licenses    []string `yaml:"licenses,omitempty" json:"licenses,omitempty"`
+}
 
-	// Create simplified export list with only the fields we want
+// ExportInstancesToYAML exports instances with selected fields only to a YAML file, after the
+// header. An empty filename writes the project's DefaultExportFile.
+func ExportInstancesToYAML(instances []Instance, header ExportHeader, filename string) error {
+	if filename == "" {
+		filename = DefaultExportFile(header.Project)
+	}
+
+	// Convert to YAML
+	yamlData, err := yaml.Marshal(InstanceExportDocument{Header: header, Instances: ToInstanceExports(instances)})
+	if err != nil {
+		return fmt.Errorf("failed to marshal instances to YAML: %v", err)
+	}
+
+	// Write to file
+	err = os.WriteFile(filename, yamlData, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write YAML to file: %v", err)
+	}
+
+	return nil
+}
+
+// LoadInstanceExport reads an export file written by ExportInstancesToYAML. Older exports,
+// which hold a bare list, and multi-project inventories written by ExportInventoryToYAML are
+// read too; their header is empty.
+func LoadInstanceExport(filename string) (*InstanceExportDocument, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+
+	var instances []InstanceExport
+	if err := yaml.Unmarshal(data, &instances); err == nil {
+		return &InstanceExportDocument{Instances: instances}, nil
+	}
+
+	var document InstanceExportDocument
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("error parsing YAML: %v", err)
+	}
+	return &document, nil
+}
+
+// ToInstanceExports converts instances to the simplified export format
+func ToInstanceExports(instances []Instance) []InstanceExport {
 	var exportData []InstanceExport
 	for _, instance := range instances {
 		exportInstance := InstanceExport{
-			Name:        instance.Name,
-			Zone:        instance.Zone,
-			MachineType: instance.MachineType,
-			Status:      instance.Status,
-			Licenses:    instance.LicenseCodes,
+			Project:           instance.Project,
+			Name:              instance.Name,
+			Zone:              instance.Zone,
+			ID:                instance.ID,
+			SelfLink:          instance.SelfLink,
+			MachineType:       instance.MachineType,
+			Status:            instance.Status,
+			CPUPlatform:       instance.CPUPlatform,
+			CreationTimestamp: instance.CreationTimestamp,
+			SourceImage:       instance.SourceImage,
+			Licenses:          instance.LicenseCodes,
+			GuestOSFeatures:   instance.GuestOSFeatures,
+			Labels:            instance.Labels,
+			MetadataKeys:      instance.MetadataKeys,
+			ServiceAccounts:   instance.ServiceAccounts,
+			ManagedBy:         instance.ManagedBy,
+		}
+		for _, disk := range instance.Disks {
+			diskType := disk.DiskType
+			if diskType == "" {
+				diskType = disk.Type
+			}
+			exportInstance.Disks = append(exportInstance.Disks, DiskExport{
+				Name:        disk.Name,
+				Boot:        disk.Boot,
+				Type:        diskType,
+				Mode:        disk.Mode,
+				SizeGB:      disk.SizeGB,
+				SourceImage: disk.SourceImage,
+				Licenses:    disk.Licenses,
+			})
+		}
+		if rule := MappingRuleFor(instance); rule != "-" {
+			exportInstance.MappingRule = rule
 		}
 		exportData = append(exportData, exportInstance)
 	}
+	return exportData
+}
+
+// InventoryExport is the combined export of a multi-project inventory
+type InventoryExport struct {
+	Projects  []string             `yaml:"projects" json:"projects"`
+	Instances []InstanceExport     `yaml:"instances" json:"instances"`
+	Errors    []ProjectErrorExport `yaml:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// ProjectErrorExport records a project that could not be inventoried
+type ProjectErrorExport struct {
+	Project string `yaml:"project" json:"project"`
+	Error   string `yaml:"error" json:"error"`
+}
+
+// ExportInventoryToYAML writes a multi-project inventory, including its per-project errors, to a file
+func ExportInventoryToYAML(inventory *Inventory, filename string) error {
+	exportData := ToInventoryExport(inventory)
 
-	// Convert to YAML
 	yamlData, err := yaml.Marshal(exportData)
 	if err != nil {
-		return fmt.Errorf("failed to marshal instances to YAML: %v", err)
+		return fmt.Errorf("failed to marshal inventory to YAML: %v", err)
 	}
 
-	// Write to file
-	err = os.WriteFile(filename, yamlData, 0644)
-	if err != nil {
+	if err := os.WriteFile(filename, yamlData, 0644); err != nil {
 		return fmt.Errorf("failed to write YAML to file: %v", err)
 	}
 
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckInstancesFromFileValidatesHeader(t *testing.T) {
+	live := []Instance{{Project: "proj", Zone: "us-central1-a", Name: "rhel", ID: "1"}}
+	dir := t.TempDir()
+
+	write := func(name string, header ExportHeader) string {
+		filename := filepath.Join(dir, name)
+		if err := ExportInstancesToYAML(live, header, filename); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	stale := NewExportHeader("proj", "tester@example.com", "")
+	stale.ExportedAt = stale.ExportedAt.Add(-30 * 24 * time.Hour)
+	newer := NewExportHeader("proj", "", "")
+	newer.SchemaVersion = ExportSchemaVersion + 1
+
+	legacy := filepath.Join(dir, "legacy.yml")
+	if err := os.WriteFile(legacy, []byte("- name: rhel\n  zone: us-central1-a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file   string
+		maxAge time.Duration
+		want   string // error substring, or "" when the file is accepted
+	}{
+		{write("ok.yml", NewExportHeader("proj", "tester@example.com", "license~byos")), DefaultExportMaxAge, ""},
+		{write("other.yml", NewExportHeader("other-proj", "", "")), DefaultExportMaxAge, "export of project other-proj, not proj"},
+		{write("stale.yml", stale), DefaultExportMaxAge, "export the instance list again"},
+		{filepath.Join(dir, "stale.yml"), 0, ""},
+		{write("newer.yml", newer), 0, "schema version 2"},
+		{legacy, 0, "no export header"},
+	}
+
+	for _, test := range tests {
+		matched, err := CheckInstancesFromFile("proj", live, FileCheckOptions{File: test.file, MaxAge: test.maxAge})
+		switch {
+		case test.want == "" && (err != nil || len(matched) != 1):
+			t.Errorf("%s: matched %d, %v; want the instance", filepath.Base(test.file), len(matched), err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: error = %v, want %q", filepath.Base(test.file), err, test.want)
+		}
+	}
+}
+
+func TestTimestampedFile(t *testing.T) {
+	at := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	if got := TimestampedFile("exports/p-instances.yml", at); got != "exports/p-instances-20250102-030405.yml" {
+		t.Errorf("TimestampedFile = %s", got)
+	}
+}
+
+func TestCheckInstancesFromFileRefusesChangedInstances(t *testing.T) {
+	exported := []Instance{
+		{Project: "proj", Zone: "us-central1-a", Name: "same", ID: "1", LicenseCodes: []string{"rhel-cloud:rhel-9-byos"}},
+		{Project: "proj", Zone: "us-central1-a", Name: "recreated", ID: "2", LicenseCodes: []string{"rhel-cloud:rhel-9-byos"}},
+		{Project: "proj", Zone: "us-central1-a", Name: "relicensed", ID: "3", LicenseCodes: []string{"rhel-cloud:rhel-9-byos"}},
+		{Project: "proj", Zone: "us-central1-a", Name: "no-id", LicenseCodes: []string{"rhel-cloud:rhel-9-byos"}},
+		{Project: "proj", Zone: "us-central1-a", Name: "new-disk", ID: "5", LicenseCodes: []string{"rhel-cloud:rhel-9-byos"},
+			Disks: []AttachedDisk{{Name: "new-disk", Boot: true, Licenses: []string{"rhel-cloud:rhel-9-byos"}}}},
+	}
+	filename := filepath.Join(t.TempDir(), "proj-instances.yml")
+	if err := ExportInstancesToYAML(exported, NewExportHeader("proj", "", ""), filename); err != nil {
+		t.Fatal(err)
+	}
+
+	live := append([]Instance{}, exported...)
+	live[1].ID = "20"
+	live[2].LicenseCodes = []string{"rhel-cloud:rhel-9-server"}
+	live[3].ID = "4"
+	live[4].Disks = append(live[4].Disks[:1:1], AttachedDisk{Name: "sap-data", Licenses: []string{"rhel-sap-cloud:rhel-9-sap-byos"}})
+
+	_, err := CheckInstancesFromFile("proj", live, FileCheckOptions{File: filename})
+	if err == nil || !strings.Contains(err.Error(), "4 instances changed") ||
+		!strings.Contains(err.Error(), "recreated (ID 2 in the file, 20 now)") ||
+		!strings.Contains(err.Error(), "boot disk licenses are rhel-cloud:rhel-9-server now, the file has rhel-cloud:rhel-9-byos") ||
+		!strings.Contains(err.Error(), "no-id: the file has no instance ID") ||
+		!strings.Contains(err.Error(), "disk sap-data with licenses rhel-sap-cloud:rhel-9-sap-byos was attached since the export") {
+		t.Errorf("error = %v, want every changed instance refused", err)
+	}
+
+	matched, err := CheckInstancesFromFile("proj", live, FileCheckOptions{File: filename, SkipChanged: true})
+	if err != nil || len(matched) != 1 || matched[0].Name != "same" {
+		t.Errorf("with SkipChanged matched %+v, %v; want only the unchanged instance", matched, err)
+	}
+}
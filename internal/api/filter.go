@@ -0,0 +1,279 @@
+package api
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// InstanceFilter selects instances with an expression such as
+// "license~rhel-8 AND status=RUNNING AND label.env=prod AND zone=us-central1-*".
+//
+// Terms are joined with AND. Each term is <field><op><value> where op is one of
+//
+//	=   equal, * in the value matches any run of characters
+//	!=  not equal, same wildcard rules
+//	~   regular expression match
+//	!~  regular expression non-match
+//
+// Fields are name, zone, status, machineType, project, license, mig and label.<key>.
+// A license term matches when any license code of any of the instance's disks matches. mig is the name of
+// the managed instance group an instance belongs to, empty for standalone instances.
+type InstanceFilter struct {
+	Expression string
+	terms      []filterTerm
+}
+
+// filterTerm is one field comparison of a filter
+type filterTerm struct {
+	Field   string
+	Op      string
+	Value   string
+	pattern *regexp.Regexp
+}
+
+// ParseFilter parses a filter expression; an empty expression returns a nil filter that matches everything
+func ParseFilter(expression string) (*InstanceFilter, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return nil, nil
+	}
+
+	filter := &InstanceFilter{Expression: expression}
+	for _, part := range splitFilterTerms(expression) {
+		term, err := parseFilterTerm(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter term %q: %v", part, err)
+		}
+		filter.terms = append(filter.terms, term)
+	}
+
+	return filter, nil
+}
+
+// splitFilterTerms splits on AND keywords that are not inside quotes
+func splitFilterTerms(expression string) []string {
+	var parts []string
+	var current strings.Builder
+	var quote rune
+
+	words := strings.Fields(expression)
+	for i, word := range words {
+		if quote == 0 && strings.EqualFold(word, "AND") {
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+
+		if current.Len() > 0 {
+			current.WriteByte(' ')
+		}
+		current.WriteString(word)
+
+		// Track whether we are inside a quoted value across words
+		for _, r := range word {
+			switch {
+			case quote == 0 && (r == '"' || r == '\''):
+				quote = r
+			case r == quote:
+				quote = 0
+			}
+		}
+
+		if i == len(words)-1 {
+			parts = append(parts, current.String())
+		}
+	}
+
+	return parts
+}
+
+// parseFilterTerm parses a single <field><op><value> term
+func parseFilterTerm(term string) (filterTerm, error) {
+	opIndex := strings.IndexAny(term, "!=~")
+	if opIndex <= 0 {
+		return filterTerm{}, fmt.Errorf("expected <field><op><value> with op =, !=, ~ or !~")
+	}
+
+	op := term[opIndex : opIndex+1]
+	if op == "!" {
+		if opIndex+1 >= len(term) || (term[opIndex+1] != '=' && term[opIndex+1] != '~') {
+			return filterTerm{}, fmt.Errorf("expected != or !~")
+		}
+		op = term[opIndex : opIndex+2]
+	}
+
+	parsed := filterTerm{
+		Field: strings.TrimSpace(term[:opIndex]),
+		Op:    op,
+		Value: unquote(strings.TrimSpace(term[opIndex+len(op):])),
+	}
+
+	switch {
+	case parsed.Field == "name", parsed.Field == "zone", parsed.Field == "status",
+		parsed.Field == "machineType", parsed.Field == "project", parsed.Field == "license", parsed.Field == "mig":
+	case strings.HasPrefix(parsed.Field, "label.") && len(parsed.Field) > len("label."):
+	default:
+		return filterTerm{}, fmt.Errorf("unknown field %q", parsed.Field)
+	}
+
+	if op == "~" || op == "!~" {
+		pattern, err := regexp.Compile(parsed.Value)
+		if err != nil {
+			return filterTerm{}, fmt.Errorf("invalid regular expression: %v", err)
+		}
+		parsed.pattern = pattern
+	}
+
+	return parsed, nil
+}
+
+// unquote strips one pair of matching quotes
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Match reports whether an instance satisfies every term. A nil filter matches everything.
+func (f *InstanceFilter) Match(instance Instance) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, term := range f.terms {
+		if !term.match(instance) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchExport reports whether an exported instance satisfies every term, in the same way as Match
+func (f *InstanceFilter) MatchExport(instance InstanceExport) bool {
+	var disks []AttachedDisk
+	for _, disk := range instance.Disks {
+		disks = append(disks, AttachedDisk{Name: disk.Name, Boot: disk.Boot, Licenses: disk.Licenses})
+	}
+	return f.Match(Instance{
+		Project:      instance.Project,
+		Name:         instance.Name,
+		Zone:         instance.Zone,
+		Status:       instance.Status,
+		MachineType:  instance.MachineType,
+		LicenseCodes: instance.Licenses,
+		Labels:       instance.Labels,
+		ManagedBy:    instance.ManagedBy,
+		Disks:        disks,
+	})
+}
+
+// match applies one term to an instance
+func (t filterTerm) match(instance Instance) bool {
+	var values []string
+	switch {
+	case t.Field == "name":
+		values = []string{instance.Name}
+	case t.Field == "zone":
+		values = []string{instance.Zone}
+	case t.Field == "status":
+		values = []string{instance.Status}
+	case t.Field == "machineType":
+		values = []string{instance.MachineType}
+	case t.Field == "project":
+		values = []string{instance.Project}
+	case t.Field == "license":
+		// Data disks can carry licenses of their own; LicenseCodes holds the boot disk's
+		values = append([]string{}, instance.LicenseCodes...)
+		for _, disk := range instance.Disks {
+			values = append(values, disk.Licenses...)
+		}
+	case t.Field == "mig":
+		values = []string{resourceName(instance.ManagedBy)}
+	default:
+		// A missing label compares as the empty string
+		values = []string{instance.Labels[strings.TrimPrefix(t.Field, "label.")]}
+	}
+
+	anyMatch := false
+	for _, value := range values {
+		if t.compare(value) {
+			anyMatch = true
+			break
+		}
+	}
+
+	// Negated terms hold only when no value matches
+	if t.Op == "!=" || t.Op == "!~" {
+		return !anyMatch
+	}
+	return anyMatch
+}
+
+// compare tests one value against the term, ignoring negation
+func (t filterTerm) compare(value string) bool {
+	if t.pattern != nil {
+		return t.pattern.MatchString(value)
+	}
+
+	if strings.Contains(t.Value, "*") {
+		matched, err := path.Match(t.Value, value)
+		return err == nil && matched
+	}
+
+	// Status is case-insensitive; everything else must match exactly, as it does server-side
+	if t.Field == "status" {
+		return strings.EqualFold(value, t.Value)
+	}
+	return value == t.Value
+}
+
+// APIFilter returns the part of the filter the Compute API can evaluate server-side:
+// exact name, status and label equality. Everything is still checked client-side.
+func (f *InstanceFilter) APIFilter() string {
+	if f == nil {
+		return ""
+	}
+
+	var parts []string
+	for _, term := range f.terms {
+		if term.Op != "=" || strings.ContainsAny(term.Value, "*\"") {
+			continue
+		}
+
+		field := term.Field
+		switch {
+		case field == "name":
+		case field == "status":
+		case strings.HasPrefix(field, "label."):
+			field = "labels." + strings.TrimPrefix(field, "label.")
+		default:
+			continue
+		}
+
+		value := term.Value
+		if field == "status" {
+			value = strings.ToUpper(value)
+		}
+		parts = append(parts, fmt.Sprintf(`(%s %s "%s")`, field, term.Op, value))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// FilterInstances returns the instances that match the filter
+func FilterInstances(instances []Instance, filter *InstanceFilter) []Instance {
+	if filter == nil {
+		return instances
+	}
+
+	var matched []Instance
+	for _, instance := range instances {
+		if filter.Match(instance) {
+			matched = append(matched, instance)
+		}
+	}
+	return matched
+}
@@ -6,106 +6,69 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 
+	"gcp-instance-explorer/internal/audit"
+	"gcp-instance-explorer/pkg/models"
+
 	"google.golang.org/api/compute/v1"
 )
 
-// Instance represents a GCP compute instance with relevant information
-type Instance struct {
-	Name         string
-	Zone         string
-	MachineType  string
-	Status       string
-	IP           string
-	LicenseCodes []string // License codes
-	DiskType     string   // Disk type
-	DiskSizeGB   int64    // Disk size
-	Project      string   // Add project ID
-}
+// Instance is the instance model shared with pkg/models. It holds every attached disk with its
+// licenses; LicenseCodes, DiskType and DiskSizeGB describe the boot disk.
+type Instance = models.Instance
+
+// AttachedDisk is one disk of an Instance
+type AttachedDisk = models.AttachedDisk
 
 // ListInstances retrieves all instances in the specified project
 func ListInstances(ctx context.Context, projectID string, computeService *compute.Service) ([]Instance, error) {
+	return ListInstancesFiltered(ctx, projectID, computeService, nil)
+}
+
+// ListInstancesFiltered retrieves the instances in the project that match filter. The parts of
+// the filter the API understands are pushed down to AggregatedList; the rest is applied here.
+func ListInstancesFiltered(ctx context.Context, projectID string, computeService *compute.Service, filter *InstanceFilter) ([]Instance, error) {
+	apiFilter := filter.APIFilter()
+	instances, err := listInstances(ctx, projectID, computeService, apiFilter)
+	if err != nil && apiFilter != "" {
+		// Fall back to filtering everything locally if the API rejects the pushed-down filter
+		progressf("Warning: server-side filter %q failed (%v), filtering locally\n", apiFilter, err)
+		instances, err = listInstances(ctx, projectID, computeService, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return FilterInstances(instances, filter), nil
+}
+
+// listInstances runs AggregatedList with an optional API filter
+func listInstances(ctx context.Context, projectID string, computeService *compute.Service, apiFilter string) ([]Instance, error) {
 	// Get instances across all zones using AggregatedList
 	req := computeService.Instances.AggregatedList(projectID)
-	var instances []Instance
+	if apiFilter != "" {
+		req = req.Filter(apiFilter)
+	}
+	// Collect the API resources first; disks are only listed when there are instances
+	type zonedInstance struct {
+		zone     string
+		instance *compute.Instance
+	}
+	var found []zonedInstance
 
 	// Make the API call
 	if err := req.Pages(ctx, func(page *compute.InstanceAggregatedList) error {
 		// Iterate through the items (zones)
 		for zoneKey, instanceList := range page.Items {
-			// Skip if no instances in this zone
-			if instanceList.Instances == nil || len(instanceList.Instances) == 0 {
-				continue
-			}
-
 			// Extract zone name from the key
 			zoneName := strings.TrimPrefix(zoneKey, "zones/")
 
-			// Process each instance in this zone
 			for _, instance := range instanceList.Instances {
-				// Extract machine type shortname
-				machineType := instance.MachineType
-				if parts := strings.Split(machineType, "/"); len(parts) > 0 {
-					machineType = parts[len(parts)-1]
-				}
-
-				// Get external IP if available
-				var ip string
-				if len(instance.NetworkInterfaces) > 0 && len(instance.NetworkInterfaces[0].AccessConfigs) > 0 {
-					ip = instance.NetworkInterfaces[0].AccessConfigs[0].NatIP
-				}
-
-				// Extract license information from disks
-				var licenseCodes []string
-				var diskType string
-				var diskSizeGB int64
-
-				if len(instance.Disks) > 0 {
-					// Use the boot disk (first disk) for license info
-					bootDisk := instance.Disks[0]
-
-					// For disk type, we only have the interface type (SCSI, NVME, etc.)
-					// and disk type (PERSISTENT, SCRATCH)
-					diskType = bootDisk.Type
-					if bootDisk.Interface != "" {
-						diskType = bootDisk.Interface + "-" + diskType
-					}
-
-					diskSizeGB = bootDisk.DiskSizeGb
-
-					// Extract licenses from the boot disk
-					for _, license := range bootDisk.Licenses {
-						// Extract just the license name from the full URL
-						licenseName := path.Base(license)
-
-						// Try to extract the  license code
-						parts := strings.Split(license, "/")
-						if len(parts) >= 6 {
-							// Format is usually: https://www.googleapis.com/compute/v1/projects/PROJECT/global/licenses/LICENSE
-							project := parts[len(parts)-4]
-							licenseCode := parts[len(parts)-1]
-							licenseCodes = append(licenseCodes, fmt.Sprintf("%s:%s", project, licenseCode))
-						} else {
-							// Fallback if the format is different
-							licenseCodes = append(licenseCodes, licenseName)
-						}
-					}
-				}
-
-				// Add instance to our list
-				instances = append(instances, Instance{
-					Name:         instance.Name,
-					Zone:         zoneName,
-					MachineType:  machineType,
-					Status:       instance.Status,
-					IP:           ip,
-					LicenseCodes: licenseCodes,
-					DiskType:     diskType,
-					DiskSizeGB:   diskSizeGB,
-					Project:      projectID,
-				})
+				found = append(found, zonedInstance{zone: zoneName, instance: instance})
 			}
 		}
 		return nil
@@ -113,33 +76,181 @@ func ListInstances(ctx context.Context, projectID string, computeService *comput
 		return nil, fmt.Errorf("failed to list instances: %v", err)
 	}
 
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	// Disk details such as the source image are not part of the instance resource
+	disks, err := listDisks(ctx, projectID, computeService)
+	if err != nil {
+		progressf("Warning: could not list disks of %s (%v), source images will be missing\n", projectID, err)
+	}
+
+	instances := make([]Instance, 0, len(found))
+	for _, f := range found {
+		instances = append(instances, instanceFromAPI(projectID, f.zone, f.instance, disks))
+	}
+
 	return instances, nil
 }
 
-// StartInstance turns on an instance
-func StartInstance(ctx context.Context, instance Instance, computeService *compute.Service) error {
+// listDisks returns every disk of a project keyed by its self link
+func listDisks(ctx context.Context, projectID string, computeService *compute.Service) (map[string]*compute.Disk, error) {
+	disks := make(map[string]*compute.Disk)
+	err := computeService.Disks.AggregatedList(projectID).Pages(ctx, func(page *compute.DiskAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, disk := range scoped.Disks {
+				disks[disk.SelfLink] = disk
+			}
+		}
+		return nil
+	})
+	return disks, err
+}
+
+// instanceFromAPI builds the instance model from the API resource. disks, which may be nil,
+// supplies details the attached disk entries lack.
+func instanceFromAPI(projectID, zone string, instance *compute.Instance, disks map[string]*compute.Disk) Instance {
+	result := Instance{
+		Name:              instance.Name,
+		Zone:              zone,
+		Project:           projectID,
+		SelfLink:          instance.SelfLink,
+		MachineType:       resourceName(instance.MachineType),
+		Status:            instance.Status,
+		CPUPlatform:       instance.CpuPlatform,
+		CreationTimestamp: instance.CreationTimestamp,
+		Labels:            instance.Labels,
+	}
+	if instance.Id != 0 {
+		result.ID = strconv.FormatUint(instance.Id, 10)
+	}
+
+	// Members of a managed instance group are recreated from its template, whatever their disks carry
+	result.ManagedBy = instanceGroupManager(instance)
+
+	if instance.Metadata != nil {
+		for _, item := range instance.Metadata.Items {
+			result.MetadataKeys = append(result.MetadataKeys, item.Key)
+		}
+		sort.Strings(result.MetadataKeys)
+	}
+
+	for _, account := range instance.ServiceAccounts {
+		result.ServiceAccounts = append(result.ServiceAccounts, account.Email)
+	}
+
+	if instance.Scheduling != nil {
+		result.Scheduling = models.Scheduling{
+			ProvisioningModel: instance.Scheduling.ProvisioningModel,
+			Preemptible:       instance.Scheduling.Preemptible,
+			OnHostMaintenance: instance.Scheduling.OnHostMaintenance,
+			AutomaticRestart:  instance.Scheduling.AutomaticRestart == nil || *instance.Scheduling.AutomaticRestart,
+		}
+	}
+
+	for _, nic := range instance.NetworkInterfaces {
+		networkInterface := models.NetworkInterface{
+			Name:    nic.Name,
+			Network: resourceName(nic.Network),
+			IP:      nic.NetworkIP,
+		}
+		for _, access := range nic.AccessConfigs {
+			if access.NatIP != "" {
+				networkInterface.ExternalIPs = append(networkInterface.ExternalIPs, access.NatIP)
+			}
+		}
+		// Keep the first external IP for the one-line displays
+		if result.IP == "" && len(networkInterface.ExternalIPs) > 0 {
+			result.IP = networkInterface.ExternalIPs[0]
+		}
+		result.NetworkInterfaces = append(result.NetworkInterfaces, networkInterface)
+	}
+
+	for _, attached := range instance.Disks {
+		disk := AttachedDisk{
+			Name:       resourceName(attached.Source),
+			DeviceName: attached.DeviceName,
+			Source:     attached.Source,
+			Boot:       attached.Boot,
+			Type:       attached.Type,
+			Interface:  attached.Interface,
+			Mode:       attached.Mode,
+			SizeGB:     attached.DiskSizeGb,
+			Licenses:   licenseCodesFromURLs(attached.Licenses),
+		}
+		for _, feature := range attached.GuestOsFeatures {
+			disk.GuestOSFeatures = append(disk.GuestOSFeatures, feature.Type)
+		}
+		if details, ok := disks[attached.Source]; ok {
+			disk.SourceImage = details.SourceImage
+			disk.DiskType = resourceName(details.Type)
+			if disk.SizeGB == 0 {
+				disk.SizeGB = details.SizeGb
+			}
+		}
+		result.Disks = append(result.Disks, disk)
+	}
+
+	// The boot disk decides the instance's license and image
+	if boot := result.BootDisk(); boot != nil {
+		result.LicenseCodes = boot.Licenses
+		result.DiskType = boot.Type
+		if boot.Interface != "" {
+			result.DiskType = boot.Interface + "-" + boot.Type
+		}
+		result.DiskSizeGB = boot.SizeGB
+		result.SourceImage = boot.SourceImage
+		result.GuestOSFeatures = boot.GuestOSFeatures
+	}
+
+	return result
+}
+
+// StartInstance turns on an instance and waits for the operation to finish
+func StartInstance(ctx context.Context, instance Instance, computeService *compute.Service) (err error) {
+	rec := audit.Record{Project: instance.Project, Resource: instanceResource(instance), Action: AuditStartInstance}
+	defer func() { auditAction(rec, err) }()
+
 	op, err := computeService.Instances.Start(instance.Project, instance.Zone, instance.Name).Context(ctx).Do()
 	if err != nil {
 		return fmt.Errorf("failed to start instance: %v", err)
 	}
+	rec.Operation = op.Name
 
-	fmt.Printf("Operation in progress: %s\n", op.Name)
+	// Wait for the operation so callers learn the real outcome
+	progressf("Operation in progress: %s\n", op.Name)
+	if _, err := WaitForZoneOperation(ctx, computeService, instance.Project, instance.Zone, op.Name); err != nil {
+		return fmt.Errorf("failed to start instance: %v", err)
+	}
+
+	progressf("Operation %s completed\n", op.Name)
 	return nil
 }
 
-// StopInstance turns off an instance
-func StopInstance(ctx context.Context, instance Instance, computeService *compute.Service) error {
+// StopInstance turns off an instance and waits for the operation to finish
+func StopInstance(ctx context.Context, instance Instance, computeService *compute.Service) (err error) {
+	rec := audit.Record{Project: instance.Project, Resource: instanceResource(instance), Action: AuditStopInstance}
+	defer func() { auditAction(rec, err) }()
+
 	op, err := computeService.Instances.Stop(instance.Project, instance.Zone, instance.Name).Context(ctx).Do()
 	if err != nil {
 		return fmt.Errorf("failed to stop instance: %v", err)
 	}
+	rec.Operation = op.Name
 
-	fmt.Printf("Operation in progress: %s\n", op.Name)
+	// Wait for the operation so callers learn the real outcome
+	progressf("Operation in progress: %s\n", op.Name)
+	if _, err := WaitForZoneOperation(ctx, computeService, instance.Project, instance.Zone, op.Name); err != nil {
+		return fmt.Errorf("failed to stop instance: %v", err)
+	}
+
+	progressf("Operation %s completed\n", op.Name)
 	return nil
 }
 
 // ReplaceLicense replaces the license URL for an instance
-func ReplaceLicense(ctx context.Context, instance Instance, newLicenseURL string, computeService *compute.Service) error {
+func ReplaceLicense(ctx context.Context, instance Instance, newLicenseURL string, computeService *compute.Service) (err error) {
 	// First, need to get the current instance to check its disks
 	instanceObj, err := computeService.Instances.Get(instance.Project, instance.Zone, instance.Name).Context(ctx).Do()
 	if err != nil {
@@ -151,18 +262,27 @@ func ReplaceLicense(ctx context.Context, instance Instance, newLicenseURL string
 		return fmt.Errorf("instance has no disks")
 	}
 
-	fmt.Println("Note: Changing licenses typically requires recreating the instance.")
-	fmt.Println("This feature is limited in direct API usage.")
-	fmt.Println("Alternative: Set custom metadata to track license information.")
+	progressln("Note: Changing licenses typically requires recreating the instance.")
+	progressln("This feature is limited in direct API usage.")
+	progressln("Alternative: Set custom metadata to track license information.")
 
 	// Set metadata with license information (this doesn't actually change the license)
 	fingerprint := instanceObj.Metadata.Fingerprint
 	items := instanceObj.Metadata.Items
 
-	// Add or update license metadata
+	// Add or update license metadata, keeping the old value for the audit log
+	rec := audit.Record{
+		Project:       instance.Project,
+		Resource:      instanceResource(instance),
+		Action:        AuditLicenseMetadata,
+		AfterLicenses: []string{newLicenseURL},
+	}
 	licenseFound := false
 	for i, item := range items {
 		if item.Key == "license" {
+			if item.Value != nil {
+				rec.BeforeLicenses = []string{*item.Value}
+			}
 			items[i].Value = &newLicenseURL
 			licenseFound = true
 			break
@@ -182,7 +302,8 @@ func ReplaceLicense(ctx context.Context, instance Instance, newLicenseURL string
 		Items:       items,
 	}
 
-	// Set the metadata on the instance
+	// Set the metadata on the instance; from here on the attempt is audited
+	defer func() { auditAction(rec, err) }()
 	op, err := computeService.Instances.SetMetadata(
 		instance.Project,
 		instance.Zone,
@@ -192,10 +313,15 @@ func ReplaceLicense(ctx context.Context, instance Instance, newLicenseURL string
 	if err != nil {
 		return fmt.Errorf("failed to set license metadata: %v", err)
 	}
+	rec.Operation = op.Name
 
-	fmt.Println("License information added to instance metadata.")
-	fmt.Printf("Operation in progress: %s\n", op.Name)
-	fmt.Println("Note: This does not change the actual license, only records it in metadata.")
+	progressf("Operation in progress: %s\n", op.Name)
+	if _, err := WaitForZoneOperation(ctx, computeService, instance.Project, instance.Zone, op.Name); err != nil {
+		return fmt.Errorf("failed to set license metadata: %v", err)
+	}
+
+	progressln("License information added to instance metadata.")
+	progressln("Note: This does not change the actual license, only records it in metadata.")
 
 	return nil
 }
@@ -210,7 +336,7 @@ func DisplayInstances(instances []Instance, w io.Writer) {
 	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
 
 	// Print header
-	fmt.Fprintln(tw, "NAME\tZONE\tMACHINE TYPE\tSTATUS\tLICENSES")
+	fmt.Fprintln(tw, "NAME\tZONE\tMACHINE TYPE\tSTATUS\tLICENSES\tMAPPING RULE\tOTHER DISK LICENSES\tMIG")
 
 	// Print each instance on one line
 	for _, instance := range instances {
@@ -219,12 +345,21 @@ func DisplayInstances(instances []Instance, w io.Writer) {
 			licenses = strings.Join(instance.LicenseCodes, ", ")
 		}
 
-		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+		// Licenses on data disks are shown too, they would otherwise go unnoticed
+		otherLicenses := "-"
+		if other := instance.DiskLicenses(); len(other) > 0 {
+			otherLicenses = strings.Join(other, ", ")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			instance.Name,
 			instance.Zone,
 			instance.MachineType,
 			instance.Status,
-			licenses)
+			licenses,
+			MappingRuleFor(instance),
+			otherLicenses,
+			orDash(resourceName(instance.ManagedBy)))
 	}
 
 	tw.Flush()
@@ -235,5 +370,35 @@ func FormatInstanceName(instance Instance) string {
 	return fmt.Sprintf("%s (%s/%s)", instance.Name, instance.Zone, instance.Status)
 }
 
+// licenseCodeFromURL turns a license URL into a short project:license code
+func licenseCodeFromURL(license string) string {
+	parts := strings.Split(license, "/")
+	if len(parts) >= 6 {
+		// Format is usually: https://www.googleapis.com/compute/v1/projects/PROJECT/global/licenses/LICENSE
+		return fmt.Sprintf("%s:%s", parts[len(parts)-4], parts[len(parts)-1])
+	}
+
+	// Fallback if the format is different
+	return path.Base(license)
+}
+
+// licenseCodesFromURLs converts a list of license URLs to project:license codes
+func licenseCodesFromURLs(licenses []string) []string {
+	var codes []string
+	for _, license := range licenses {
+		codes = append(codes, licenseCodeFromURL(license))
+	}
+	return codes
+}
+
+// resourceName returns the last path segment of a resource URL
+func resourceName(url string) string {
+	if url == "" {
+		return ""
+	}
+	parts := strings.Split(url, "/")
+	return parts[len(parts)-1]
+}
+
 // The ConvertToPAYG function is now implemented in payg_converter.go
 // Do not define it here to avoid duplicate definition errors
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gcp-instance-explorer/internal/fakecompute"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// newFakeCompute starts a fake with a labelled RHEL instance and an unlabelled Debian one
+func newFakeCompute(t *testing.T) (*fakecompute.Server, *compute.Service) {
+	t.Helper()
+
+	fake := fakecompute.NewServer()
+	t.Cleanup(fake.Close)
+
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{
+		Name:     "rhel",
+		Licenses: []string{"https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-8-byos"},
+	})
+	fake.AddInstance("proj", "us-central1-a", &compute.Instance{
+		Name:   "rhel",
+		Labels: map[string]string{"env": "prod"},
+		Disks:  []*compute.AttachedDisk{{Boot: true, Source: "rhel"}},
+	})
+	fake.AddDisk("proj", "europe-west1-b", &compute.Disk{Name: "debian"})
+	fake.AddInstance("proj", "europe-west1-b", &compute.Instance{
+		Name:   "debian",
+		Status: "TERMINATED",
+		Disks:  []*compute.AttachedDisk{{Boot: true, Source: "debian"}},
+	})
+
+	svc, err := fake.ComputeService(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, svc
+}
+
+func TestListInstancesFiltered(t *testing.T) {
+	_, svc := newFakeCompute(t)
+
+	tests := []struct {
+		expression string
+		want       []string
+	}{
+		{"", []string{"debian", "rhel"}},
+		{"license~rhel-8 AND status=running", []string{"rhel"}},
+		{"label.env=prod AND zone=us-central1-*", []string{"rhel"}},
+		{"label.env!=prod", []string{"debian"}},
+		{"zone=europe-* AND license~rhel", nil},
+	}
+
+	for _, tt := range tests {
+		filter, err := ParseFilter(tt.expression)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q): %v", tt.expression, err)
+		}
+
+		instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+		if err != nil {
+			t.Fatalf("ListInstancesFiltered(%q): %v", tt.expression, err)
+		}
+
+		got := make(map[string]bool)
+		for _, instance := range instances {
+			got[instance.Name] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q matched %d instances, want %v", tt.expression, len(got), tt.want)
+			continue
+		}
+		for _, name := range tt.want {
+			if !got[name] {
+				t.Errorf("%q did not match %s", tt.expression, name)
+			}
+		}
+	}
+}
+
+func TestLicenseFilterMatchesDataDisks(t *testing.T) {
+	instance := Instance{Name: "sap", LicenseCodes: []string{"rhel-cloud:rhel-9-server"}, Disks: []AttachedDisk{
+		{Name: "sap", Boot: true, Licenses: []string{"rhel-cloud:rhel-9-server"}},
+		{Name: "sap-data", Licenses: []string{"rhel-sap-cloud:rhel-9-sap-byos"}},
+	}}
+
+	for expression, want := range map[string]bool{
+		"license~byos":        true,
+		"license!~byos":       false,
+		"license~rhel-9-serv": true,
+		"license~debian":      false,
+	} {
+		filter, err := ParseFilter(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter.Match(instance); got != want {
+			t.Errorf("%q matched = %t, want %t", expression, got, want)
+		}
+	}
+}
+
+func TestReplaceLicenseSetsMetadata(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	instance := Instance{Name: "rhel", Zone: "us-central1-a", Project: "proj"}
+	license := "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-8-server"
+
+	if err := ReplaceLicense(context.Background(), instance, license, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, item := range fake.Instance("proj", "us-central1-a", "rhel").Metadata.Items {
+		if item.Key == "license" && item.Value != nil && *item.Value == license {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("license metadata not set")
+	}
+}
+
+func TestListInstancesReadsEveryDisk(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{
+		Name:        "app-boot",
+		SourceImage: "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/images/rhel-9-v20250101",
+		Type:        "https://www.googleapis.com/compute/v1/projects/proj/zones/us-central1-a/diskTypes/pd-balanced",
+		SizeGb:      20,
+		Licenses:    []string{"https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-9-server"},
+	})
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{
+		Name:     "app-data",
+		SizeGb:   100,
+		Licenses: []string{"https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-9-byos"},
+	})
+	value := "x"
+	fake.AddInstance("proj", "us-central1-a", &compute.Instance{
+		Name:        "app",
+		CpuPlatform: "Intel Cascade Lake",
+		Metadata:    &compute.Metadata{Items: []*compute.MetadataItems{{Key: "startup-script", Value: &value}}},
+		// The data disk comes first so the boot flag, not the position, must decide
+		Disks: []*compute.AttachedDisk{
+			{Source: "app-data", Type: "PERSISTENT"},
+			{Source: "app-boot", Boot: true, Type: "PERSISTENT", GuestOsFeatures: []*compute.GuestOsFeature{{Type: "UEFI_COMPATIBLE"}}},
+		},
+	})
+
+	filter, _ := ParseFilter("name=app")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("got %d instances, want 1", len(instances))
+	}
+	app := instances[0]
+
+	if len(app.Disks) != 2 {
+		t.Fatalf("got %d disks, want 2", len(app.Disks))
+	}
+	if got := app.BootDisk().Name; got != "app-boot" {
+		t.Errorf("boot disk = %s, want app-boot", got)
+	}
+	if len(app.LicenseCodes) != 1 || app.LicenseCodes[0] != "rhel-cloud:rhel-9-server" {
+		t.Errorf("boot licenses = %v", app.LicenseCodes)
+	}
+	if other := app.DiskLicenses(); len(other) != 1 || other[0] != "app-data=rhel-cloud:rhel-9-byos" {
+		t.Errorf("other disk licenses = %v", other)
+	}
+	if !strings.HasSuffix(app.SourceImage, "/rhel-9-v20250101") || app.BootDisk().DiskType != "pd-balanced" {
+		t.Errorf("disk details not merged: image %q type %q", app.SourceImage, app.BootDisk().DiskType)
+	}
+	if len(app.GuestOSFeatures) != 1 || app.CPUPlatform != "Intel Cascade Lake" || app.ID == "" || app.SelfLink == "" {
+		t.Errorf("instance details missing: %+v", app)
+	}
+	if len(app.MetadataKeys) != 1 || app.MetadataKeys[0] != "startup-script" {
+		t.Errorf("metadata keys = %v", app.MetadataKeys)
+	}
+}
+
+func TestMappingRuleForMatchesSourceImage(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{
+		Name:        "custom",
+		SourceImage: "https://www.googleapis.com/compute/v1/projects/proj/global/images/golden-rhel-9-20250101",
+	})
+	fake.AddInstance("proj", "us-central1-a", &compute.Instance{
+		Name:  "custom",
+		Disks: []*compute.AttachedDisk{{Boot: true, Source: "custom"}},
+	})
+
+	filter, _ := ParseFilter("name=custom")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("got %d instances, want 1", len(instances))
+	}
+
+	// The disk carries no license, so only the image-based rule can match
+	if got := MappingRuleFor(instances[0]); got != "unlicensed-rhel-9-image-to-payg (to PAYG)" {
+		t.Errorf("MappingRuleFor = %q, want the unlicensed rhel-9 image rule", got)
+	}
+}
+
+func TestListInstancesPushesFilterDown(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+
+	filter, _ := ParseFilter("label.env=prod AND license~rhel")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Name != "rhel" {
+		t.Errorf("instances = %+v, want rhel", instances)
+	}
+	if filters := fake.Filters(); len(filters) != 1 || filters[0] != `(labels.env = "prod")` {
+		t.Errorf("filters sent = %q, want only the label term pushed down", filters)
+	}
+}
+
+func TestListInstancesFallsBackWhenFilterIsRejected(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	fake.RejectFilters()
+
+	filter, _ := ParseFilter("status=terminated")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Name != "debian" {
+		t.Errorf("instances = %+v, want debian filtered locally", instances)
+	}
+	if filters := fake.Filters(); len(filters) != 2 || filters[1] != "" {
+		t.Errorf("filters sent = %q, want a retry without a filter", filters)
+	}
+}
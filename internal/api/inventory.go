@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// ProjectError records a project that could not be inventoried
+type ProjectError struct {
+	Project string
+	Err     error
+}
+
+// Inventory is the combined instance list of several projects
+type Inventory struct {
+	Projects  []string
+	Instances []Instance
+	Errors    []ProjectError
+}
+
+// ListInstancesAcrossProjects runs ListInstancesFiltered for every project with at most parallel
+// projects in flight. Projects that fail are reported in Errors and do not stop the others.
+func ListInstancesAcrossProjects(ctx context.Context, projectIDs []string, parallel int, filter *InstanceFilter, computeService *compute.Service) *Inventory {
+	inventory := &Inventory{Projects: projectIDs}
+	results := make([][]Instance, len(projectIDs))
+	errs := make([]error, len(projectIDs))
+
+	forEachProject(len(projectIDs), parallel, func(i int) {
+		results[i], errs[i] = ListInstancesFiltered(ctx, projectIDs[i], computeService, filter)
+	})
+
+	// Keep the output in project order regardless of which finished first
+	for i, projectID := range projectIDs {
+		if errs[i] != nil {
+			inventory.Errors = append(inventory.Errors, ProjectError{Project: projectID, Err: errs[i]})
+			continue
+		}
+
+		instances := results[i]
+		sort.SliceStable(instances, func(a, b int) bool {
+			if instances[a].Zone != instances[b].Zone {
+				return instances[a].Zone < instances[b].Zone
+			}
+			return instances[a].Name < instances[b].Name
+		})
+		inventory.Instances = append(inventory.Instances, instances...)
+	}
+
+	return inventory
+}
+
+// forEachProject calls list for every project index with at most parallel calls in flight.
+// Callers store results by index so the output keeps project order.
+func forEachProject(count, parallel int, list func(i int)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				list(i)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// DisplayInventory prints the combined instance table followed by any per-project errors
+func DisplayInventory(inventory *Inventory, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tNAME\tZONE\tMACHINE TYPE\tSTATUS\tLICENSES\tMAPPING RULE\tOTHER DISK LICENSES")
+	for _, instance := range inventory.Instances {
+		licenses := "none"
+		if len(instance.LicenseCodes) > 0 {
+			licenses = strings.Join(instance.LicenseCodes, ", ")
+		}
+
+		// Licenses on data disks are shown too, they would otherwise go unnoticed
+		otherLicenses := "-"
+		if other := instance.DiskLicenses(); len(other) > 0 {
+			otherLicenses = strings.Join(other, ", ")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			instance.Project,
+			instance.Name,
+			instance.Zone,
+			instance.MachineType,
+			instance.Status,
+			licenses,
+			MappingRuleFor(instance),
+			otherLicenses)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d instances in %d of %d projects\n",
+		len(inventory.Instances), len(inventory.Projects)-len(inventory.Errors), len(inventory.Projects))
+
+	if len(inventory.Errors) > 0 {
+		fmt.Fprintf(w, "\nProjects that could not be listed (%d):\n", len(inventory.Errors))
+		for _, projectErr := range inventory.Errors {
+			fmt.Fprintf(w, "  - %s: %v\n", projectErr.Project, projectErr.Err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// JournalState is the progress of one instance in a conversion run
+type JournalState string
+
+const (
+	JournalPending  JournalState = "pending"   // Planned, nothing sent yet
+	JournalInFlight JournalState = "in-flight" // PATCH sent or about to be sent
+	JournalDone     JournalState = "done"      // Disk update operation finished
+	JournalFailed   JournalState = "failed"    // Conversion failed, disk may be unchanged
+	JournalSkipped  JournalState = "skipped"   // Plan could not resolve the instance
+)
+
+// JournalRecord is one line of the conversion journal
+type JournalRecord struct {
+	Time             time.Time           `json:"time"`
+	Project          string              `json:"project"`
+	Zone             string              `json:"zone"`
+	Instance         string              `json:"instance"`
+	Disk             string              `json:"disk,omitempty"`
+	Direction        ConversionDirection `json:"direction"`
+	State            JournalState        `json:"state"`
+	OriginalLicenses []string            `json:"originalLicenses,omitempty"`
+	TargetLicense    string              `json:"targetLicense,omitempty"`
+	Operation        string              `json:"operation,omitempty"`
+	StartedAt        *time.Time          `json:"startedAt,omitempty"`
+	Error            string              `json:"error,omitempty"`
+	Item             *PlanItem           `json:"item,omitempty"` // Full plan item, on pending records only
+}
+
+// key identifies the disk a record belongs to; an instance can have several disks in one run
+func (rec JournalRecord) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", rec.Project, rec.Zone, rec.Instance, rec.Disk)
+}
+
+// Journal is an append-only JSON lines log of a conversion run
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	Path string
+}
+
+// DefaultJournalPath names a new journal after the project, direction and start time
+func DefaultJournalPath(project string, direction ConversionDirection) string {
+	return fmt.Sprintf("%s-%s-%s.journal.jsonl", project, direction, time.Now().UTC().Format("20060102-150405"))
+}
+
+// OpenJournal opens a journal for appending, creating it if needed
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+
+	return &Journal{file: file, Path: path}, nil
+}
+
+// Record appends a record and syncs it to disk. A nil journal records nothing.
+func (j *Journal) Record(rec JournalRecord) error {
+	if j == nil {
+		return nil
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal record: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+
+	// Sync every record so an interrupted run never loses one
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %v", err)
+	}
+
+	return nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// ReadJournal reads every record from a journal file
+func ReadJournal(path string) ([]JournalRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal: %v", err)
+	}
+	defer file.Close()
+
+	var records []JournalRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var rec JournalRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			// A run killed mid-write can leave a partial last line
+			progressf("Warning: ignoring unreadable journal line %d: %v\n", lineNumber, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %v", err)
+	}
+
+	return records, nil
+}
+
+// journalItem records a state change for a plan item
+func (j *Journal) journalItem(item PlanItem, direction ConversionDirection, state JournalState, operation string, startedAt *time.Time, itemErr string) error {
+	rec := JournalRecord{
+		Project:          item.Project,
+		Zone:             item.Zone,
+		Instance:         item.Instance,
+		Disk:             item.Disk,
+		Direction:        direction,
+		State:            state,
+		OriginalLicenses: item.CurrentLicenses,
+		TargetLicense:    item.TargetLicense,
+		Operation:        operation,
+		StartedAt:        startedAt,
+		Error:            itemErr,
+	}
+
+	if state == JournalPending {
+		planned := item
+		rec.Item = &planned
+	}
+
+	return j.Record(rec)
+}
+
+// ResumePlan rebuilds the unfinished part of a run from its journal. Completed items are
+// dropped, and items that were in flight are re-verified against the live disk: if the new
+// licenses are already there they are marked done, if the disk is unchanged they are retried.
+// Items that cannot be settled, because the disk cannot be read or its licenses changed in
+// another way, are journaled as failed and returned as unsettled, one reason per item.
+func ResumePlan(ctx context.Context, path string, computeService *compute.Service) (*ConversionPlan, *Journal, []string, error) {
+	records, err := ReadJournal(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The first pending record of each instance holds its plan item; the last record its state
+	plan := &ConversionPlan{CreatedAt: time.Now().UTC()}
+	var order []string
+	items := make(map[string]PlanItem)
+	last := make(map[string]JournalRecord)
+
+	for _, rec := range records {
+		key := rec.key()
+		if rec.State == JournalPending && rec.Item != nil {
+			if _, seen := items[key]; !seen {
+				items[key] = *rec.Item
+				order = append(order, key)
+			}
+			if plan.Direction == "" {
+				plan.Direction = rec.Direction
+				plan.Project = rec.Project
+			}
+		}
+		last[key] = rec
+	}
+
+	if len(order) == 0 {
+		return nil, nil, nil, fmt.Errorf("journal %s has no planned instances to resume", path)
+	}
+
+	journal, err := OpenJournal(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var unsettled []string
+
+	for _, key := range order {
+		item := items[key]
+		rec := last[key]
+
+		switch rec.State {
+		case JournalDone:
+			progressf("[%s] Already converted, skipping\n", item.Instance)
+			continue
+		case JournalSkipped:
+			progressf("[%s] Skipped in the original run: %s\n", item.Instance, item.Skipped)
+			continue
+		case JournalInFlight:
+			progressf("[%s] Was in flight when the run stopped, re-verifying disk %s...\n", item.Instance, item.Disk)
+			retry, err := reverifyInFlight(ctx, item, rec, plan.Direction, journal, computeService)
+			if err != nil {
+				progressf("[%s] ❌ %v\n", item.Instance, err)
+				if journalErr := journal.journalItem(item, plan.Direction, JournalFailed, rec.Operation, rec.StartedAt, err.Error()); journalErr != nil {
+					progressf("[%s] ⚠️ %v\n", item.Instance, journalErr)
+				}
+				unsettled = append(unsettled, fmt.Sprintf("%s disk %s: %v", item.Instance, item.Disk, err))
+				continue
+			}
+			if !retry {
+				continue
+			}
+		}
+
+		plan.Items = append(plan.Items, item)
+	}
+
+	return plan, journal, unsettled, nil
+}
+
+// reverifyInFlight settles an item that was in flight and reports whether it should be retried
+func reverifyInFlight(ctx context.Context, item PlanItem, rec JournalRecord, direction ConversionDirection,
+	journal *Journal, computeService *compute.Service) (bool, error) {
+	// Let an operation that was already started finish first
+	if rec.Operation != "" {
+		if _, err := WaitForZoneOperation(ctx, computeService, item.Project, item.Zone, rec.Operation); err != nil {
+			progressf("[%s] Operation %s did not succeed: %v\n", item.Instance, rec.Operation, err)
+		}
+	}
+
+	disk, err := computeService.Disks.Get(item.Project, item.Zone, item.Disk).Context(ctx).Do()
+	if err != nil {
+		return false, fmt.Errorf("error getting disk details: %v", err)
+	}
+
+	var body diskPatchBody
+	if err := json.Unmarshal([]byte(item.Body), &body); err != nil {
+		return false, fmt.Errorf("error reading planned request body: %v", err)
+	}
+
+	switch {
+	case sameLicenses(disk.Licenses, body.Licenses):
+		progressf("[%s] ✓ Disk already carries the new licenses, marking done\n", item.Instance)
+		return false, journal.journalItem(item, direction, JournalDone, rec.Operation, rec.StartedAt, "")
+	case sameLicenses(disk.Licenses, item.CurrentLicenses):
+		progressf("[%s] Disk is unchanged, retrying\n", item.Instance)
+		return true, nil
+	default:
+		return false, fmt.Errorf("disk licenses changed unexpectedly (now: %s)",
+			strings.Join(licenseCodesFromURLs(disk.Licenses), ", "))
+	}
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed license_mappings.yaml
+var defaultMappingsYAML []byte
+
+// LicenseMapping is one rule mapping a source license or image to a target license
+type LicenseMapping struct {
+	Name          string              `yaml:"name"`
+	Direction     ConversionDirection `yaml:"direction"`
+	SourceLicense string              `yaml:"sourceLicense,omitempty"` // project:code
+	SourceImage   string              `yaml:"sourceImage,omitempty"`   // Regular expression
+	Unlicensed    bool                `yaml:"unlicensed,omitempty"`
+	TargetLicense string              `yaml:"targetLicense"` // License URL or project:code
+
+	imagePattern *regexp.Regexp
+}
+
+// MappingRegistry holds the license mapping rules in the order they are checked
+type MappingRegistry struct {
+	Rules []LicenseMapping
+}
+
+// mappingFile is the on-disk format of a mapping file
+type mappingFile struct {
+	ReplaceDefaults bool             `yaml:"replaceDefaults,omitempty"`
+	Rules           []LicenseMapping `yaml:"rules"`
+}
+
+// activeMappings is the registry used for planning; it starts with the embedded defaults
+var activeMappings = mustParseMappings(defaultMappingsYAML, "embedded defaults")
+
+// Mappings returns the license mapping rules currently in use
+func Mappings() *MappingRegistry {
+	return activeMappings
+}
+
+// LoadMappingsFile adds the rules from a user YAML file in front of the defaults,
+// or replaces the defaults when the file sets replaceDefaults
+func LoadMappingsFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("error reading mapping file: %v", err)
+	}
+
+	file, err := parseMappings(data, filename)
+	if err != nil {
+		return err
+	}
+
+	registry := &MappingRegistry{Rules: file.Rules}
+	if !file.ReplaceDefaults {
+		registry.Rules = append(registry.Rules, activeMappings.Rules...)
+	}
+
+	activeMappings = registry
+	return nil
+}
+
+// mustParseMappings parses the embedded defaults, which are known to be valid
+func mustParseMappings(data []byte, source string) *MappingRegistry {
+	file, err := parseMappings(data, source)
+	if err != nil {
+		panic(err)
+	}
+	return &MappingRegistry{Rules: file.Rules}
+}
+
+// parseMappings parses and validates a mapping file
+func parseMappings(data []byte, source string) (*mappingFile, error) {
+	var file mappingFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing mapping file %s: %v", source, err)
+	}
+
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s#%d", source, i+1)
+		}
+
+		if _, err := ParseDirection(string(rule.Direction)); err != nil {
+			return nil, fmt.Errorf("mapping rule %s: %v", rule.Name, err)
+		}
+
+		if rule.TargetLicense == "" {
+			return nil, fmt.Errorf("mapping rule %s has no targetLicense", rule.Name)
+		}
+		rule.TargetLicense = licenseURLFromCode(rule.TargetLicense)
+
+		if strings.Contains(rule.SourceLicense, "/") {
+			rule.SourceLicense = licenseCodeFromURL(rule.SourceLicense)
+		}
+
+		if rule.SourceLicense == "" && rule.SourceImage == "" && !rule.Unlicensed {
+			return nil, fmt.Errorf("mapping rule %s needs sourceLicense, sourceImage or unlicensed", rule.Name)
+		}
+
+		if rule.SourceImage != "" {
+			pattern, err := regexp.Compile(rule.SourceImage)
+			if err != nil {
+				return nil, fmt.Errorf("mapping rule %s has an invalid sourceImage: %v", rule.Name, err)
+			}
+			rule.imagePattern = pattern
+		}
+	}
+
+	return &file, nil
+}
+
+// Matches reports whether the rule applies to a disk with these license codes and source image
+func (rule *LicenseMapping) Matches(licenseCodes []string, sourceImage string) bool {
+	if rule.Unlicensed && len(licenseCodes) > 0 {
+		return false
+	}
+
+	if rule.SourceLicense != "" && !containsString(licenseCodes, rule.SourceLicense) {
+		return false
+	}
+
+	if rule.imagePattern != nil && (sourceImage == "" || !rule.imagePattern.MatchString(sourceImage)) {
+		return false
+	}
+
+	return true
+}
+
+// Apply returns the disk's license URLs after the rule is applied
+func (rule *LicenseMapping) Apply(currentLicenses []string) []string {
+	if rule.SourceLicense == "" {
+		return []string{rule.TargetLicense}
+	}
+
+	// Only swap the matched license so any other licenses stay on the disk
+	var licenses []string
+	for _, license := range currentLicenses {
+		if licenseCodeFromURL(license) == rule.SourceLicense {
+			license = rule.TargetLicense
+		}
+		if !containsString(licenses, license) {
+			licenses = append(licenses, license)
+		}
+	}
+	return licenses
+}
+
+// Match returns the first rule for the direction that applies, or nil
+func (r *MappingRegistry) Match(direction ConversionDirection, licenseCodes []string, sourceImage string) *LicenseMapping {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Direction == direction && rule.Matches(licenseCodes, sourceImage) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// MatchAny returns the first rule in either direction that applies, or nil
+func (r *MappingRegistry) MatchAny(licenseCodes []string, sourceImage string) *LicenseMapping {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Matches(licenseCodes, sourceImage) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// MappingRuleFor describes the rule that would apply to an instance, for display
+func MappingRuleFor(instance Instance) string {
+	rule := activeMappings.MatchAny(instance.LicenseCodes, instance.SourceImage)
+	if rule == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s (to %s)", rule.Name, rule.Direction.Label())
+}
+
+// licenseURLFromCode expands a project:code license to its full URL; URLs are returned unchanged
+func licenseURLFromCode(license string) string {
+	if strings.Contains(license, "/") {
+		return license
+	}
+
+	parts := strings.SplitN(license, ":", 2)
+	if len(parts) != 2 {
+		return license
+	}
+
+	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/global/licenses/%s", parts[0], parts[1])
+}
+
+// containsString reports whether list holds value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// sharedCoreVCPUs holds machine types whose names carry no vCPU count
+var sharedCoreVCPUs = map[string]int{
+	"e2-micro":  2,
+	"e2-small":  2,
+	"e2-medium": 2,
+	"f1-micro":  1,
+	"g1-small":  1,
+}
+
+// MachineTypeVCPUs returns the vCPU count of a machine type such as n2-standard-8 or custom-4-16384.
+// Machine types whose name does not give the count, such as a2-highgpu-1g, return an error.
+func MachineTypeVCPUs(machineType string) (int, error) {
+	if vcpus, ok := sharedCoreVCPUs[machineType]; ok {
+		return vcpus, nil
+	}
+
+	// Shared-core custom types end in their memory, not their vCPUs: e2-custom-small-1024
+	parts := strings.Split(machineType, "-")
+	if len(parts) == 4 && parts[1] == "custom" {
+		if vcpus, ok := sharedCoreVCPUs[parts[0]+"-"+parts[2]]; ok {
+			return vcpus, nil
+		}
+	}
+
+	// The vCPU count is the first number after the family: n2-standard-8, n2-custom-8-32768,
+	// custom-4-16384, c3-standard-4-lssd
+	for i, part := range parts {
+		if i == 0 && part != "custom" {
+			continue
+		}
+		if vcpus, err := strconv.Atoi(part); err == nil && vcpus > 0 {
+			return vcpus, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown vCPU count of machine type %q", machineType)
+}
+
+// LookupMachineTypeVCPUs returns the vCPU count of a machine type in a zone. The name is tried
+// first; machine types whose name does not give the count are read with machineTypes.get.
+func LookupMachineTypeVCPUs(ctx context.Context, project, zone, machineType string, computeService *compute.Service) (int, error) {
+	if vcpus, err := MachineTypeVCPUs(machineType); err == nil {
+		return vcpus, nil
+	}
+
+	resource, err := computeService.MachineTypes.Get(project, resourceName(zone), machineType).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("error getting machine type %s in %s: %v", machineType, zone, err)
+	}
+	if resource.GuestCpus <= 0 {
+		return 0, fmt.Errorf("machine type %s in %s reports no vCPUs", machineType, zone)
+	}
+	return int(resource.GuestCpus), nil
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// defaultOperationTimeout bounds how long we wait for an operation when the context has no deadline
+const defaultOperationTimeout = 10 * time.Minute
+
+// Backoff between polls of an operation that is still running; tests shorten it
+var (
+	initialOperationPoll = 1 * time.Second
+	maxOperationPoll     = 15 * time.Second
+)
+
+// WaitForZoneOperation blocks until a zone operation is DONE and returns an error if it failed.
+// It uses zoneOperations.wait, backing off between calls, and stops when ctx is done.
+func WaitForZoneOperation(ctx context.Context, computeService *compute.Service, project, zone, operationName string) (*compute.Operation, error) {
+	// Operation zones come back as full URLs
+	zone = resourceName(zone)
+
+	return waitForOperation(ctx, operationName, func(ctx context.Context) (*compute.Operation, error) {
+		return computeService.ZoneOperations.Wait(project, zone, operationName).Context(ctx).Do()
+	})
+}
+
+// WaitForGlobalOperation is WaitForZoneOperation for global operations such as image and
+// instance template inserts
+func WaitForGlobalOperation(ctx context.Context, computeService *compute.Service, project, operationName string) (*compute.Operation, error) {
+	return waitForOperation(ctx, operationName, func(ctx context.Context) (*compute.Operation, error) {
+		return computeService.GlobalOperations.Wait(project, operationName).Context(ctx).Do()
+	})
+}
+
+// waitForOperation calls wait until the operation is DONE
+func waitForOperation(ctx context.Context, operationName string, wait func(ctx context.Context) (*compute.Operation, error)) (*compute.Operation, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultOperationTimeout)
+		defer cancel()
+	}
+
+	delay := initialOperationPoll
+
+	for {
+		op, err := wait(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("timed out waiting for operation %s: %v", operationName, ctx.Err())
+			}
+			return nil, fmt.Errorf("failed to get status of operation %s: %v", operationName, err)
+		}
+
+		if op.Status == "DONE" {
+			if err := operationError(op); err != nil {
+				return op, err
+			}
+			return op, nil
+		}
+
+		// wait returns early after about two minutes even if the operation is still running
+		select {
+		case <-ctx.Done():
+			return op, fmt.Errorf("timed out waiting for operation %s (last status %s): %v", operationName, op.Status, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxOperationPoll {
+			delay = maxOperationPoll
+		}
+	}
+}
+
+// operationError turns the errors reported by a finished operation into a Go error
+func operationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+
+	var messages []string
+	for _, opErr := range op.Error.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", opErr.Code, opErr.Message))
+	}
+
+	return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(messages, "; "))
+}
+
+// errNoOperation means the disk API accepted a change without naming an operation to wait
+// for, so whether the change was applied is unknown
+var errNoOperation = errors.New("the response named no operation, so the change could not be confirmed")
+
+// patchDisk sends a disk request through the alpha API and waits for its zone operation.
+// accepted, when not nil, is called with the operation name once the server has accepted the
+// request and before the wait. A response without an operation name returns errNoOperation.
+func patchDisk(ctx context.Context, client *http.Client, computeService *compute.Service,
+	project, zone, method, url, body string, accepted func(operation string)) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making API request: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("API request failed: %s - %s", resp.Status, string(data))
+	}
+
+	var operation struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &operation); err != nil || operation.Name == "" {
+		return "", errNoOperation
+	}
+	if accepted != nil {
+		accepted(operation.Name)
+	}
+
+	if _, err := WaitForZoneOperation(ctx, computeService, project, zone, operation.Name); err != nil {
+		return operation.Name, err
+	}
+	return operation.Name, nil
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fastOperationPolls shortens the backoff between operation polls for the test
+func fastOperationPolls(t *testing.T) {
+	initial, max := initialOperationPoll, maxOperationPoll
+	initialOperationPoll, maxOperationPoll = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { initialOperationPoll, maxOperationPoll = initial, max })
+}
+
+func TestWaitForZoneOperationPollsUntilDone(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	fastOperationPolls(t)
+	fake.DelayOperations(3)
+
+	instance := Instance{Name: "debian", Zone: "europe-west1-b", Project: "proj"}
+	if err := StartInstance(context.Background(), instance, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	polls := 0
+	for _, request := range fake.Requests() {
+		if strings.HasSuffix(request, "/wait") {
+			polls++
+		}
+	}
+	if polls != 4 {
+		t.Errorf("operation polled %d times, want 3 while running and 1 when done", polls)
+	}
+}
+
+func TestWaitForZoneOperationTimesOut(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	fastOperationPolls(t)
+	fake.DelayOperations(1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	instance := Instance{Name: "debian", Zone: "europe-west1-b", Project: "proj"}
+	err := StartInstance(ctx, instance, svc)
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for operation") {
+		t.Errorf("error = %v, want a timeout while the operation is still running", err)
+	}
+}
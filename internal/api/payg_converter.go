@@ -2,49 +2,77 @@ package api
 
 import (
 	"context"
-	"encoding/json" // Add this import
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
-	"time" // Add this import
+	"sync"
+	"time"
+
+	"gcp-instance-explorer/internal/audit"
 
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
-	"gopkg.in/yaml.v3"
 )
 
-// PAYGConversion represents a BYOS to PAYG conversion operation
+// PAYGConversion represents a license conversion operation in either direction
 type PAYGConversion struct {
-	Instance      Instance
-	OriginalOS    string
-	ConversionURL string
-	Success       bool
-	NewOS         string
+	Instance         Instance
+	OriginalOS       string
+	ConversionURL    string
+	Success          bool
+	NewOS            string
+	Disk             string   // Disk whose licenses were changed
+	OriginalLicenses []string // Exact license URLs on the disk before the change
+	NewLicenses      []string // License URLs the change should leave on the disk
+	VerifiedLicenses []string // License URLs VerifyConversion found on the disk
+	Skipped          bool     // The plan could not resolve the instance, nothing was sent
 }
 
-// CheckInstancesFromFile checks if instances from a YAML file exist in the current project
-func CheckInstancesFromFile(projectID string, instances []Instance) ([]Instance, error) {
-	// Look for file with pattern: {projectID}-instances.yml
-	filename := fmt.Sprintf("%s-instances.yml", projectID)
+// DefaultExportMaxAge is how old an export may be before CheckInstancesFromFile refuses it
+const DefaultExportMaxAge = 7 * 24 * time.Hour
+
+// FileCheckOptions controls which export file CheckInstancesFromFile reads, how old it may be
+// and what happens to instances that changed since it was exported
+type FileCheckOptions struct {
+	File        string        // Export file, the project's DefaultExportFile when empty
+	MaxAge      time.Duration // Oldest export accepted, 0 for no limit
+	SkipChanged bool          // Leave changed instances out with a warning instead of refusing the file
+}
+
+// DefaultFileCheckOptions returns the options used by the menu and when no flags are given
+func DefaultFileCheckOptions() FileCheckOptions {
+	return FileCheckOptions{MaxAge: DefaultExportMaxAge}
+}
+
+// CheckInstancesFromFile checks if instances from an export file exist in the current project.
+// The file's header must name the project and be recent enough, so a stale or wrong-project
+// file never drives a conversion. Instances are matched by zone and name; one that was
+// recreated under the same name, or whose licenses changed since the export, is not the
+// instance the operator reviewed, so the file is refused unless opts.SkipChanged leaves such
+// instances out.
+func CheckInstancesFromFile(projectID string, instances []Instance, opts FileCheckOptions) ([]Instance, error) {
+	filename := opts.File
+	if filename == "" {
+		filename = DefaultExportFile(projectID)
+	}
 
 	// Check if file exists
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		return nil, fmt.Errorf("file %s not found. Please export instance list first", filename)
 	}
 
-	// Read the file
-	data, err := os.ReadFile(filename)
+	// Read and parse the file
+	document, err := LoadInstanceExport(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error reading file: %v", err)
+		return nil, err
 	}
-
-	// Parse YAML
-	var fileInstances []InstanceExport
-	if err := yaml.Unmarshal(data, &fileInstances); err != nil {
-		return nil, fmt.Errorf("error parsing YAML: %v", err)
+	if err := document.Header.Validate(projectID, opts.MaxAge, time.Now()); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
 	}
+	progressf("Using %s: %s\n", filename, document.Header)
+	fileInstances := document.Instances
 
 	// Create map of current instances for quick lookup
 	instanceMap := make(map[string]Instance)
@@ -56,23 +84,42 @@ func CheckInstancesFromFile(projectID string, instances []Instance) ([]Instance,
 	// Match instances from file with current instances
 	var matchedInstances []Instance
 	var missingInstances []string
+	var changedInstances []string
 
 	for _, fileInstance := range fileInstances {
 		key := fmt.Sprintf("%s/%s", fileInstance.Zone, fileInstance.Name)
-		if instance, found := instanceMap[key]; found {
-			matchedInstances = append(matchedInstances, instance)
-		} else {
+		instance, found := instanceMap[key]
+		if !found {
 			missingInstances = append(missingInstances, key)
+			continue
+		}
+		if reason := exportMismatch(fileInstance, instance); reason != "" {
+			changedInstances = append(changedInstances, fmt.Sprintf("%s: %s", key, reason))
+			continue
+		}
+		matchedInstances = append(matchedInstances, instance)
+	}
+
+	// Changed instances are not what the operator reviewed
+	if len(changedInstances) > 0 {
+		if !opts.SkipChanged {
+			return nil, fmt.Errorf("%d instances changed since %s was exported:\n  - %s\nexport the instance list again and review it, "+
+				"or skip the changed instances", len(changedInstances), filename, strings.Join(changedInstances, "\n  - "))
 		}
+		progressf("Warning: skipping %d instances that changed since the file was exported:\n", len(changedInstances))
+		for _, changed := range changedInstances {
+			progressf("  - %s\n", changed)
+		}
+		progressln()
 	}
 
 	// Report any missing instances
 	if len(missingInstances) > 0 {
-		fmt.Printf("Warning: %d instances from the file were not found in the current project:\n", len(missingInstances))
+		progressf("Warning: %d instances from the file were not found in the current project:\n", len(missingInstances))
 		for _, missing := range missingInstances {
-			fmt.Printf("  - %s\n", missing)
+			progressf("  - %s\n", missing)
 		}
-		fmt.Println()
+		progressln()
 	}
 
 	if len(matchedInstances) == 0 {
@@ -82,227 +129,356 @@ func CheckInstancesFromFile(projectID string, instances []Instance) ([]Instance,
 	return matchedInstances, nil
 }
 
-// ConvertToPAYG converts instances from BYOS to PAYG licensing
-func ConvertToPAYG(ctx context.Context, instances []Instance, computeService *compute.Service) ([]PAYGConversion, error) {
-	var results []PAYGConversion
+// exportMismatch explains how a live instance differs from its export entry in identity, disks
+// or licenses, or returns "" when it is the same instance with the same disks and licenses
+func exportMismatch(exported InstanceExport, live Instance) string {
+	// Every accepted file has a header, and exports with a header record the instance ID
+	if exported.ID == "" {
+		return "the file has no instance ID, so a recreated instance cannot be told apart"
+	}
+	if live.ID != "" && exported.ID != live.ID {
+		return fmt.Sprintf("instance was deleted and recreated (ID %s in the file, %s now)", exported.ID, live.ID)
+	}
 
-	for _, instance := range instances {
-		// Create conversion record
-		conversion := PAYGConversion{
-			Instance:   instance,
-			OriginalOS: strings.Join(instance.LicenseCodes, ", "),
-		}
+	if !sameLicenses(exported.Licenses, live.LicenseCodes) {
+		return fmt.Sprintf("boot disk licenses are %s now, the file has %s",
+			licenseList(live.LicenseCodes), licenseList(exported.Licenses))
+	}
 
-		// Log instance status clearly
-		fmt.Printf("\n== Instance %s status: %s ==\n", instance.Name, instance.Status)
-		if instance.Status != "RUNNING" {
-			fmt.Printf("💡 Note: VM is NOT running. License will be applied to disk but VM needs to be started to use the new license.\n")
-		}
+	// Entries without disks predate per-disk exports and only carry the boot disk licenses
+	if len(exported.Disks) == 0 {
+		return ""
+	}
 
-		// Get the instance object to find disk details
-		instanceObj, err := computeService.Instances.Get(instance.Project, instance.Zone, instance.Name).Context(ctx).Do()
-		if err != nil {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Error getting instance details for %s: %v\n", instance.Name, err)
-			continue
+	liveDisks := make(map[string]AttachedDisk, len(live.Disks))
+	for _, disk := range live.Disks {
+		liveDisks[disk.Name] = disk
+	}
+	for _, exportedDisk := range exported.Disks {
+		liveDisk, ok := liveDisks[exportedDisk.Name]
+		if !ok {
+			return fmt.Sprintf("disk %s was detached since the export", exportedDisk.Name)
 		}
-
-		// Find the boot disk
-		if len(instanceObj.Disks) == 0 {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Instance %s has no disks\n", instance.Name)
-			continue
+		if !sameLicenses(exportedDisk.Licenses, liveDisk.Licenses) {
+			return fmt.Sprintf("disk %s licenses are %s now, the file has %s",
+				liveDisk.Name, licenseList(liveDisk.Licenses), licenseList(exportedDisk.Licenses))
 		}
+		delete(liveDisks, exportedDisk.Name)
+	}
+	for _, disk := range live.Disks {
+		if _, added := liveDisks[disk.Name]; added {
+			return fmt.Sprintf("disk %s with licenses %s was attached since the export", disk.Name, licenseList(disk.Licenses))
+		}
+	}
+	return ""
+}
 
-		bootDisk := instanceObj.Disks[0]
-		diskName := ""
+// licenseList joins license codes for messages, or returns "none"
+func licenseList(codes []string) string {
+	if len(codes) == 0 {
+		return "none"
+	}
+	return strings.Join(codes, ", ")
+}
 
-		// Extract disk name from the source URL
-		if bootDisk.Source != "" {
-			parts := strings.Split(bootDisk.Source, "/")
-			if len(parts) > 0 {
-				diskName = parts[len(parts)-1]
-			}
-		}
+// ConvertOptions controls how a conversion plan is applied
+type ConvertOptions struct {
+	Parallel       int      // Number of disks converted at the same time
+	RatePerProject float64  // Maximum PATCH requests per second per project, 0 for no limit
+	Journal        *Journal // Records every state change so an interrupted run can be resumed
+}
 
-		if diskName == "" {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Could not determine disk name for instance %s\n", instance.Name)
-			continue
-		}
+// DefaultConvertOptions returns the options used by the menu and when no flags are given
+func DefaultConvertOptions() ConvertOptions {
+	return ConvertOptions{Parallel: 4, RatePerProject: 5}
+}
 
-		// Determine the appropriate PAYG license URL based on the current OS
-		var paygLicense string
+// ConvertToPAYG converts instances from BYOS to PAYG licensing
+func ConvertToPAYG(ctx context.Context, instances []Instance, computeService *compute.Service) ([]PAYGConversion, error) {
+	plan, err := PlanConversion(ctx, instances, ToPAYG, computeService)
+	if err != nil {
+		return nil, err
+	}
 
-		// Mapping logic
-		currentOS := strings.ToLower(strings.Join(instance.LicenseCodes, " "))
+	return ApplyPlan(ctx, plan, computeService, DefaultConvertOptions())
+}
 
-		switch {
-		case strings.Contains(currentOS, "rhel-8"):
-			paygLicense = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-8-server"
-		case strings.Contains(currentOS, "rhel-9"):
-			paygLicense = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-9-server"
-		case len(instance.LicenseCodes) == 0:
-			// No license codes found, check disk for any OS indicators
-			fmt.Printf("No license codes found for VM %s. Attempting to determine OS version...\n", instance.Name)
+// ConvertToBYOS converts instances from PAYG back to BYOS (Red Hat Cloud Access) licensing
+func ConvertToBYOS(ctx context.Context, instances []Instance, computeService *compute.Service) ([]PAYGConversion, error) {
+	plan, err := PlanConversion(ctx, instances, ToBYOS, computeService)
+	if err != nil {
+		return nil, err
+	}
 
-			// Get disk details directly
-			disk, err := computeService.Disks.Get(
-				instance.Project,
-				instance.Zone,
-				diskName).Context(ctx).Do()
+	return ApplyPlan(ctx, plan, computeService, DefaultConvertOptions())
+}
 
-			if err != nil {
-				fmt.Printf("Could not get disk details: %v. Defaulting to RHEL 9.\n", err)
-				paygLicense = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-9-server"
-			} else if disk.SourceImage != "" && strings.Contains(strings.ToLower(disk.SourceImage), "rhel-8") {
-				fmt.Printf("Detected RHEL 8 from disk source image: %s\n", disk.SourceImage)
-				paygLicense = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-8-server"
-			} else {
-				fmt.Printf("Could not determine specific OS version. Defaulting to RHEL 9.\n")
-				paygLicense = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-9-server"
-			}
-		default:
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Could not determine appropriate PAYG license for %s with OS: %s\n",
-				instance.Name, strings.Join(instance.LicenseCodes, ", "))
-			continue
+// ApplyPlan sends exactly the requests recorded in a conversion plan. Disks are converted
+// by a bounded pool of workers; results come back in plan order.
+func ApplyPlan(ctx context.Context, plan *ConversionPlan, computeService *compute.Service, opts ConvertOptions) ([]PAYGConversion, error) {
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+
+	// One authenticated client is shared by every worker
+	client, err := alphaHTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating HTTP client: %v", err)
+	}
+
+	// Journal the whole plan up front so a resume knows about items no worker reached
+	for _, item := range plan.Items {
+		if err := opts.Journal.journalItem(item, plan.Direction, JournalPending, "", nil, ""); err != nil {
+			return nil, err
 		}
+	}
 
-		// Use paths=licenses as shown in your example
-		apiURL := fmt.Sprintf("https://www.googleapis.com/compute/alpha/projects/%s/zones/%s/disks/%s?paths=licenses",
-			instance.Project, instance.Zone, diskName)
-		conversion.ConversionURL = apiURL
+	limiter := newProjectLimiter(opts.RatePerProject)
+	results := make([]PAYGConversion, len(plan.Items))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = applyPlanItem(ctx, plan.Items[i], plan.Direction, client, limiter, opts.Journal, computeService)
+			}
+		}()
+	}
 
-		// Create the request body with licenses array containing full URLs
-		requestBody := fmt.Sprintf(`{"name":"%s", "licenses":["%s"]}`, diskName, paygLicense)
+	for i := range plan.Items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
 
-		// Make the API call using a properly authenticated HTTP client
-		req, err := http.NewRequest("PATCH", apiURL, strings.NewReader(requestBody))
-		if err != nil {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Error creating request for %s: %v\n", instance.Name, err)
-			continue
-		}
+	return results, nil
+}
 
-		req.Header.Set("Content-Type", "application/json")
+// applyPlanItem converts a single disk and returns its conversion record
+func applyPlanItem(ctx context.Context, item PlanItem, direction ConversionDirection, client *http.Client,
+	limiter *projectLimiter, journal *Journal, computeService *compute.Service) PAYGConversion {
+	instance := item.instance()
+	label := direction.Label()
 
-		// Log what we're about to do
-		fmt.Printf("Converting disk for %s to PAYG license: %s\n", instance.Name, paygLicense)
+	// Prefix every line with the instance so concurrent output stays readable
+	logf := func(format string, args ...interface{}) {
+		progressf("[%s] "+format, append([]interface{}{instance.Name}, args...)...)
+	}
 
-		client, err := google.DefaultClient(ctx, compute.ComputeScope)
-		if err != nil {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Error creating HTTP client for %s: %v\n", instance.Name, err)
-			continue
+	// Rollbacks restore a whole license list rather than a single target
+	target := item.TargetLicense
+	if target == "" {
+		target = strings.Join(licenseCodesFromURLs(item.NewLicenses), ", ")
+	}
+
+	// Journal the item's state; a failed write is reported but never hides the result
+	var startedAt *time.Time
+	var operationName string
+	record := func(state JournalState, itemErr string) {
+		if err := journal.journalItem(item, direction, state, operationName, startedAt, itemErr); err != nil {
+			logf("⚠️ %v\n", err)
 		}
+	}
 
-		// Print the actual request being sent for debugging
-		fmt.Printf("Making request to URL: %s\n", apiURL)
+	// Audit every request that was sent, whatever its outcome
+	auditRequest := func(err error) {
+		auditAction(audit.Record{
+			Project:        instance.Project,
+			Resource:       diskResource(instance.Project, instance.Zone, item.Disk),
+			Action:         AuditDiskLicenses,
+			BeforeLicenses: item.CurrentLicenses,
+			AfterLicenses:  item.NewLicenses,
+			Operation:      operationName,
+		}, err)
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("Error making API request for %s: %v\n", instance.Name, err)
-			continue
-		}
-		defer resp.Body.Close()
+	// Create conversion record
+	conversion := PAYGConversion{
+		Instance:         instance,
+		OriginalOS:       strings.Join(instance.LicenseCodes, ", "),
+		ConversionURL:    item.URL,
+		Disk:             item.Disk,
+		OriginalLicenses: item.CurrentLicenses,
+		NewLicenses:      item.NewLicenses,
+	}
 
-		// Always read and log the response body for debugging
-		body, _ := io.ReadAll(resp.Body)
+	// Instances the plan could not resolve are reported but never touched
+	if item.Skipped != "" {
+		conversion.NewOS = "Skipped: " + item.Skipped
+		conversion.Skipped = true
+		logf("Skipping: %s\n", item.Skipped)
+		record(JournalSkipped, item.Skipped)
+		return conversion
+	}
 
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			conversion.Success = false
-			results = append(results, conversion)
-			fmt.Printf("❌ API request failed for %s: %d %s - %s\n",
-				instance.Name, resp.StatusCode, resp.Status, string(body))
-			continue
-		} else {
-			// Log successful response status
-			fmt.Printf("✓ API response: %d %s\n", resp.StatusCode, resp.Status)
-
-			// Parse the operation from the response
-			var operation struct {
-				Name   string `json:"name"`
-				Status string `json:"status"`
-				Zone   string `json:"zone"`
-			}
+	// Log instance status clearly
+	logf("Instance status: %s\n", instance.Status)
+	if instance.Status != "RUNNING" {
+		logf("💡 Note: VM is NOT running. License will be applied to disk but VM needs to be started to use the new license.\n")
+	}
 
-			if err := json.Unmarshal(body, &operation); err == nil && operation.Name != "" {
-				// Make it very clear this is the GCP operation status, not VM status
-				fmt.Printf("  GCP Disk Update Operation '%s':\n", operation.Name)
-				fmt.Printf("   - Operation Status: %s (this is the UPDATE operation, not the VM)\n", operation.Status)
-				fmt.Printf("   - Target: Disk %s\n", diskName)
+	// Refuse to apply a plan whose disk has changed since it was reviewed
+	disk, err := computeService.Disks.Get(instance.Project, instance.Zone, item.Disk).Context(ctx).Do()
+	if err != nil {
+		logf("Error getting disk details: %v\n", err)
+		record(JournalFailed, err.Error())
+		return conversion
+	}
 
-				// Wait a bit for the operation to make progress
-				time.Sleep(5 * time.Second)
-			}
-		}
+	if !sameLicenses(disk.Licenses, item.CurrentLicenses) {
+		conversion.NewOS = "Skipped: disk licenses changed since the plan was made"
+		logf("❌ Disk %s licenses changed since the plan was made (now: %s), not converting\n",
+			item.Disk, strings.Join(licenseCodesFromURLs(disk.Licenses), ", "))
+		record(JournalFailed, "disk licenses changed since the plan was made")
+		return conversion
+	}
 
-		conversion.Success = true
-		if instance.Status != "RUNNING" {
-			conversion.NewOS = fmt.Sprintf("PAYG license applied to disk (VM status: %s)", instance.Status)
-		} else {
-			conversion.NewOS = "PAYG: Converting to " + paygLicense
+	// Saved, resumed and rollback plans may be applied long after they were checked, so the
+	// safety checks run again on the live instance and disk
+	instanceObj, err := computeService.Instances.Get(instance.Project, instance.Zone, instance.Name).Context(ctx).Do()
+	if err != nil {
+		logf("Error getting instance details: %v\n", err)
+		record(JournalFailed, err.Error())
+		return conversion
+	}
+	boot := false
+	for _, attached := range instanceObj.Disks {
+		if attached.Boot && resourceName(attached.Source) == item.Disk {
+			boot = true
 		}
-		results = append(results, conversion)
+	}
+	if blocked := blockReason(RunSafetyChecks(SafetyTarget{Direction: direction, Instance: instanceObj, Disk: disk, Boot: boot})); blocked != "" {
+		conversion.NewOS = "Skipped: " + blocked
+		logf("❌ Disk %s %s, not converting\n", item.Disk, blocked)
+		record(JournalFailed, blocked)
+		return conversion
 	}
 
-	return results, nil
+	// Stay under the per-project request rate
+	if err := limiter.Wait(ctx, instance.Project); err != nil {
+		// Journaled as failed, so a resume knows the disk was never patched and retries it
+		conversion.NewOS = "Skipped: cancelled before sending request"
+		logf("Cancelled before sending request: %v\n", err)
+		record(JournalFailed, "cancelled before sending request: "+err.Error())
+		return conversion
+	}
+
+	// Mark the item in flight before the request leaves, so a crash is never unrecorded
+	now := time.Now().UTC()
+	startedAt = &now
+	if err := journal.journalItem(item, direction, JournalInFlight, "", startedAt, ""); err != nil {
+		logf("❌ Not converting, journal is not writable: %v\n", err)
+		return conversion
+	}
+
+	// Log what we're about to do
+	logf("Converting disk to %s license: %s\n", label, target)
+	logf("Making request to URL: %s\n", item.URL)
+
+	// Send the request using the shared authenticated HTTP client and wait for the disk update
+	_, err = patchDisk(ctx, client, computeService, instance.Project, instance.Zone, item.Method, item.URL, item.Body,
+		func(operation string) {
+			// Make it very clear this is the GCP operation status, not VM status
+			logf("GCP Disk Update Operation '%s' on disk %s accepted (this is the UPDATE operation, not the VM)\n",
+				operation, item.Disk)
+			operationName = operation
+			record(JournalInFlight, "")
+		})
+	if errors.Is(err, errNoOperation) {
+		// The change may or may not have been applied; leave it in flight so a resume re-verifies the disk
+		conversion.NewOS = fmt.Sprintf("Disk update not confirmed: %v", err)
+		logf("❌ Disk update not confirmed: %v\n", err)
+		record(JournalInFlight, err.Error())
+		auditRequest(err)
+		return conversion
+	}
+	if err != nil {
+		conversion.NewOS = fmt.Sprintf("Disk update failed: %v", err)
+		logf("❌ Disk update failed: %v\n", err)
+		record(JournalFailed, err.Error())
+		auditRequest(err)
+		return conversion
+	}
+	logf("GCP Disk Update Operation '%s': DONE\n", operationName)
+
+	// Done is only recorded once the operation has finished successfully
+	record(JournalDone, "")
+	auditRequest(nil)
+	conversion.Success = true
+	if instance.Status != "RUNNING" {
+		conversion.NewOS = fmt.Sprintf("%s license applied to disk (VM status: %s)", label, instance.Status)
+	} else {
+		conversion.NewOS = label + ": Converted to " + target
+	}
+	return conversion
 }
 
-// VerifyConversion checks if instances were properly converted to PAYG
-func VerifyConversion(ctx context.Context, conversions []PAYGConversion, computeService *compute.Service) []PAYGConversion {
-	// Add a delay to allow changes to propagate
-	fmt.Println("\nWaiting for license changes to propagate...")
-	time.Sleep(15 * time.Second)
+// sameLicenses reports whether two license URL lists hold the same licenses
+func sameLicenses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
 
+	seen := make(map[string]int)
+	for _, license := range a {
+		seen[licenseCodeFromURL(license)]++
+	}
+	for _, license := range b {
+		code := licenseCodeFromURL(license)
+		if seen[code] == 0 {
+			return false
+		}
+		seen[code]--
+	}
+	return true
+}
+
+// VerifyConversion checks if instances were properly converted
+func VerifyConversion(ctx context.Context, conversions []PAYGConversion, computeService *compute.Service) []PAYGConversion {
 	for i, conversion := range conversions {
 		if !conversion.Success {
 			continue
 		}
 
-		fmt.Printf("\nVerifying license change for %s (VM status: %s)...\n",
+		progressf("\nVerifying license change for %s (VM status: %s)...\n",
 			conversion.Instance.Name, conversion.Instance.Status)
 
-		// First get the disk directly instead of via the instance
-		instanceObj, err := computeService.Instances.Get(
-			conversion.Instance.Project,
-			conversion.Instance.Zone,
-			conversion.Instance.Name).Context(ctx).Do()
-
-		if err != nil {
-			fmt.Printf("Error getting instance for disk info: %v\n", err)
-			continue
+		// Use the disk the change was sent to, or the boot disk of the listed instance
+		diskName := conversion.Disk
+		if diskName == "" {
+			if bootDisk := conversion.Instance.BootDisk(); bootDisk != nil {
+				diskName = bootDisk.Name
+			}
 		}
+		if diskName == "" {
+			instanceObj, err := computeService.Instances.Get(
+				conversion.Instance.Project,
+				conversion.Instance.Zone,
+				conversion.Instance.Name).Context(ctx).Do()
 
-		if len(instanceObj.Disks) == 0 {
-			fmt.Printf("No disks found for instance %s\n", conversion.Instance.Name)
-			continue
-		}
+			if err != nil {
+				progressf("Error getting instance for disk info: %v\n", err)
+				continue
+			}
 
-		// Extract disk name
-		diskName := ""
-		if instanceObj.Disks[0].Source != "" {
-			parts := strings.Split(instanceObj.Disks[0].Source, "/")
-			if len(parts) > 0 {
-				diskName = parts[len(parts)-1]
+			live := instanceFromAPI(conversion.Instance.Project, conversion.Instance.Zone, instanceObj, nil)
+			bootDisk := live.BootDisk()
+			if bootDisk == nil {
+				progressf("No disks found for instance %s\n", conversion.Instance.Name)
+				continue
 			}
+			diskName = bootDisk.Name
 		}
 
 		if diskName == "" {
-			fmt.Printf("Could not determine disk name for %s\n", conversion.Instance.Name)
+			progressf("Could not determine disk name for %s\n", conversion.Instance.Name)
 			continue
 		}
 
-		fmt.Printf("Checking disk '%s' for license changes...\n", diskName)
+		progressf("Checking disk '%s' for license changes...\n", diskName)
 
 		// Get disk details directly
 		disk, err := computeService.Disks.Get(
@@ -311,32 +487,58 @@ func VerifyConversion(ctx context.Context, conversions []PAYGConversion, compute
 			diskName).Context(ctx).Do()
 
 		if err != nil {
-			fmt.Printf("Error getting disk details: %v\n", err)
+			progressf("Error getting disk details: %v\n", err)
 			continue
 		}
 
 		// Extract license information from disk
-		var licenseCodes []string
-		for _, license := range disk.Licenses {
-			parts := strings.Split(license, "/")
-			if len(parts) >= 6 {
-				project := parts[len(parts)-4]
-				licenseCode := parts[len(parts)-1]
-				licenseCodes = append(licenseCodes, fmt.Sprintf("%s:%s", project, licenseCode))
-			}
+		licenseCodes := licenseCodesFromURLs(disk.Licenses)
+		conversions[i].VerifiedLicenses = disk.Licenses
+
+		// Conversions that sent a change must have left exactly the planned licenses
+		if conversion.ConversionURL != "" && !sameLicenses(disk.Licenses, conversion.NewLicenses) {
+			progressf("❌ Disk licenses %s do not match the expected %s\n",
+				strings.Join(licenseCodes, ", "), strings.Join(licenseCodesFromURLs(conversion.NewLicenses), ", "))
+			conversions[i].Success = false
+			conversions[i].NewOS = "Unexpected licenses: " + strings.Join(licenseCodes, ", ")
+			continue
 		}
 
 		if len(licenseCodes) > 0 {
-			fmt.Printf("✓ Found %d licenses on disk: %s\n", len(licenseCodes), strings.Join(licenseCodes, ", "))
+			progressf("✓ Found %d licenses on disk: %s\n", len(licenseCodes), strings.Join(licenseCodes, ", "))
 			conversions[i].NewOS = strings.Join(licenseCodes, ", ")
 		} else if conversion.Instance.Status != "RUNNING" {
-			fmt.Printf("⚠️ No licenses found. VM is not running - start VM to apply license.\n")
+			progressf("⚠️ No licenses found. VM is not running - start VM to apply license.\n")
 			conversions[i].NewOS = "License changed, but VM needs to be started to verify"
 		} else {
-			fmt.Printf("⚠️ No licenses found, but VM is running. License change may be pending.\n")
+			progressf("⚠️ No licenses found, but VM is running. License change may be pending.\n")
 			conversions[i].NewOS = "License change may be pending"
 		}
 	}
 
 	return conversions
 }
+
+// DisplayConversionResults prints one block per conversion and returns the number that succeeded
+func DisplayConversionResults(conversions []PAYGConversion, w io.Writer) int {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	successful := 0
+	for _, conversion := range conversions {
+		status := "✓ Success"
+		if !conversion.Success {
+			status = "✗ Failed"
+		} else {
+			successful++
+		}
+
+		fmt.Fprintf(w, "%s  %s  %s\n", status, conversion.Instance.Name, conversion.Instance.Zone)
+		fmt.Fprintf(w, "  Before: %s\n", conversion.OriginalOS)
+		fmt.Fprintf(w, "  After:  %s\n", conversion.NewOS)
+		fmt.Fprintln(w)
+	}
+
+	return successful
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// planRHEL plans converting the fake's rhel instance to PAYG
+func planRHEL(t *testing.T, svc *compute.Service) *ConversionPlan {
+	t.Helper()
+
+	filter, _ := ParseFilter("name=rhel")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanConversion(context.Background(), instances, ToPAYG, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Convertible()) != 1 {
+		t.Fatalf("convertible items = %+v, want the rhel disk", plan.Items)
+	}
+	return plan
+}
+
+// lastJournalState returns the state of the last journal record of an instance
+func lastJournalState(t *testing.T, path, instance string) JournalState {
+	t.Helper()
+
+	records, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state JournalState
+	for _, rec := range records {
+		if rec.Instance == instance {
+			state = rec.State
+		}
+	}
+	return state
+}
+
+func TestApplyPlanWithoutOperationStaysInFlight(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+
+	// The PATCH is accepted but the response names no operation to wait for
+	alpha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"kind": "compute#operation"}`))
+	}))
+	t.Cleanup(alpha.Close)
+	SetAlphaEndpoint(alpha.URL, alpha.Client())
+	t.Cleanup(func() { SetAlphaEndpoint("", nil) })
+
+	// Plans record the request URL, so the endpoint must be set first
+	plan := planRHEL(t, svc)
+
+	path := filepath.Join(t.TempDir(), "run.journal.jsonl")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := ApplyPlan(context.Background(), plan, svc, ConvertOptions{Parallel: 1, Journal: journal})
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Success {
+		t.Errorf("result = %+v, want an unconfirmed change reported as not converted", results[0])
+	}
+	if state := lastJournalState(t, path, "rhel"); state != JournalInFlight {
+		t.Errorf("journal state = %s, want %s so a resume re-verifies the disk", state, JournalInFlight)
+	}
+	if got := fake.Disk("proj", "us-central1-a", "rhel").Licenses; len(got) != 1 || licenseCodeFromURL(got[0]) != "rhel-cloud:rhel-8-byos" {
+		t.Errorf("disk licenses = %v, the fake alpha endpoint should not have changed them", got)
+	}
+
+	// The disk is unchanged, so a resume retries the item
+	resumed, resumedJournal, unsettled, err := ResumePlan(context.Background(), path, svc)
+	if err != nil || len(unsettled) > 0 {
+		t.Fatal(err, unsettled)
+	}
+	resumedJournal.Close()
+	if len(resumed.Items) != 1 || resumed.Items[0].Instance != "rhel" {
+		t.Errorf("resumed items = %+v, want the unconfirmed rhel disk retried", resumed.Items)
+	}
+}
+
+func TestApplyPlanRerunsSafetyChecks(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	SetAlphaEndpoint(fake.AlphaEndpoint(), fake.HTTPClient())
+	t.Cleanup(func() { SetAlphaEndpoint("", nil) })
+	plan := planRHEL(t, svc)
+
+	// The instance is protected after the plan was made and saved
+	instance := fake.Instance("proj", "us-central1-a", "rhel")
+	instance.Labels[DoNotTouchLabel] = "true"
+	fake.AddInstance("proj", "us-central1-a", instance)
+
+	path := filepath.Join(t.TempDir(), "run.journal.jsonl")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := ApplyPlan(context.Background(), plan, svc, ConvertOptions{Parallel: 1, Journal: journal})
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Success || !strings.Contains(results[0].NewOS, DoNotTouchLabel) {
+		t.Errorf("result = %+v, want the item blocked by the protected check", results[0])
+	}
+	if state := lastJournalState(t, path, "rhel"); state != JournalFailed {
+		t.Errorf("journal state = %s, want %s", state, JournalFailed)
+	}
+	if got := fake.Disk("proj", "us-central1-a", "rhel").Licenses; len(got) != 1 || licenseCodeFromURL(got[0]) != "rhel-cloud:rhel-8-byos" {
+		t.Errorf("disk licenses = %v, a blocked item must not be patched", got)
+	}
+}
+
+func TestApplyPlanJournalsCancelledItems(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	SetAlphaEndpoint(fake.AlphaEndpoint(), fake.HTTPClient())
+	t.Cleanup(func() { SetAlphaEndpoint("", nil) })
+
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{
+		Name:     "rhel-2",
+		Licenses: []string{"https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-8-byos"},
+	})
+	fake.AddInstance("proj", "us-central1-a", &compute.Instance{
+		Name:  "rhel-2",
+		Disks: []*compute.AttachedDisk{{Boot: true, Source: "rhel-2"}},
+	})
+	filter, _ := ParseFilter("license~rhel-8")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanConversion(context.Background(), instances, ToPAYG, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "run.journal.jsonl")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One request a minute, so the second disk is still waiting for its turn when the run is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	results, err := ApplyPlan(ctx, plan, svc, ConvertOptions{Parallel: 1, RatePerProject: 1.0 / 60, Journal: journal})
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cancelled PAYGConversion
+	for _, result := range results {
+		if !result.Success {
+			cancelled = result
+		}
+	}
+	if cancelled.Instance.Name == "" || cancelled.NewOS == "" {
+		t.Fatalf("results = %+v, want the waiting disk reported as not converted", results)
+	}
+	if state := lastJournalState(t, path, cancelled.Instance.Name); state != JournalFailed {
+		t.Errorf("journal state = %s, want %s so a resume retries the disk", state, JournalFailed)
+	}
+
+	resumed, resumedJournal, unsettled, err := ResumePlan(context.Background(), path, svc)
+	if err != nil || len(unsettled) > 0 {
+		t.Fatal(err, unsettled)
+	}
+	resumedJournal.Close()
+	if len(resumed.Items) != 1 || resumed.Items[0].Instance != cancelled.Instance.Name {
+		t.Errorf("resumed items = %+v, want only the cancelled %s disk", resumed.Items, cancelled.Instance.Name)
+	}
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// ConversionDirection says which way a conversion moves the license
+type ConversionDirection string
+
+const (
+	// ToPAYG moves BYOS disks to the rhel-cloud pay-as-you-go licenses
+	ToPAYG ConversionDirection = "payg"
+	// ToBYOS moves PAYG disks to the Red Hat Cloud Access (BYOS) licenses
+	ToBYOS ConversionDirection = "byos"
+	// Rollback restores the licenses a disk had before an earlier run
+	Rollback ConversionDirection = "rollback"
+)
+
+// ParseDirection parses a -to flag value
+func ParseDirection(value string) (ConversionDirection, error) {
+	switch ConversionDirection(strings.ToLower(value)) {
+	case ToPAYG:
+		return ToPAYG, nil
+	case ToBYOS:
+		return ToBYOS, nil
+	default:
+		return "", fmt.Errorf("unknown conversion direction %q, expected payg or byos", value)
+	}
+}
+
+// Label returns the license model the direction converts to
+func (d ConversionDirection) Label() string {
+	switch d {
+	case ToBYOS:
+		return "BYOS"
+	case Rollback:
+		return "original"
+	case EditLicenses:
+		return "edited"
+	default:
+		return "PAYG"
+	}
+}
+
+// From returns the license model the direction converts from
+func (d ConversionDirection) From() string {
+	switch d {
+	case ToBYOS:
+		return "PAYG"
+	case Rollback:
+		return "converted"
+	case EditLicenses:
+		return "original"
+	default:
+		return "BYOS"
+	}
+}
+
+// ConversionPlan lists every disk change a conversion run will make, without making it
+type ConversionPlan struct {
+	Project   string              `yaml:"project" json:"project"`
+	Direction ConversionDirection `yaml:"direction" json:"direction"`
+	CreatedAt time.Time           `yaml:"createdAt" json:"createdAt"`
+	Items     []PlanItem          `yaml:"items" json:"items"`
+}
+
+// PlanItem is the resolved license change for a single instance
+type PlanItem struct {
+	Instance        string         `yaml:"instance" json:"instance"`
+	Zone            string         `yaml:"zone" json:"zone"`
+	Project         string         `yaml:"project" json:"project"`
+	Status          string         `yaml:"status" json:"status"`
+	MachineType     string         `yaml:"machineType,omitempty" json:"machineType,omitempty"`
+	Disk            string         `yaml:"disk,omitempty" json:"disk,omitempty"`
+	CurrentLicenses []string       `yaml:"currentLicenses,omitempty" json:"currentLicenses,omitempty"`
+	TargetLicense   string         `yaml:"targetLicense,omitempty" json:"targetLicense,omitempty"`
+	NewLicenses     []string       `yaml:"newLicenses,omitempty" json:"newLicenses,omitempty"` // Every license the disk will carry afterwards
+	Rule            string         `yaml:"rule,omitempty" json:"rule,omitempty"`               // Name of the mapping rule that chose the target
+	Method          string         `yaml:"method,omitempty" json:"method,omitempty"`
+	URL             string         `yaml:"url,omitempty" json:"url,omitempty"`
+	Body            string         `yaml:"body,omitempty" json:"body,omitempty"`
+	Skipped         string         `yaml:"skipped,omitempty" json:"skipped,omitempty"` // Reason the instance will not be converted
+	Checks          []SafetyResult `yaml:"checks,omitempty" json:"checks,omitempty"`   // Safety checks that warned or blocked
+}
+
+// instance rebuilds the Instance the plan item was made for
+func (item PlanItem) instance() Instance {
+	return Instance{
+		Name:         item.Instance,
+		Zone:         item.Zone,
+		Project:      item.Project,
+		Status:       item.Status,
+		MachineType:  item.MachineType,
+		LicenseCodes: licenseCodesFromURLs(item.CurrentLicenses),
+	}
+}
+
+// CurrentLicenseCodes returns the disk's licenses before the change as project:code values
+func (item PlanItem) CurrentLicenseCodes() []string {
+	return licenseCodesFromURLs(item.CurrentLicenses)
+}
+
+// NewLicenseCodes returns the disk's licenses after the change as project:code values
+func (item PlanItem) NewLicenseCodes() []string {
+	return licenseCodesFromURLs(item.NewLicenses)
+}
+
+// diskPatchBody is the JSON body sent to the alpha disks PATCH endpoint
+type diskPatchBody struct {
+	Name     string   `json:"name"`
+	Licenses []string `json:"licenses"`
+}
+
+// PlanConversion resolves each instance to its boot disk, current licenses, target license
+// and the exact PATCH request that would convert it. Nothing is changed.
+func PlanConversion(ctx context.Context, instances []Instance, direction ConversionDirection, computeService *compute.Service) (*ConversionPlan, error) {
+	return PlanConversionOnDisks(ctx, instances, direction, DiskSelector{}, computeService)
+}
+
+// PlanConversionOnDisks is PlanConversion for the disks chosen by selector. With selector.All,
+// data disks that no mapping rule matches are left out of the plan.
+func PlanConversionOnDisks(ctx context.Context, instances []Instance, direction ConversionDirection, selector DiskSelector,
+	computeService *compute.Service) (*ConversionPlan, error) {
+	return planDisks(ctx, instances, direction, selector, computeService,
+		func(disk *compute.Disk, boot bool) ([]string, string, string, string) {
+			rule := activeMappings.Match(direction, licenseCodesFromURLs(disk.Licenses), disk.SourceImage)
+			if rule == nil {
+				return nil, "", "", fmt.Sprintf("no %s license mapping rule matches licenses: %s",
+					direction.Label(), strings.Join(licenseCodesFromURLs(disk.Licenses), ", "))
+			}
+
+			newLicenses := rule.Apply(disk.Licenses)
+			if sameLicenses(newLicenses, disk.Licenses) {
+				return nil, "", "", fmt.Sprintf("disk already carries %s", licenseCodeFromURL(rule.TargetLicense))
+			}
+			return newLicenses, rule.Name, rule.TargetLicense, ""
+		})
+}
+
+// Convertible returns the plan items that will actually be applied
+func (plan *ConversionPlan) Convertible() []PlanItem {
+	var items []PlanItem
+	for _, item := range plan.Items {
+		if item.Skipped == "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DisplayPlan prints the plan as a table followed by the exact requests it will send
+func DisplayPlan(plan *ConversionPlan, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tZONE\tSTATUS\tDISK\tCURRENT\tTARGET\tRULE")
+	for _, item := range plan.Items {
+		current := "none"
+		if len(item.CurrentLicenses) > 0 {
+			current = strings.Join(licenseCodesFromURLs(item.CurrentLicenses), ", ")
+		}
+
+		target := "SKIPPED: " + item.Skipped
+		if item.Skipped == "" {
+			target = licenseCodeFromURL(item.TargetLicense)
+			if item.TargetLicense == "" {
+				target = strings.Join(licenseCodesFromURLs(item.NewLicenses), ", ")
+			}
+			if target == "" {
+				target = "none"
+			}
+		}
+
+		rule := item.Rule
+		if rule == "" {
+			rule = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			item.Instance, item.Zone, item.Status, item.Disk, current, target, rule)
+	}
+	tw.Flush()
+
+	displaySafetyResults(plan, w)
+
+	for _, item := range plan.Convertible() {
+		fmt.Fprintf(w, "\n%s:\n  %s %s\n  %s\n", item.Instance, item.Method, item.URL, item.Body)
+	}
+}
+
+// displaySafetyResults lists the safety checks that warned about or blocked a disk
+func displaySafetyResults(plan *ConversionPlan, w io.Writer) {
+	var lines []string
+	for _, item := range plan.Items {
+		for _, result := range item.Checks {
+			lines = append(lines, fmt.Sprintf("%s/%s\t%s\t%s\t%s", item.Instance, item.Disk, result.Verdict, result.Check, result.Reason))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nSafety checks (blocked disks are left out of the run):")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, line := range lines {
+		fmt.Fprintf(tw, "  %s\n", line)
+	}
+	tw.Flush()
+}
+
+// SavePlan writes the plan to a YAML file for review
+func SavePlan(plan *ConversionPlan, filename string) error {
+	data, err := yaml.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan to YAML: %v", err)
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write plan to file: %v", err)
+	}
+
+	return nil
+}
+
+// LoadPlan reads a plan written by SavePlan
+func LoadPlan(filename string) (*ConversionPlan, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file: %v", err)
+	}
+
+	var plan ConversionPlan
+	if err := yaml.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("error parsing plan: %v", err)
+	}
+
+	if len(plan.Items) == 0 {
+		return nil, fmt.Errorf("plan %s contains no instances", filename)
+	}
+
+	// Plans written before the direction was recorded were always BYOS to PAYG
+	if plan.Direction == "" {
+		plan.Direction = ToPAYG
+	}
+
+	// Plans written before NewLicenses was recorded carry it only in the request body
+	for i := range plan.Items {
+		item := &plan.Items[i]
+		if item.Skipped == "" && item.NewLicenses == nil {
+			var body diskPatchBody
+			if err := json.Unmarshal([]byte(item.Body), &body); err == nil {
+				item.NewLicenses = body.Licenses
+			}
+		}
+	}
+
+	return &plan, nil
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+)
+
+// Feature is something the tool does and the project permissions it needs
+type Feature struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// ConvertFeature is the feature the Mass Mover checks before it patches any disk
+const ConvertFeature = "convert"
+
+// TemplateConvertFeature is the feature the template command checks before it creates anything
+const TemplateConvertFeature = "template-convert"
+
+// Features lists every feature with the permissions its API calls need, in the order preflight shows them
+var Features = []Feature{
+	{Name: "list", Description: "List instances and their licenses",
+		Permissions: []string{"compute.instances.list", "compute.disks.list"}},
+	{Name: "inventory", Description: "List disks, images and snapshots with their licenses",
+		Permissions: []string{"compute.disks.list", "compute.images.list", "compute.snapshots.list"}},
+	{Name: "templates", Description: "List instance templates, their image licenses and managed instance groups",
+		Permissions: []string{"compute.instanceTemplates.list", "compute.images.get", "compute.instanceGroupManagers.list"}},
+	{Name: "start", Description: "Turn instances on",
+		Permissions: []string{"compute.instances.start", "compute.zoneOperations.get"}},
+	{Name: "stop", Description: "Turn instances off",
+		Permissions: []string{"compute.instances.stop", "compute.zoneOperations.get"}},
+	{Name: "license-metadata", Description: "Replace the license metadata of an instance",
+		Permissions: []string{"compute.instances.get", "compute.instances.setMetadata", "compute.zoneOperations.get"}},
+	{Name: "plan", Description: "Plan conversions and verify disk licenses",
+		Permissions: []string{"compute.instances.list", "compute.instances.get", "compute.disks.list", "compute.disks.get"}},
+	{Name: ConvertFeature, Description: "Change disk licenses: convert, apply, rollback and licenses add/remove/replace",
+		Permissions: []string{"compute.instances.list", "compute.instances.get", "compute.disks.list", "compute.disks.get",
+			"compute.disks.update", "compute.zoneOperations.get"}},
+	{Name: TemplateConvertFeature, Description: "Create an image and instance template with the other license model",
+		Permissions: []string{"compute.instanceTemplates.get", "compute.instanceTemplates.create", "compute.instanceGroupManagers.list",
+			"compute.images.get", "compute.images.useReadOnly", "compute.images.create", "compute.disks.create", "compute.disks.get",
+			"compute.disks.update", "compute.disks.delete", "compute.disks.useReadOnly", "compute.zoneOperations.get",
+			"compute.globalOperations.get"}},
+}
+
+// FeatureByName returns the named feature
+func FeatureByName(name string) (Feature, error) {
+	for _, feature := range Features {
+		if feature.Name == name {
+			return feature, nil
+		}
+	}
+
+	var names []string
+	for _, feature := range Features {
+		names = append(names, feature.Name)
+	}
+	return Feature{}, fmt.Errorf("unknown feature %q, use one of: %s", name, strings.Join(names, ", "))
+}
+
+// FeatureCheck is whether the caller holds every permission of a feature
+type FeatureCheck struct {
+	Feature     string   `yaml:"feature" json:"feature"`
+	Description string   `yaml:"description" json:"description"`
+	Available   bool     `yaml:"available" json:"available"`
+	Missing     []string `yaml:"missing,omitempty" json:"missing,omitempty"`
+}
+
+// PreflightReport is the result of testing the caller's permissions on a project
+type PreflightReport struct {
+	Project   string         `yaml:"project" json:"project"`
+	Principal string         `yaml:"principal" json:"principal"`
+	Features  []FeatureCheck `yaml:"features" json:"features"`
+}
+
+// Feature returns the check of the named feature
+func (r *PreflightReport) Feature(name string) (FeatureCheck, bool) {
+	for _, check := range r.Features {
+		if check.Feature == name {
+			return check, true
+		}
+	}
+	return FeatureCheck{}, false
+}
+
+// TestPermissions asks Resource Manager which of the permissions the caller holds on a project.
+// It needs no permission of its own, so it works for any identity that can reach the API.
+func TestPermissions(ctx context.Context, projectID string, permissions []string,
+	cloudResourceManagerService *cloudresourcemanager.Service) (map[string]bool, error) {
+	resp, err := cloudResourceManagerService.Projects.TestIamPermissions(projectID,
+		&cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to test permissions on project %s: %v", projectID, err)
+	}
+
+	granted := make(map[string]bool, len(resp.Permissions))
+	for _, permission := range resp.Permissions {
+		granted[permission] = true
+	}
+	return granted, nil
+}
+
+// Preflight tests the permissions of the given features, or of every feature when none are given
+func Preflight(ctx context.Context, projectID string, features []Feature,
+	cloudResourceManagerService *cloudresourcemanager.Service) (*PreflightReport, error) {
+	if len(features) == 0 {
+		features = Features
+	}
+
+	needed := make(map[string]bool)
+	for _, feature := range features {
+		for _, permission := range feature.Permissions {
+			needed[permission] = true
+		}
+	}
+	permissions := make([]string, 0, len(needed))
+	for permission := range needed {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+
+	granted, err := TestPermissions(ctx, projectID, permissions, cloudResourceManagerService)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PreflightReport{Project: projectID}
+	for _, feature := range features {
+		check := FeatureCheck{Feature: feature.Name, Description: feature.Description}
+		for _, permission := range feature.Permissions {
+			if !granted[permission] {
+				check.Missing = append(check.Missing, permission)
+			}
+		}
+		check.Available = len(check.Missing) == 0
+		report.Features = append(report.Features, check)
+	}
+	return report, nil
+}
+
+// PreflightConversion checks that the caller may change disk licenses in a project. It returns
+// the missing permissions, or an error when the permissions could not be tested at all.
+func PreflightConversion(ctx context.Context, projectID string,
+	cloudResourceManagerService *cloudresourcemanager.Service) ([]string, error) {
+	return PreflightFeature(ctx, projectID, ConvertFeature, cloudResourceManagerService)
+}
+
+// PreflightFeature returns the permissions of the named feature the caller lacks in a project
+func PreflightFeature(ctx context.Context, projectID, name string,
+	cloudResourceManagerService *cloudresourcemanager.Service) ([]string, error) {
+	feature, err := FeatureByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := Preflight(ctx, projectID, []Feature{feature}, cloudResourceManagerService)
+	if err != nil {
+		return nil, err
+	}
+	return report.Features[0].Missing, nil
+}
+
+// DisplayPreflight prints which features the caller's permissions allow
+func DisplayPreflight(report *PreflightReport, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	fmt.Fprintf(w, "Principal: %s\nProject:   %s\n\n", orDash(report.Principal), report.Project)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FEATURE\tAVAILABLE\tDESCRIPTION\tMISSING PERMISSIONS")
+	available := 0
+	for _, check := range report.Features {
+		status := "no"
+		if check.Available {
+			status = "yes"
+			available++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", check.Feature, status, check.Description, orDash(strings.Join(check.Missing, ", ")))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d of %d features available\n", available, len(report.Features))
+}
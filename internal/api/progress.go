@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// progressOutput receives status messages written while listing, converting and verifying
+var progressOutput = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stdout}
+
+// SetProgressOutput sends status messages to w. The command line uses stderr so that
+// stdout carries only the rendered results.
+func SetProgressOutput(w io.Writer) {
+	progressOutput.Lock()
+	defer progressOutput.Unlock()
+	progressOutput.w = w
+}
+
+// progressf writes a formatted status message
+func progressf(format string, args ...interface{}) {
+	progressOutput.Lock()
+	defer progressOutput.Unlock()
+	fmt.Fprintf(progressOutput.w, format, args...)
+}
+
+// progressln writes a status message followed by a newline
+func progressln(args ...interface{}) {
+	progressOutput.Lock()
+	defer progressOutput.Unlock()
+	fmt.Fprintln(progressOutput.w, args...)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
 )
 
 // Project represents a GCP project
@@ -12,11 +13,83 @@ type Project struct {
 	Name string
 }
 
-// ListProjects retrieves all projects accessible to the authenticated user
+// ListProjects retrieves all active projects accessible to the authenticated user
 func ListProjects(ctx context.Context, cloudResourceManagerService *cloudresourcemanager.Service) ([]Project, error) {
-	req := cloudResourceManagerService.Projects.List()
-	var projects []Project
+	projects, err := listProjects(ctx, "lifecycleState:ACTIVE", cloudResourceManagerService)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list projects: %v", err)
+	}
+	return projects, nil
+}
+
+// ListProjectsUnder retrieves the active projects below a folder or organization.
+// parentType is "folder" or "organization"; sub-folders are walked when recursive is set.
+// A sub-folder that cannot be read does not stop the walk: it is returned as a ProjectError
+// named folders/ID, next to the projects that could be listed.
+func ListProjectsUnder(ctx context.Context, parentType, parentID string, recursive bool,
+	cloudResourceManagerService *cloudresourcemanager.Service, foldersService *crmv2.Service) ([]Project, []ProjectError, error) {
+	if parentType != "folder" && parentType != "organization" {
+		return nil, nil, fmt.Errorf("unknown parent type %q, expected folder or organization", parentType)
+	}
+
+	// Accept both "123" and "folders/123" style IDs
+	parentID = resourceName(parentID)
 
+	projects, err := listProjectsIn(ctx, parentType, parentID, cloudResourceManagerService)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list projects in %s %s: %v", parentType, parentID, err)
+	}
+
+	if !recursive {
+		return projects, nil, nil
+	}
+
+	var scopeErrors []ProjectError
+	walkFolders(ctx, fmt.Sprintf("%ss/%s", parentType, parentID), cloudResourceManagerService, foldersService,
+		&projects, &scopeErrors)
+	return projects, scopeErrors, nil
+}
+
+// walkFolders adds the projects of every sub-folder of parent, which is named "folders/ID" or
+// "organizations/ID", and records the folders that could not be read
+func walkFolders(ctx context.Context, parent string, cloudResourceManagerService *cloudresourcemanager.Service,
+	foldersService *crmv2.Service, projects *[]Project, scopeErrors *[]ProjectError) {
+	var folderIDs []string
+	if err := foldersService.Folders.List().Parent(parent).Pages(ctx, func(page *crmv2.ListFoldersResponse) error {
+		for _, folder := range page.Folders {
+			if folder.LifecycleState == "ACTIVE" {
+				folderIDs = append(folderIDs, resourceName(folder.Name))
+			}
+		}
+		return nil
+	}); err != nil {
+		*scopeErrors = append(*scopeErrors, ProjectError{Project: parent, Err: fmt.Errorf("failed to list folders: %v", err)})
+		return
+	}
+
+	for _, folderID := range folderIDs {
+		folder := "folders/" + folderID
+		children, err := listProjectsIn(ctx, "folder", folderID, cloudResourceManagerService)
+		if err != nil {
+			*scopeErrors = append(*scopeErrors, ProjectError{Project: folder, Err: fmt.Errorf("failed to list projects: %v", err)})
+		} else {
+			*projects = append(*projects, children...)
+		}
+		walkFolders(ctx, folder, cloudResourceManagerService, foldersService, projects, scopeErrors)
+	}
+}
+
+// listProjectsIn lists the active projects directly in a folder or organization
+func listProjectsIn(ctx context.Context, parentType, parentID string,
+	cloudResourceManagerService *cloudresourcemanager.Service) ([]Project, error) {
+	return listProjects(ctx, fmt.Sprintf("parent.type:%s parent.id:%s lifecycleState:ACTIVE", parentType, parentID),
+		cloudResourceManagerService)
+}
+
+// listProjects lists the projects matching a Resource Manager filter
+func listProjects(ctx context.Context, filter string, cloudResourceManagerService *cloudresourcemanager.Service) ([]Project, error) {
+	var projects []Project
+	req := cloudResourceManagerService.Projects.List().Filter(filter)
 	if err := req.Pages(ctx, func(page *cloudresourcemanager.ListProjectsResponse) error {
 		for _, project := range page.Projects {
 			projects = append(projects, Project{
@@ -26,8 +99,7 @@ func ListProjects(ctx context.Context, cloudResourceManagerService *cloudresourc
 		}
 		return nil
 	}); err != nil {
-		return nil, fmt.Errorf("failed to list projects: %v", err)
+		return nil, err
 	}
-
 	return projects, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// projectLimiter spaces out requests so each project sees at most a fixed rate
+type projectLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+// newProjectLimiter allows perSecond requests per project; zero or less disables limiting
+func newProjectLimiter(perSecond float64) *projectLimiter {
+	limiter := &projectLimiter{next: make(map[string]time.Time)}
+	if perSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return limiter
+}
+
+// Wait blocks until the project may send another request or ctx is done
+func (l *projectLimiter) Wait(ctx context.Context, project string) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+
+	// Reserve the next free slot for this project
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next[project]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next[project] = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The types in this file implement output.Records so every command can render them as a
+// table, JSON, YAML, CSV or NDJSON. Column names match the json and yaml field names.
+
+// listCell joins a list for a table or CSV cell
+func listCell(values []string) string {
+	return strings.Join(values, ";")
+}
+
+// InstanceRecords is a list of instances in the export format
+type InstanceRecords []InstanceExport
+
+// Columns returns the field names of an instance record
+func (r InstanceRecords) Columns() []string {
+	return []string{"project", "name", "zone", "machineType", "status", "licenses", "mappingRule",
+		"otherDiskLicenses", "sourceImage", "creationTimestamp", "managedBy"}
+}
+
+// Rows returns one row per instance
+func (r InstanceRecords) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, instance := range r {
+		rows = append(rows, []string{
+			instance.Project,
+			instance.Name,
+			instance.Zone,
+			instance.MachineType,
+			instance.Status,
+			listCell(instance.Licenses),
+			instance.MappingRule,
+			listCell(instance.otherDiskLicenses()),
+			resourceName(instance.SourceImage),
+			instance.CreationTimestamp,
+			resourceName(instance.ManagedBy),
+		})
+	}
+	return rows
+}
+
+// otherDiskLicenses lists the licenses of non-boot disks as disk=license
+func (e InstanceExport) otherDiskLicenses() []string {
+	var licenses []string
+	for _, disk := range e.Disks {
+		if disk.Boot {
+			continue
+		}
+		for _, license := range disk.Licenses {
+			licenses = append(licenses, disk.Name+"="+license)
+		}
+	}
+	return licenses
+}
+
+// Records returns the instances for NDJSON output
+func (r InstanceRecords) Records() []interface{} {
+	records := make([]interface{}, len(r))
+	for i := range r {
+		records[i] = r[i]
+	}
+	return records
+}
+
+// Columns returns the field names of an inventory instance
+func (e InventoryExport) Columns() []string {
+	return InstanceRecords(e.Instances).Columns()
+}
+
+// Rows returns one row per instance; per-project errors are only in JSON and YAML
+func (e InventoryExport) Rows() [][]string {
+	return InstanceRecords(e.Instances).Rows()
+}
+
+// Records returns the instances for NDJSON output
+func (e InventoryExport) Records() []interface{} {
+	return InstanceRecords(e.Instances).Records()
+}
+
+// ToInventoryExport converts an inventory, including its per-project errors, to the export format
+func ToInventoryExport(inventory *Inventory) InventoryExport {
+	exportData := InventoryExport{
+		Projects:  inventory.Projects,
+		Instances: ToInstanceExports(inventory.Instances),
+	}
+	for _, projectErr := range inventory.Errors {
+		exportData.Errors = append(exportData.Errors, ProjectErrorExport{
+			Project: projectErr.Project,
+			Error:   projectErr.Err.Error(),
+		})
+	}
+	return exportData
+}
+
+// Columns returns the field names of a plan item
+func (plan *ConversionPlan) Columns() []string {
+	return []string{"project", "zone", "instance", "status", "disk", "currentLicenses", "newLicenses", "rule", "skipped", "checks"}
+}
+
+// Rows returns one row per plan item
+func (plan *ConversionPlan) Rows() [][]string {
+	rows := make([][]string, 0, len(plan.Items))
+	for _, item := range plan.Items {
+		rows = append(rows, []string{
+			item.Project,
+			item.Zone,
+			item.Instance,
+			item.Status,
+			item.Disk,
+			listCell(licenseCodesFromURLs(item.CurrentLicenses)),
+			listCell(licenseCodesFromURLs(item.NewLicenses)),
+			item.Rule,
+			item.Skipped,
+			listCell(safetyCells(item.Checks)),
+		})
+	}
+	return rows
+}
+
+// safetyCells formats safety results for a table or CSV cell
+func safetyCells(results []SafetyResult) []string {
+	cells := make([]string, 0, len(results))
+	for _, result := range results {
+		cells = append(cells, result.String())
+	}
+	return cells
+}
+
+// Records returns the plan items for NDJSON output
+func (plan *ConversionPlan) Records() []interface{} {
+	records := make([]interface{}, len(plan.Items))
+	for i := range plan.Items {
+		records[i] = plan.Items[i]
+	}
+	return records
+}
+
+// Outcomes of a conversion or verification
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+	OutcomeSkipped = "skipped"
+)
+
+// ConversionResult is the machine-readable result of converting or verifying one instance.
+// License lists hold project:code values.
+type ConversionResult struct {
+	Project          string   `yaml:"project" json:"project"`
+	Zone             string   `yaml:"zone" json:"zone"`
+	Instance         string   `yaml:"instance" json:"instance"`
+	Status           string   `yaml:"status" json:"status"`
+	Disk             string   `yaml:"disk,omitempty" json:"disk,omitempty"`
+	Outcome          string   `yaml:"outcome" json:"outcome"`
+	OriginalLicenses []string `yaml:"originalLicenses" json:"originalLicenses"`
+	ExpectedLicenses []string `yaml:"expectedLicenses,omitempty" json:"expectedLicenses,omitempty"`
+	VerifiedLicenses []string `yaml:"verifiedLicenses,omitempty" json:"verifiedLicenses,omitempty"`
+	Message          string   `yaml:"message,omitempty" json:"message,omitempty"`
+}
+
+// ConversionResults is the result list of a conversion run or a verification
+type ConversionResults []ConversionResult
+
+// ToConversionResults converts conversion records to their machine-readable form
+func ToConversionResults(conversions []PAYGConversion) ConversionResults {
+	results := make(ConversionResults, 0, len(conversions))
+	for _, conversion := range conversions {
+		result := ConversionResult{
+			Project:          conversion.Instance.Project,
+			Zone:             conversion.Instance.Zone,
+			Instance:         conversion.Instance.Name,
+			Status:           conversion.Instance.Status,
+			Disk:             conversion.Disk,
+			Outcome:          OutcomeSuccess,
+			OriginalLicenses: licenseCodesFromURLs(conversion.OriginalLicenses),
+			ExpectedLicenses: licenseCodesFromURLs(conversion.NewLicenses),
+			VerifiedLicenses: licenseCodesFromURLs(conversion.VerifiedLicenses),
+			Message:          conversion.NewOS,
+		}
+
+		// Verification of instances that were never converted only knows the listed licenses
+		if result.OriginalLicenses == nil {
+			result.OriginalLicenses = append([]string{}, conversion.Instance.LicenseCodes...)
+		}
+
+		switch {
+		case conversion.Skipped:
+			result.Outcome = OutcomeSkipped
+		case !conversion.Success:
+			result.Outcome = OutcomeFailed
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Succeeded returns the number of successful results
+func (r ConversionResults) Succeeded() int {
+	count := 0
+	for _, result := range r {
+		if result.Outcome == OutcomeSuccess {
+			count++
+		}
+	}
+	return count
+}
+
+// Columns returns the field names of a result
+func (r ConversionResults) Columns() []string {
+	return []string{"project", "zone", "instance", "status", "disk", "outcome",
+		"originalLicenses", "expectedLicenses", "verifiedLicenses", "message"}
+}
+
+// Rows returns one row per result
+func (r ConversionResults) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, result := range r {
+		rows = append(rows, []string{
+			result.Project,
+			result.Zone,
+			result.Instance,
+			result.Status,
+			result.Disk,
+			result.Outcome,
+			listCell(result.OriginalLicenses),
+			listCell(result.ExpectedLicenses),
+			listCell(result.VerifiedLicenses),
+			result.Message,
+		})
+	}
+	return rows
+}
+
+// Records returns the results for NDJSON output
+func (r ConversionResults) Records() []interface{} {
+	records := make([]interface{}, len(r))
+	for i := range r {
+		records[i] = r[i]
+	}
+	return records
+}
+
+// DiskLicenseRecord is one attached disk and the licenses it carries
+type DiskLicenseRecord struct {
+	Project     string   `yaml:"project" json:"project"`
+	Zone        string   `yaml:"zone" json:"zone"`
+	Instance    string   `yaml:"instance" json:"instance"`
+	Disk        string   `yaml:"disk" json:"disk"`
+	Boot        bool     `yaml:"boot" json:"boot"`
+	SizeGB      int64    `yaml:"sizeGb" json:"sizeGb"`
+	SourceImage string   `yaml:"sourceImage,omitempty" json:"sourceImage,omitempty"`
+	Licenses    []string `yaml:"licenses" json:"licenses"`
+	MappingRule string   `yaml:"mappingRule,omitempty" json:"mappingRule,omitempty"`
+}
+
+// DiskLicenseRecords lists the disks of one or more instances
+type DiskLicenseRecords []DiskLicenseRecord
+
+// ToDiskLicenseRecords lists every disk of the instances with the rule that would apply to it
+func ToDiskLicenseRecords(instances []Instance) DiskLicenseRecords {
+	var records DiskLicenseRecords
+	for _, instance := range instances {
+		for _, disk := range instance.Disks {
+			record := DiskLicenseRecord{
+				Project:     instance.Project,
+				Zone:        instance.Zone,
+				Instance:    instance.Name,
+				Disk:        disk.Name,
+				Boot:        disk.Boot,
+				SizeGB:      disk.SizeGB,
+				SourceImage: disk.SourceImage,
+				Licenses:    append([]string{}, disk.Licenses...),
+			}
+			if rule := activeMappings.MatchAny(disk.Licenses, disk.SourceImage); rule != nil {
+				record.MappingRule = rule.Name
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Columns returns the field names of a disk record
+func (r DiskLicenseRecords) Columns() []string {
+	return []string{"project", "zone", "instance", "disk", "boot", "sizeGb", "sourceImage", "licenses", "mappingRule"}
+}
+
+// Rows returns one row per disk
+func (r DiskLicenseRecords) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, record := range r {
+		rows = append(rows, []string{
+			record.Project,
+			record.Zone,
+			record.Instance,
+			record.Disk,
+			strconv.FormatBool(record.Boot),
+			strconv.FormatInt(record.SizeGB, 10),
+			resourceName(record.SourceImage),
+			listCell(record.Licenses),
+			record.MappingRule,
+		})
+	}
+	return rows
+}
+
+// Records returns the disks for NDJSON output
+func (r DiskLicenseRecords) Records() []interface{} {
+	records := make([]interface{}, len(r))
+	for i := range r {
+		records[i] = r[i]
+	}
+	return records
+}
+
+// LicensedResources lists disks, images or snapshots
+type LicensedResources []LicensedResource
+
+// Columns returns the field names of a resource record
+func (r LicensedResources) Columns() []string {
+	return []string{"kind", "project", "name", "location", "status", "sizeGb", "attached", "users", "source", "family",
+		"licenses", "mappingRule", "creationTimestamp"}
+}
+
+// Rows returns one row per resource
+func (r LicensedResources) Rows() [][]string {
+	rows := make([][]string, 0, len(r))
+	for _, resource := range r {
+		rows = append(rows, []string{
+			string(resource.Kind),
+			resource.Project,
+			resource.Name,
+			resource.Location,
+			resource.Status,
+			strconv.FormatInt(resource.SizeGB, 10),
+			strconv.FormatBool(resource.Attached),
+			listCell(resource.Users),
+			resourceName(resource.Source),
+			resource.Family,
+			listCell(resource.Licenses),
+			resource.MappingRule,
+			resource.CreationTimestamp,
+		})
+	}
+	return rows
+}
+
+// Records returns the resources for NDJSON output
+func (r LicensedResources) Records() []interface{} {
+	records := make([]interface{}, len(r))
+	for i := range r {
+		records[i] = r[i]
+	}
+	return records
+}
+
+// Columns returns the field names of an exported instance
+func (d *InstanceExportDocument) Columns() []string {
+	return InstanceRecords(d.Instances).Columns()
+}
+
+// Rows returns one row per instance; the header only appears in JSON and YAML
+func (d *InstanceExportDocument) Rows() [][]string {
+	return InstanceRecords(d.Instances).Rows()
+}
+
+// Records returns one record per instance
+func (d *InstanceExportDocument) Records() []interface{} {
+	return InstanceRecords(d.Instances).Records()
+}
+
+// Columns returns the field names of a feature check
+func (r *PreflightReport) Columns() []string {
+	return []string{"project", "principal", "feature", "available", "description", "missing"}
+}
+
+// Rows returns one row per feature
+func (r *PreflightReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r.Features))
+	for _, check := range r.Features {
+		rows = append(rows, []string{
+			r.Project,
+			r.Principal,
+			check.Feature,
+			strconv.FormatBool(check.Available),
+			check.Description,
+			listCell(check.Missing),
+		})
+	}
+	return rows
+}
+
+// Records returns the feature checks for NDJSON output
+func (r *PreflightReport) Records() []interface{} {
+	records := make([]interface{}, len(r.Features))
+	for i := range r.Features {
+		records[i] = r.Features[i]
+	}
+	return records
+}
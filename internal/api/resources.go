@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// ResourceKind is a kind of resource that carries licenses outside running instances
+type ResourceKind string
+
+const (
+	DiskResources     ResourceKind = "disks"
+	ImageResources    ResourceKind = "images"
+	SnapshotResources ResourceKind = "snapshots"
+	TemplateResources ResourceKind = "templates"
+)
+
+// ParseResourceKind parses "disks", "images", "snapshots" or "templates"
+func ParseResourceKind(value string) (ResourceKind, error) {
+	switch kind := ResourceKind(strings.ToLower(value)); kind {
+	case DiskResources, ImageResources, SnapshotResources, TemplateResources:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unknown resource kind %q, use disks, images, snapshots or templates", value)
+	}
+}
+
+// LicensedResource is a disk, image, snapshot or instance template and the licenses it carries.
+// Detached disks, custom images and snapshots pass their licenses on to every VM created from
+// them; a template passes on the licenses of its boot disk's source image.
+type LicensedResource struct {
+	Kind              ResourceKind `yaml:"kind" json:"kind"`
+	Project           string       `yaml:"project" json:"project"`
+	Name              string       `yaml:"name" json:"name"`
+	Location          string       `yaml:"location" json:"location"` // Zone of a disk, storage locations of images and snapshots
+	Status            string       `yaml:"status" json:"status"`
+	SizeGB            int64        `yaml:"sizeGb" json:"sizeGb"`
+	Attached          bool         `yaml:"attached" json:"attached"`                 // Disks and templates
+	Users             []string     `yaml:"users,omitempty" json:"users,omitempty"`   // Instances of a disk, managed instance groups of a template
+	Source            string       `yaml:"source,omitempty" json:"source,omitempty"` // Source image of a disk, image or template, source disk of a snapshot
+	Family            string       `yaml:"family,omitempty" json:"family,omitempty"`
+	Licenses          []string     `yaml:"licenses" json:"licenses"`
+	MappingRule       string       `yaml:"mappingRule,omitempty" json:"mappingRule,omitempty"`
+	CreationTimestamp string       `yaml:"creationTimestamp,omitempty" json:"creationTimestamp,omitempty"`
+}
+
+// ResourceInventory is the combined resource list of several projects
+type ResourceInventory struct {
+	Kind      ResourceKind
+	Projects  []string
+	Resources []LicensedResource
+	Errors    []ProjectError
+}
+
+// ListResources lists every resource of a kind in a project with its licenses
+func ListResources(ctx context.Context, kind ResourceKind, projectID string, computeService *compute.Service) ([]LicensedResource, error) {
+	var resources []LicensedResource
+	var err error
+
+	switch kind {
+	case DiskResources:
+		err = computeService.Disks.AggregatedList(projectID).Pages(ctx, func(page *compute.DiskAggregatedList) error {
+			for _, scoped := range page.Items {
+				for _, disk := range scoped.Disks {
+					resources = append(resources, resourceFromDisk(projectID, disk))
+				}
+			}
+			return nil
+		})
+	case ImageResources:
+		err = computeService.Images.List(projectID).Pages(ctx, func(page *compute.ImageList) error {
+			for _, image := range page.Items {
+				resources = append(resources, resourceFromImage(projectID, image))
+			}
+			return nil
+		})
+	case SnapshotResources:
+		err = computeService.Snapshots.List(projectID).Pages(ctx, func(page *compute.SnapshotList) error {
+			for _, snapshot := range page.Items {
+				resources = append(resources, resourceFromSnapshot(projectID, snapshot))
+			}
+			return nil
+		})
+	case TemplateResources:
+		resources, err = listTemplateResources(ctx, projectID, computeService)
+	default:
+		return nil, fmt.Errorf("unknown resource kind %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %v", kind, err)
+	}
+
+	sort.SliceStable(resources, func(a, b int) bool {
+		if resources[a].Location != resources[b].Location {
+			return resources[a].Location < resources[b].Location
+		}
+		return resources[a].Name < resources[b].Name
+	})
+	return resources, nil
+}
+
+// ListResourcesAcrossProjects runs ListResources for every project with at most parallel
+// projects in flight. Projects that fail are reported in Errors and do not stop the others.
+func ListResourcesAcrossProjects(ctx context.Context, kind ResourceKind, projectIDs []string, parallel int,
+	computeService *compute.Service) *ResourceInventory {
+	inventory := &ResourceInventory{Kind: kind, Projects: projectIDs}
+	results := make([][]LicensedResource, len(projectIDs))
+	errs := make([]error, len(projectIDs))
+
+	forEachProject(len(projectIDs), parallel, func(i int) {
+		results[i], errs[i] = ListResources(ctx, kind, projectIDs[i], computeService)
+	})
+
+	for i, projectID := range projectIDs {
+		if errs[i] != nil {
+			inventory.Errors = append(inventory.Errors, ProjectError{Project: projectID, Err: errs[i]})
+			continue
+		}
+		inventory.Resources = append(inventory.Resources, results[i]...)
+	}
+
+	return inventory
+}
+
+// resourceFromDisk describes a disk; its users are the instances it is attached to
+func resourceFromDisk(projectID string, disk *compute.Disk) LicensedResource {
+	resource := LicensedResource{
+		Kind:              DiskResources,
+		Project:           projectID,
+		Name:              disk.Name,
+		Location:          resourceName(disk.Zone),
+		Status:            disk.Status,
+		SizeGB:            disk.SizeGb,
+		Attached:          len(disk.Users) > 0,
+		Source:            disk.SourceImage,
+		Licenses:          licenseCodesFromURLs(disk.Licenses),
+		CreationTimestamp: disk.CreationTimestamp,
+	}
+	if disk.Region != "" {
+		resource.Location = resourceName(disk.Region)
+	}
+	for _, user := range disk.Users {
+		resource.Users = append(resource.Users, resourceName(user))
+	}
+	resource.MappingRule = resourceMappingRule(resource.Licenses, disk.SourceImage)
+	return resource
+}
+
+// resourceFromImage describes an image. Mapping rules see the image itself as the source image,
+// so a custom RHEL image is matched before new VMs are created from it.
+func resourceFromImage(projectID string, image *compute.Image) LicensedResource {
+	source := image.SourceImage
+	if source == "" {
+		source = image.SourceDisk
+	}
+
+	resource := LicensedResource{
+		Kind:              ImageResources,
+		Project:           projectID,
+		Name:              image.Name,
+		Location:          strings.Join(image.StorageLocations, ","),
+		Status:            image.Status,
+		SizeGB:            image.DiskSizeGb,
+		Source:            source,
+		Family:            image.Family,
+		Licenses:          licenseCodesFromURLs(image.Licenses),
+		CreationTimestamp: image.CreationTimestamp,
+	}
+
+	resource.MappingRule = resourceMappingRule(resource.Licenses, image.SelfLink)
+	if resource.MappingRule == "" && image.SourceImage != "" {
+		resource.MappingRule = resourceMappingRule(resource.Licenses, image.SourceImage)
+	}
+	return resource
+}
+
+// resourceFromSnapshot describes a snapshot and the disk it was taken from
+func resourceFromSnapshot(projectID string, snapshot *compute.Snapshot) LicensedResource {
+	resource := LicensedResource{
+		Kind:              SnapshotResources,
+		Project:           projectID,
+		Name:              snapshot.Name,
+		Location:          strings.Join(snapshot.StorageLocations, ","),
+		Status:            snapshot.Status,
+		SizeGB:            snapshot.DiskSizeGb,
+		Source:            snapshot.SourceDisk,
+		Licenses:          licenseCodesFromURLs(snapshot.Licenses),
+		CreationTimestamp: snapshot.CreationTimestamp,
+	}
+	resource.MappingRule = resourceMappingRule(resource.Licenses, "")
+	return resource
+}
+
+// resourceMappingRule names the rule that would apply to the resource, or ""
+func resourceMappingRule(licenseCodes []string, sourceImage string) string {
+	rule := activeMappings.MatchAny(licenseCodes, sourceImage)
+	if rule == nil {
+		return ""
+	}
+	return rule.Name
+}
+
+// DisplayResourceInventory prints the combined resource table followed by any per-project errors
+func DisplayResourceInventory(inventory *ResourceInventory, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tNAME\tLOCATION\tSTATUS\tSIZE (GB)\tATTACHED TO\tSOURCE\tLICENSES\tMAPPING RULE")
+	unattached := 0
+	for _, resource := range inventory.Resources {
+		licenses := "none"
+		if len(resource.Licenses) > 0 {
+			licenses = strings.Join(resource.Licenses, ", ")
+		}
+
+		// Attachment only means something for disks and the groups using a template
+		attachedTo := "-"
+		switch resource.Kind {
+		case DiskResources, TemplateResources:
+			attachedTo = "(unattached)"
+			if resource.Kind == TemplateResources {
+				attachedTo = "(unused)"
+			}
+			if resource.Attached {
+				attachedTo = strings.Join(resource.Users, ", ")
+			} else {
+				unattached++
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			resource.Project,
+			resource.Name,
+			resource.Location,
+			orDash(resource.Status),
+			resource.SizeGB,
+			attachedTo,
+			orDash(resourceName(resource.Source)),
+			licenses,
+			orDash(resource.MappingRule))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d %s", len(inventory.Resources), inventory.Kind)
+	switch inventory.Kind {
+	case DiskResources:
+		fmt.Fprintf(w, " (%d unattached)", unattached)
+	case TemplateResources:
+		fmt.Fprintf(w, " (%d unused by managed instance groups)", unattached)
+	}
+	fmt.Fprintf(w, " in %d of %d projects\n", len(inventory.Projects)-len(inventory.Errors), len(inventory.Projects))
+
+	if len(inventory.Errors) > 0 {
+		fmt.Fprintf(w, "\nProjects that could not be listed (%d):\n", len(inventory.Errors))
+		for _, projectErr := range inventory.Errors {
+			fmt.Fprintf(w, "  - %s: %v\n", projectErr.Project, projectErr.Err)
+		}
+	}
+}
+
+// orDash returns value, or "-" when it is empty
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
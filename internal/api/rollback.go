@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// PlanRollback builds a plan that puts back the exact licenses each disk had before the run
+// recorded in a journal. Only instances named in instanceNames are included when it is not empty.
+// Only disks the run changed are restored: items whose last state is done or in flight, and
+// whose live licenses are still exactly what the run set. Anything else is reported as skipped
+// so a change made since, by hand or by another tool, is never overwritten.
+// The plan is applied with ApplyPlan like any other, so it is journaled and verified the same way.
+func PlanRollback(ctx context.Context, journalPath string, instanceNames []string, computeService *compute.Service) (*ConversionPlan, error) {
+	records, err := ReadJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pending records hold the plan item, and with it the original licenses; the last record the state
+	var order []string
+	pending := make(map[string]JournalRecord)
+	last := make(map[string]JournalRecord)
+	for _, rec := range records {
+		key := rec.key()
+		if rec.State == JournalPending && rec.Item != nil {
+			if _, seen := pending[key]; !seen {
+				pending[key] = rec
+				order = append(order, key)
+			}
+		}
+		last[key] = rec
+	}
+
+	plan := &ConversionPlan{Direction: Rollback, CreatedAt: time.Now().UTC()}
+
+	for _, key := range order {
+		rec := pending[key]
+		if rec.Item.Skipped != "" {
+			continue
+		}
+
+		if len(instanceNames) > 0 && !containsString(instanceNames, rec.Instance) {
+			continue
+		}
+
+		if plan.Project == "" {
+			plan.Project = rec.Project
+		}
+
+		// Journals written before NewLicenses was recorded carry it only in the request body
+		original := *rec.Item
+		if original.NewLicenses == nil {
+			var body diskPatchBody
+			if err := json.Unmarshal([]byte(original.Body), &body); err == nil {
+				original.NewLicenses = body.Licenses
+			}
+		}
+
+		item := PlanItem{
+			Instance: original.Instance,
+			Zone:     original.Zone,
+			Project:  original.Project,
+			Status:   original.Status,
+			Disk:     original.Disk,
+			Rule:     "rollback of " + string(rec.Direction),
+		}
+
+		// Items that failed or were never sent did not change the disk
+		if state := last[key].State; state != JournalDone && state != JournalInFlight {
+			item.Skipped = fmt.Sprintf("the run did not change this disk (last state: %s)", state)
+			plan.Items = append(plan.Items, item)
+			continue
+		}
+
+		// Plan against the disk as it is now
+		disk, err := computeService.Disks.Get(item.Project, item.Zone, item.Disk).Context(ctx).Do()
+		if err != nil {
+			item.Skipped = fmt.Sprintf("error getting disk details: %v", err)
+			plan.Items = append(plan.Items, item)
+			continue
+		}
+		item.CurrentLicenses = disk.Licenses
+
+		if sameLicenses(disk.Licenses, original.CurrentLicenses) {
+			item.Skipped = "disk already has its original licenses"
+			plan.Items = append(plan.Items, item)
+			continue
+		}
+
+		if !sameLicenses(disk.Licenses, original.NewLicenses) {
+			item.Skipped = fmt.Sprintf("disk licenses changed since the run (now: %s, the run set: %s), not restoring",
+				licenseList(licenseCodesFromURLs(disk.Licenses)), licenseList(licenseCodesFromURLs(original.NewLicenses)))
+			plan.Items = append(plan.Items, item)
+			continue
+		}
+
+		// An empty list must still be sent as [] so the licenses are cleared
+		restored := append([]string{}, original.CurrentLicenses...)
+		body, err := json.Marshal(diskPatchBody{Name: item.Disk, Licenses: restored})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build request body for %s: %v", item.Instance, err)
+		}
+
+		item.NewLicenses = restored
+		item.Method = "PATCH"
+		item.URL = diskPatchURL(item.Project, item.Zone, item.Disk)
+		item.Body = string(body)
+		plan.Items = append(plan.Items, item)
+	}
+
+	if len(plan.Items) == 0 {
+		if len(instanceNames) > 0 {
+			return nil, fmt.Errorf("journal %s has no converted instances named %s", journalPath, strings.Join(instanceNames, ", "))
+		}
+		return nil, fmt.Errorf("journal %s has no converted instances to roll back", journalPath)
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestPlanRollbackOnlyRestoresDisksTheRunChanged(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	SetAlphaEndpoint(fake.AlphaEndpoint(), fake.HTTPClient())
+	t.Cleanup(func() { SetAlphaEndpoint("", nil) })
+
+	byos := "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-8-byos"
+	for _, name := range []string{"failed", "relicensed"} {
+		fake.AddDisk("proj", "us-central1-a", &compute.Disk{Name: name, Licenses: []string{byos}})
+		fake.AddInstance("proj", "us-central1-a", &compute.Instance{
+			Name:  name,
+			Disks: []*compute.AttachedDisk{{Boot: true, Source: name}},
+		})
+	}
+	fake.FailDiskPatch("proj", "us-central1-a", "failed", "license change rejected")
+
+	filter, _ := ParseFilter("license~rhel-8-byos")
+	instances, err := ListInstancesFiltered(context.Background(), "proj", svc, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanConversion(context.Background(), instances, ToPAYG, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "run.journal.jsonl")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyPlan(context.Background(), plan, svc, ConvertOptions{Parallel: 1, Journal: journal}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	// After the run, someone else licenses the disk whose update failed and changes a converted one
+	sap := "https://www.googleapis.com/compute/v1/projects/rhel-sap-cloud/global/licenses/rhel-8-sap"
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{Name: "failed", Licenses: []string{sap}})
+	relicensed := fake.Disk("proj", "us-central1-a", "relicensed")
+	fake.AddDisk("proj", "us-central1-a", &compute.Disk{Name: "relicensed", Licenses: append(relicensed.Licenses, sap)})
+
+	rollback, err := PlanRollback(context.Background(), path, nil, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"rhel":       "",
+		"failed":     "the run did not change this disk (last state: failed)",
+		"relicensed": "disk licenses changed since the run",
+	}
+	if len(rollback.Items) != len(want) {
+		t.Fatalf("rollback items = %+v, want %d", rollback.Items, len(want))
+	}
+	for _, item := range rollback.Items {
+		reason, ok := want[item.Instance]
+		switch {
+		case !ok:
+			t.Errorf("unexpected rollback item %+v", item)
+		case reason == "" && item.Skipped != "":
+			t.Errorf("%s skipped (%s), want it restored", item.Instance, item.Skipped)
+		case reason != "" && !strings.HasPrefix(item.Skipped, reason):
+			t.Errorf("%s skipped = %q, want %q", item.Instance, item.Skipped, reason)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// SafetyVerdict is the outcome of a safety check
+type SafetyVerdict string
+
+const (
+	SafetyPass  SafetyVerdict = "pass"
+	SafetyWarn  SafetyVerdict = "warn"  // Shown before confirmation; the disk is still changed
+	SafetyBlock SafetyVerdict = "block" // The disk is left out of the run
+)
+
+// DoNotTouchLabel marks instances the tool must never change
+const DoNotTouchLabel = "do-not-touch"
+
+// SafetyTarget is one disk of one instance that a plan is about to change
+type SafetyTarget struct {
+	Direction ConversionDirection
+	Instance  *compute.Instance
+	Disk      *compute.Disk
+	Boot      bool
+}
+
+// SafetyCheck inspects a target before its licenses are changed. Check returns a verdict and,
+// unless the target passes, the reason.
+type SafetyCheck struct {
+	Name  string
+	Check func(target SafetyTarget) (SafetyVerdict, string)
+}
+
+// SafetyResult is the outcome of one check on one disk
+type SafetyResult struct {
+	Check   string        `yaml:"check" json:"check"`
+	Verdict SafetyVerdict `yaml:"verdict" json:"verdict"`
+	Reason  string        `yaml:"reason" json:"reason"`
+}
+
+// String formats the result as check=verdict: reason
+func (r SafetyResult) String() string {
+	return fmt.Sprintf("%s=%s: %s", r.Check, r.Verdict, r.Reason)
+}
+
+// DefaultSafetyChecks returns the checks every plan runs unless replaced with SetSafetyChecks
+func DefaultSafetyChecks() []SafetyCheck {
+	return []SafetyCheck{
+		{Name: "shared-disk", Check: checkSharedDisk},
+		{Name: "managed-instance-group", Check: checkManagedInstanceGroup},
+		{Name: "protected", Check: checkProtected},
+		{Name: "rhel-image", Check: checkRHELImage},
+	}
+}
+
+// safetyChecks holds the check chain used by planDisks
+var safetyChecks = struct {
+	sync.Mutex
+	checks []SafetyCheck
+}{checks: DefaultSafetyChecks()}
+
+// SetSafetyChecks replaces the check chain. A nil chain restores the defaults.
+func SetSafetyChecks(checks []SafetyCheck) {
+	if checks == nil {
+		checks = DefaultSafetyChecks()
+	}
+
+	safetyChecks.Lock()
+	defer safetyChecks.Unlock()
+	safetyChecks.checks = checks
+}
+
+// AddSafetyCheck appends a check to the chain
+func AddSafetyCheck(check SafetyCheck) {
+	safetyChecks.Lock()
+	defer safetyChecks.Unlock()
+	safetyChecks.checks = append(append([]SafetyCheck{}, safetyChecks.checks...), check)
+}
+
+// RunSafetyChecks runs every check in order and returns the results that did not pass
+func RunSafetyChecks(target SafetyTarget) []SafetyResult {
+	safetyChecks.Lock()
+	checks := safetyChecks.checks
+	safetyChecks.Unlock()
+
+	var results []SafetyResult
+	for _, check := range checks {
+		verdict, reason := check.Check(target)
+		if verdict == SafetyPass {
+			continue
+		}
+		results = append(results, SafetyResult{Check: check.Name, Verdict: verdict, Reason: reason})
+	}
+	return results
+}
+
+// blockReason joins the reasons of the blocking results, or returns "" when nothing blocks
+func blockReason(results []SafetyResult) string {
+	var reasons []string
+	for _, result := range results {
+		if result.Verdict == SafetyBlock {
+			reasons = append(reasons, result.Check+": "+result.Reason)
+		}
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return "blocked by safety check " + strings.Join(reasons, "; ")
+}
+
+// checkSharedDisk blocks disks attached to several instances or opened for multi-writer access,
+// since a license change on them affects every instance using the disk
+func checkSharedDisk(target SafetyTarget) (SafetyVerdict, string) {
+	if len(target.Disk.Users) > 1 {
+		var users []string
+		for _, user := range target.Disk.Users {
+			users = append(users, resourceName(user))
+		}
+		return SafetyBlock, fmt.Sprintf("disk is attached to %d instances: %s", len(users), strings.Join(users, ", "))
+	}
+	if strings.HasSuffix(target.Disk.AccessMode, "_MANY") {
+		return SafetyBlock, fmt.Sprintf("disk access mode is %s", target.Disk.AccessMode)
+	}
+	return SafetyPass, ""
+}
+
+// checkManagedInstanceGroup blocks members of a managed instance group, which recreates them from
+// its template and so undoes any change made to their disks
+func checkManagedInstanceGroup(target SafetyTarget) (SafetyVerdict, string) {
+	if manager := instanceGroupManager(target.Instance); manager != "" {
+		return SafetyBlock, fmt.Sprintf("member of managed instance group %s, which recreates it from its template; "+
+			"change the template's image instead", resourceName(manager))
+	}
+	return SafetyPass, ""
+}
+
+// instanceGroupManager returns the managed instance group that created an instance, or ""
+func instanceGroupManager(instance *compute.Instance) string {
+	if instance == nil || instance.Metadata == nil {
+		return ""
+	}
+	for _, item := range instance.Metadata.Items {
+		if item.Key == "created-by" && item.Value != nil && strings.Contains(*item.Value, "/instanceGroupManagers/") {
+			return *item.Value
+		}
+	}
+	return ""
+}
+
+// checkProtected blocks instances labeled do-not-touch and warns about deletion-protected ones
+func checkProtected(target SafetyTarget) (SafetyVerdict, string) {
+	instance := target.Instance
+	if value, ok := instance.Labels[DoNotTouchLabel]; ok && value != "false" {
+		return SafetyBlock, fmt.Sprintf("instance is labeled %s", DoNotTouchLabel)
+	}
+	if value, ok := instance.Labels["deletion-protection"]; ok && value != "false" {
+		return SafetyWarn, "instance is labeled deletion-protection"
+	}
+	if instance.DeletionProtection {
+		return SafetyWarn, "instance has deletion protection enabled"
+	}
+	return SafetyPass, ""
+}
+
+// checkRHELImage blocks BYOS and PAYG conversions of disks that do not look like RHEL at all, and
+// warns when only the licenses do. Other license edits are not limited to RHEL.
+func checkRHELImage(target SafetyTarget) (SafetyVerdict, string) {
+	if target.Direction != ToPAYG && target.Direction != ToBYOS {
+		return SafetyPass, ""
+	}
+
+	rhelLicenses := false
+	for _, code := range licenseCodesFromURLs(target.Disk.Licenses) {
+		if strings.Contains(code, "rhel") {
+			rhelLicenses = true
+		}
+	}
+	image := target.Disk.SourceImage
+	rhelImage := strings.Contains(resourceName(image), "rhel") || strings.Contains(image, "/rhel-cloud/")
+
+	switch {
+	case rhelImage || (rhelLicenses && image == ""):
+		return SafetyPass, ""
+	case rhelLicenses:
+		return SafetyWarn, fmt.Sprintf("source image %s is not a RHEL image, only the licenses are", resourceName(image))
+	case image == "":
+		return SafetyBlock, "disk has no source image and no RHEL license"
+	default:
+		return SafetyBlock, fmt.Sprintf("source image %s and licenses do not look like RHEL", resourceName(image))
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestDefaultSafetyChecks(t *testing.T) {
+	const rhelImage = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/images/rhel-9-v20250101"
+	byos := []string{licenseURLFromCode("rhel-cloud:rhel-9-byos")}
+	migValue := "projects/123/zones/us-central1-a/instanceGroupManagers/web"
+
+	tests := []struct {
+		name     string
+		instance *compute.Instance
+		disk     *compute.Disk
+		want     string // check=verdict of every result, comma-separated
+	}{
+		{"plain RHEL", &compute.Instance{}, &compute.Disk{SourceImage: rhelImage, Licenses: byos}, ""},
+		{"imported RHEL", &compute.Instance{}, &compute.Disk{Licenses: byos}, ""},
+		{"shared", &compute.Instance{}, &compute.Disk{SourceImage: rhelImage, Licenses: byos, Users: []string{"a", "b"}},
+			"shared-disk=block"},
+		{"multi-writer", &compute.Instance{}, &compute.Disk{SourceImage: rhelImage, Licenses: byos, AccessMode: "READ_WRITE_MANY"},
+			"shared-disk=block"},
+		{"MIG member", &compute.Instance{Metadata: &compute.Metadata{Items: []*compute.MetadataItems{{Key: "created-by", Value: &migValue}}}},
+			&compute.Disk{SourceImage: rhelImage, Licenses: byos}, "managed-instance-group=block"},
+		{"do-not-touch", &compute.Instance{Labels: map[string]string{"do-not-touch": "true"}},
+			&compute.Disk{SourceImage: rhelImage, Licenses: byos}, "protected=block"},
+		{"deletion protection", &compute.Instance{DeletionProtection: true},
+			&compute.Disk{SourceImage: rhelImage, Licenses: byos}, "protected=warn"},
+		{"custom image", &compute.Instance{}, &compute.Disk{SourceImage: "projects/p/global/images/golden-v3", Licenses: byos},
+			"rhel-image=warn"},
+		{"not RHEL", &compute.Instance{}, &compute.Disk{SourceImage: "projects/debian-cloud/global/images/debian-12"},
+			"rhel-image=block"},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, result := range RunSafetyChecks(SafetyTarget{Direction: ToPAYG, Instance: test.instance, Disk: test.disk, Boot: true}) {
+			got = append(got, result.Check+"="+string(result.Verdict))
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("%s: results = %v, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPlanExcludesBlockedDisks(t *testing.T) {
+	_, svc := newFakeCompute(t)
+
+	AddSafetyCheck(SafetyCheck{Name: "no-prod", Check: func(target SafetyTarget) (SafetyVerdict, string) {
+		if target.Instance.Labels["env"] == "prod" {
+			return SafetyBlock, "production instance"
+		}
+		return SafetyPass, ""
+	}})
+	t.Cleanup(func() { SetSafetyChecks(nil) })
+
+	instances, err := ListInstances(context.Background(), "proj", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanConversion(context.Background(), instances, ToPAYG, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range plan.Items {
+		if item.Instance != "rhel" {
+			continue
+		}
+		if !strings.Contains(item.Skipped, "no-prod: production instance") || len(item.Checks) != 1 {
+			t.Errorf("rhel item = %+v, want it blocked by no-prod", item)
+		}
+	}
+	if len(plan.Convertible()) != 0 {
+		t.Errorf("convertible items = %+v, want none", plan.Convertible())
+	}
+}
@@ -0,0 +1,457 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/audit"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Audited actions of a template conversion
+const (
+	AuditInsertDisk     = "disks.insert"
+	AuditDeleteDisk     = "disks.delete"
+	AuditInsertImage    = "images.insert"
+	AuditInsertTemplate = "instanceTemplates.insert"
+)
+
+// ManagedGroup is a managed instance group that creates its instances from a template
+type ManagedGroup struct {
+	Name     string `yaml:"name" json:"name"`
+	Location string `yaml:"location" json:"location"` // Zone or region
+	Regional bool   `yaml:"regional,omitempty" json:"regional,omitempty"`
+}
+
+// listTemplateResources lists the global instance templates of a project with the licenses of
+// their boot images and the managed instance groups that use them. Groups or images that cannot
+// be read are noted in the status of the templates they affect rather than failing the list.
+func listTemplateResources(ctx context.Context, projectID string, computeService *compute.Service) ([]LicensedResource, error) {
+	groups, groupsErr := templateGroups(ctx, projectID, computeService)
+	if groupsErr != nil {
+		progressf("⚠️ %s: templates are listed without their managed instance groups: %v\n", projectID, groupsErr)
+	}
+
+	var templates []*compute.InstanceTemplate
+	err := computeService.InstanceTemplates.List(projectID).Pages(ctx, func(page *compute.InstanceTemplateList) error {
+		templates = append(templates, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Many templates boot from the same image or family
+	type resolvedImage struct {
+		image *compute.Image
+		err   error
+	}
+	images := make(map[string]resolvedImage)
+	var resources []LicensedResource
+	for _, template := range templates {
+		resource := LicensedResource{
+			Kind:              TemplateResources,
+			Project:           projectID,
+			Name:              template.Name,
+			Location:          "global",
+			CreationTimestamp: template.CreationTimestamp,
+		}
+		for _, group := range groups[template.Name] {
+			resource.Users = append(resource.Users, group.Name)
+		}
+		resource.Attached = len(resource.Users) > 0
+		var status []string
+		if groupsErr != nil {
+			status = append(status, "managed instance groups unknown")
+		}
+
+		params := templateBootParams(template)
+		if params == nil || params.SourceImage == "" {
+			resource.Status = strings.Join(append(status, "no source image"), "; ")
+			resources = append(resources, resource)
+			continue
+		}
+		resource.SizeGB = params.DiskSizeGb
+		resource.Source = params.SourceImage
+
+		resolved, ok := images[params.SourceImage]
+		if !ok {
+			resolved.image, resolved.err = resolveImage(ctx, params.SourceImage, projectID, computeService)
+			images[params.SourceImage] = resolved
+		}
+
+		licenses := params.Licenses
+		if image := resolved.image; resolved.err == nil {
+			resource.Source = image.SelfLink
+			resource.Family = image.Family
+			licenses = append(append([]string{}, image.Licenses...), params.Licenses...)
+			if resource.SizeGB == 0 {
+				resource.SizeGB = image.DiskSizeGb
+			}
+		} else {
+			progressf("⚠️ %s: template %s: error getting image %s: %v\n", projectID, template.Name,
+				resourceName(params.SourceImage), resolved.err)
+			status = append(status, fmt.Sprintf("error getting image: %v", resolved.err))
+		}
+		resource.Status = strings.Join(status, "; ")
+		resource.Licenses = licenseCodesFromURLs(licenses)
+		resource.MappingRule = resourceMappingRule(resource.Licenses, resource.Source)
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+// templateGroups maps template names to the managed instance groups using them, counting both
+// the group's template and the templates of its rolling update versions
+func templateGroups(ctx context.Context, projectID string, computeService *compute.Service) (map[string][]ManagedGroup, error) {
+	groups := make(map[string][]ManagedGroup)
+	err := computeService.InstanceGroupManagers.AggregatedList(projectID).Pages(ctx, func(page *compute.InstanceGroupManagerAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, manager := range scoped.InstanceGroupManagers {
+				group := ManagedGroup{Name: manager.Name, Location: resourceName(manager.Zone)}
+				if manager.Region != "" {
+					group.Location = resourceName(manager.Region)
+					group.Regional = true
+				}
+
+				templates := []string{manager.InstanceTemplate}
+				for _, version := range manager.Versions {
+					templates = append(templates, version.InstanceTemplate)
+				}
+				seen := make(map[string]bool)
+				for _, template := range templates {
+					name := resourceName(template)
+					if name == "" || seen[name] {
+						continue
+					}
+					seen[name] = true
+					groups[name] = append(groups[name], group)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing managed instance groups: %v", err)
+	}
+	return groups, nil
+}
+
+// templateBootParams returns the initialize params of a template's boot disk, or nil
+func templateBootParams(template *compute.InstanceTemplate) *compute.AttachedDiskInitializeParams {
+	if template.Properties == nil {
+		return nil
+	}
+	for _, disk := range template.Properties.Disks {
+		if disk.Boot && disk.InitializeParams != nil {
+			return disk.InitializeParams
+		}
+	}
+	return nil
+}
+
+// resolveImage looks up the image a source image reference points to. References may be full
+// URLs, projects/P/global/images/NAME, family references, or global/images/NAME relative to
+// the template's project.
+func resolveImage(ctx context.Context, source, defaultProject string, computeService *compute.Service) (*compute.Image, error) {
+	project := defaultProject
+	parts := strings.Split(source, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "projects" {
+			project = parts[i+1]
+		}
+	}
+
+	if len(parts) >= 2 && parts[len(parts)-2] == "family" {
+		return computeService.Images.GetFromFamily(project, parts[len(parts)-1]).Context(ctx).Do()
+	}
+	return computeService.Images.Get(project, parts[len(parts)-1]).Context(ctx).Do()
+}
+
+// TemplateConversion is the plan for replacing an instance template whose source image carries
+// the wrong license. Managed instance groups recreate their instances from the template, so
+// converting their disks does not last; the template needs an image with the new license.
+type TemplateConversion struct {
+	Project         string
+	Template        string
+	Direction       ConversionDirection
+	SourceImage     string   // Image the template boots from today
+	CurrentLicenses []string // License URLs of that image and the template's boot disk
+	NewLicenses     []string
+	Rule            string
+	Zone            string // Zone of the temporary disk the new image is made from
+	DiskName        string
+	ImageName       string
+	NewTemplate     string
+	Groups          []ManagedGroup // Groups to roll onto the new template
+
+	template *compute.InstanceTemplate
+}
+
+// TemplateConversionOptions names the resources a template conversion creates. Empty names are
+// derived from the existing image and template.
+type TemplateConversionOptions struct {
+	Zone        string
+	ImageName   string
+	NewTemplate string
+}
+
+// PlanTemplateConversion works out the image and template that replace a template whose boot
+// image carries the licenses of the other model. Nothing is changed.
+func PlanTemplateConversion(ctx context.Context, projectID, templateName string, direction ConversionDirection,
+	opts TemplateConversionOptions, computeService *compute.Service) (*TemplateConversion, error) {
+	if opts.Zone == "" {
+		return nil, fmt.Errorf("a zone is needed for the temporary disk the new image is made from")
+	}
+
+	template, err := computeService.InstanceTemplates.Get(projectID, templateName).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance template %s: %v", templateName, err)
+	}
+
+	params := templateBootParams(template)
+	if params == nil || params.SourceImage == "" {
+		return nil, fmt.Errorf("instance template %s does not create its boot disk from an image", templateName)
+	}
+
+	image, err := resolveImage(ctx, params.SourceImage, projectID, computeService)
+	if err != nil {
+		return nil, fmt.Errorf("error getting source image %s of template %s: %v", params.SourceImage, templateName, err)
+	}
+
+	current := append(append([]string{}, image.Licenses...), params.Licenses...)
+	rule := activeMappings.Match(direction, licenseCodesFromURLs(current), image.SelfLink)
+	if rule == nil {
+		return nil, fmt.Errorf("no mapping rule converts image %s (%s) to %s", image.Name,
+			strings.Join(licenseCodesFromURLs(current), ", "), direction.Label())
+	}
+	newLicenses := rule.Apply(current)
+	if sameLicenses(newLicenses, current) {
+		return nil, fmt.Errorf("image %s already carries the %s licenses", image.Name, direction.Label())
+	}
+
+	groups, err := templateGroups(ctx, projectID, computeService)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := "-" + string(direction)
+	conversion := &TemplateConversion{
+		Project:         projectID,
+		Template:        templateName,
+		Direction:       direction,
+		SourceImage:     image.SelfLink,
+		CurrentLicenses: current,
+		NewLicenses:     newLicenses,
+		Rule:            rule.Name,
+		Zone:            opts.Zone,
+		ImageName:       opts.ImageName,
+		NewTemplate:     opts.NewTemplate,
+		Groups:          groups[templateName],
+		template:        template,
+	}
+	if conversion.ImageName == "" {
+		conversion.ImageName = resourceNameWithSuffix(image.Name, suffix)
+	}
+	if conversion.NewTemplate == "" {
+		conversion.NewTemplate = resourceNameWithSuffix(templateName, suffix)
+	}
+	conversion.DiskName = resourceNameWithSuffix(conversion.ImageName, "-tmp")
+	return conversion, nil
+}
+
+// resourceNameWithSuffix appends suffix, shortening name so the result stays within the
+// 63 characters Compute Engine allows
+func resourceNameWithSuffix(name, suffix string) string {
+	const maxLength = 63
+	if len(name)+len(suffix) > maxLength {
+		name = strings.TrimRight(name[:maxLength-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// ConvertTemplate creates the image and template of a planned conversion: it creates a
+// temporary disk from the old image, changes the disk's licenses, creates the new image from
+// the disk and a copy of the template that boots from it. The temporary disk is always
+// deleted. Managed instance groups are left on the old template.
+func ConvertTemplate(ctx context.Context, conversion *TemplateConversion, computeService *compute.Service) error {
+	if conversion.template == nil {
+		return fmt.Errorf("template conversion was not planned with PlanTemplateConversion")
+	}
+
+	client, err := alphaHTTPClient()
+	if err != nil {
+		return fmt.Errorf("error creating HTTP client: %v", err)
+	}
+
+	project, zone := conversion.Project, conversion.Zone
+	diskResourceName := diskResource(project, zone, conversion.DiskName)
+
+	// 1. Temporary disk from the old image
+	progressf("Creating temporary disk %s in %s from %s\n", conversion.DiskName, zone, resourceName(conversion.SourceImage))
+	op, err := computeService.Disks.Insert(project, zone, &compute.Disk{
+		Name:        conversion.DiskName,
+		SourceImage: conversion.SourceImage,
+		Description: fmt.Sprintf("Temporary disk for converting template %s to %s", conversion.Template, conversion.Direction.Label()),
+	}).Context(ctx).Do()
+	if err == nil {
+		_, err = WaitForZoneOperation(ctx, computeService, project, zone, op.Name)
+	}
+	auditAction(audit.Record{Project: project, Resource: diskResourceName, Action: AuditInsertDisk, Operation: operationName(op)}, err)
+	if err != nil {
+		return fmt.Errorf("error creating temporary disk %s: %v", conversion.DiskName, err)
+	}
+
+	defer func() {
+		progressf("Deleting temporary disk %s\n", conversion.DiskName)
+		op, err := computeService.Disks.Delete(project, zone, conversion.DiskName).Context(ctx).Do()
+		if err == nil {
+			_, err = WaitForZoneOperation(ctx, computeService, project, zone, op.Name)
+		}
+		auditAction(audit.Record{Project: project, Resource: diskResourceName, Action: AuditDeleteDisk, Operation: operationName(op)}, err)
+		if err != nil {
+			progressf("⚠️ Could not delete temporary disk %s, delete it by hand: %v\n", conversion.DiskName, err)
+		}
+	}()
+
+	// 2. New licenses on the disk
+	progressf("Changing licenses of %s to %s\n", conversion.DiskName, strings.Join(licenseCodesFromURLs(conversion.NewLicenses), ", "))
+	disk, err := computeService.Disks.Get(project, zone, conversion.DiskName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error getting temporary disk %s: %v", conversion.DiskName, err)
+	}
+	body, err := json.Marshal(diskPatchBody{Name: conversion.DiskName, Licenses: conversion.NewLicenses})
+	if err != nil {
+		return fmt.Errorf("failed to build request body for %s: %v", conversion.DiskName, err)
+	}
+	patchOperation, err := patchDisk(ctx, client, computeService, project, zone, http.MethodPatch,
+		diskPatchURL(project, zone, conversion.DiskName), string(body), nil)
+	auditAction(audit.Record{
+		Project:        project,
+		Resource:       diskResourceName,
+		Action:         AuditDiskLicenses,
+		BeforeLicenses: disk.Licenses,
+		AfterLicenses:  conversion.NewLicenses,
+		Operation:      patchOperation,
+	}, err)
+	if err != nil {
+		return fmt.Errorf("error changing licenses of temporary disk %s: %v", conversion.DiskName, err)
+	}
+
+	// 3. New image from the disk
+	progressf("Creating image %s\n", conversion.ImageName)
+	op, err = computeService.Images.Insert(project, &compute.Image{
+		Name:        conversion.ImageName,
+		SourceDisk:  disk.SelfLink,
+		Description: fmt.Sprintf("%s copy of %s", conversion.Direction.Label(), resourceName(conversion.SourceImage)),
+	}).Context(ctx).Do()
+	if err == nil {
+		_, err = WaitForGlobalOperation(ctx, computeService, project, op.Name)
+	}
+	auditAction(audit.Record{
+		Project:       project,
+		Resource:      fmt.Sprintf("projects/%s/global/images/%s", project, conversion.ImageName),
+		Action:        AuditInsertImage,
+		AfterLicenses: conversion.NewLicenses,
+		Operation:     operationName(op),
+	}, err)
+	if err != nil {
+		return fmt.Errorf("error creating image %s: %v", conversion.ImageName, err)
+	}
+
+	// 4. Copy of the template that boots from the new image
+	progressf("Creating instance template %s\n", conversion.NewTemplate)
+	template := conversion.newTemplate(fmt.Sprintf("projects/%s/global/images/%s", project, conversion.ImageName))
+	op, err = computeService.InstanceTemplates.Insert(project, template).Context(ctx).Do()
+	if err == nil {
+		_, err = WaitForGlobalOperation(ctx, computeService, project, op.Name)
+	}
+	auditAction(audit.Record{
+		Project:       project,
+		Resource:      fmt.Sprintf("projects/%s/global/instanceTemplates/%s", project, conversion.NewTemplate),
+		Action:        AuditInsertTemplate,
+		AfterLicenses: conversion.NewLicenses,
+		Operation:     operationName(op),
+	}, err)
+	if err != nil {
+		return fmt.Errorf("error creating instance template %s: %v", conversion.NewTemplate, err)
+	}
+
+	return nil
+}
+
+// newTemplate copies the old template's properties with the boot disk created from image.
+// The template's own boot disk licenses are dropped, since the new image already carries them.
+func (c *TemplateConversion) newTemplate(image string) *compute.InstanceTemplate {
+	properties := *c.template.Properties
+	properties.Disks = nil
+	for _, disk := range c.template.Properties.Disks {
+		copied := *disk
+		if disk.Boot && disk.InitializeParams != nil {
+			params := *disk.InitializeParams
+			params.SourceImage = image
+			params.Licenses = nil
+			copied.InitializeParams = &params
+		}
+		properties.Disks = append(properties.Disks, &copied)
+	}
+
+	return &compute.InstanceTemplate{
+		Name:        c.NewTemplate,
+		Description: fmt.Sprintf("%s copy of %s", c.Direction.Label(), c.Template),
+		Properties:  &properties,
+	}
+}
+
+// operationName returns the name of an operation, or "" when the request failed
+func operationName(op *compute.Operation) string {
+	if op == nil {
+		return ""
+	}
+	return op.Name
+}
+
+// DisplayTemplateConversion prints what a template conversion creates and how to move the
+// managed instance groups onto the new template afterwards
+func DisplayTemplateConversion(conversion *TemplateConversion, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	fmt.Fprintf(w, "Template:     %s (project %s)\n", conversion.Template, conversion.Project)
+	fmt.Fprintf(w, "Source image: %s\n", resourceName(conversion.SourceImage))
+	fmt.Fprintf(w, "Licenses:     %s -> %s (rule %s)\n",
+		strings.Join(licenseCodesFromURLs(conversion.CurrentLicenses), ", "),
+		strings.Join(licenseCodesFromURLs(conversion.NewLicenses), ", "), conversion.Rule)
+
+	fmt.Fprintf(w, "\nSteps:\n")
+	fmt.Fprintf(w, "  1. Create temporary disk %s in %s from %s\n", conversion.DiskName, conversion.Zone, resourceName(conversion.SourceImage))
+	fmt.Fprintf(w, "  2. Change its licenses to %s\n", strings.Join(licenseCodesFromURLs(conversion.NewLicenses), ", "))
+	fmt.Fprintf(w, "  3. Create image %s from the disk\n", conversion.ImageName)
+	fmt.Fprintf(w, "  4. Create instance template %s, a copy of %s booting from %s\n", conversion.NewTemplate, conversion.Template, conversion.ImageName)
+	fmt.Fprintf(w, "  5. Delete the temporary disk\n")
+
+	if len(conversion.Groups) == 0 {
+		fmt.Fprintf(w, "\nNo managed instance group uses %s.\n", conversion.Template)
+		return
+	}
+
+	fmt.Fprintf(w, "\nManaged instance groups are not changed. Roll them onto the new template when ready:\n")
+	for _, group := range conversion.Groups {
+		location := "--zone=" + group.Location
+		if group.Regional {
+			location = "--region=" + group.Location
+		}
+		fmt.Fprintf(w, "  gcloud compute instance-groups managed set-instance-template %s --template=%s %s --project=%s\n",
+			group.Name, conversion.NewTemplate, location, conversion.Project)
+		fmt.Fprintf(w, "  gcloud compute instance-groups managed rolling-action start-update %s --version=template=%s %s --project=%s\n",
+			group.Name, conversion.NewTemplate, location, conversion.Project)
+	}
+}
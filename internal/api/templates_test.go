@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestListTemplateResourcesReportsImageErrors(t *testing.T) {
+	fake, svc := newFakeCompute(t)
+	fake.AddImage("proj", &compute.Image{
+		Name:     "golden",
+		Licenses: []string{"https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/rhel-9-byos"},
+	})
+	for name, image := range map[string]string{"good": "global/images/golden", "broken": "global/images/deleted"} {
+		fake.AddTemplate("proj", &compute.InstanceTemplate{
+			Name: name,
+			Properties: &compute.InstanceProperties{Disks: []*compute.AttachedDisk{{Boot: true,
+				InitializeParams: &compute.AttachedDiskInitializeParams{SourceImage: image}}}},
+		})
+	}
+
+	// A template whose image cannot be read is still listed, with the error in its status
+	resources, err := listTemplateResources(context.Background(), "proj", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]LicensedResource)
+	for _, resource := range resources {
+		statuses[resource.Name] = resource
+	}
+	if good := statuses["good"]; good.Status != "" || len(good.Licenses) != 1 {
+		t.Errorf("good template = %+v", good)
+	}
+	if broken := statuses["broken"]; !strings.HasPrefix(broken.Status, "error getting image: ") || !strings.Contains(broken.Status, "404") {
+		t.Errorf("broken template status = %q, want the image error", broken.Status)
+	}
+}
@@ -0,0 +1,296 @@
+// Package audit keeps an append-only, hash-chained JSON lines log of every change the tool makes.
+// Each record carries the hash of the record before it, so editing, removing or reordering
+// records breaks the chain and Verify reports where.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultPath is the audit log used when no other file is given
+const DefaultPath = "gcp-instance-explorer.audit.jsonl"
+
+// Outcomes of an audited action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Record is one audited action
+type Record struct {
+	Sequence       int64     `json:"seq"`
+	Time           time.Time `json:"time"`
+	Principal      string    `json:"principal"`
+	Project        string    `json:"project"`
+	Resource       string    `json:"resource"` // e.g. projects/p/zones/z/disks/d
+	Action         string    `json:"action"`   // e.g. disks.updateLicenses
+	BeforeLicenses []string  `json:"beforeLicenses,omitempty"`
+	AfterLicenses  []string  `json:"afterLicenses,omitempty"`
+	Operation      string    `json:"operation,omitempty"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+	PrevHash       string    `json:"prevHash"`
+	Hash           string    `json:"hash"`
+}
+
+// hash computes the record's hash over every field except Hash itself
+func (rec Record) hash() (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends records to an audit log file. The file is opened on the first record, so
+// commands that change nothing leave no file behind. Each record is appended under a lock on
+// the file, so several processes can share one log. A nil Log records nothing.
+type Log struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	principal func() string
+	who       string
+	err       error
+}
+
+// New returns a log that appends to path
+func New(path string) *Log {
+	return &Log{path: path}
+}
+
+// SetPrincipal sets the function naming the authenticated account. It is called once, when the
+// first record is written, so commands that change nothing never have to look the account up.
+func (l *Log) SetPrincipal(principal func() string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.principal = principal
+}
+
+// Path is the file the log appends to
+func (l *Log) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// Err returns the first error writing a record, or nil if every record was written
+func (l *Log) Err() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Record fills in the time, principal, sequence and hashes of rec, appends it and syncs it to disk
+func (l *Log) Record(rec Record) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.record(rec)
+	if err != nil && l.err == nil {
+		l.err = err
+	}
+	return err
+}
+
+// record appends rec after the last record in the file. The file stays locked from reading the
+// last record until rec is synced, so another process cannot link a record to the same one.
+func (l *Log) record(rec Record) error {
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := lockFile(l.file); err != nil {
+		return fmt.Errorf("failed to lock audit log %s: %v", l.path, err)
+	}
+	defer unlockFile(l.file)
+
+	last, err := lastRecord(l.file)
+	if err != nil {
+		return fmt.Errorf("failed to read audit log %s: %v", l.path, err)
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	if rec.Principal == "" {
+		rec.Principal = l.who
+	}
+	rec.Sequence = last.Sequence + 1
+	rec.PrevHash = last.Hash
+
+	hash, err := rec.hash()
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %v", err)
+	}
+	rec.Hash = hash
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %v", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log %s: %v", l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log %s: %v", l.path, err)
+	}
+	return nil
+}
+
+// open opens the file for appending and looks up the principal
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	l.file = file
+
+	l.who = "unknown"
+	if l.principal != nil {
+		if who := l.principal(); who != "" {
+			l.who = who
+		}
+	}
+	return nil
+}
+
+// Close closes the log file if it was opened
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// lastRecord reads the last record of a log file. It reads backwards from the end, so appending
+// stays cheap however long the log grows. An empty file returns the zero Record.
+func lastRecord(file *os.File) (Record, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return Record{}, err
+	}
+
+	const blockSize = 64 * 1024
+	var tail []byte
+	for offset := info.Size(); offset > 0; {
+		n := min(blockSize, offset)
+		offset -= n
+		block := make([]byte, n)
+		if _, err := file.ReadAt(block, offset); err != nil {
+			return Record{}, err
+		}
+		tail = append(block, tail...)
+
+		// Keep reading until the tail holds the whole last line
+		line := bytes.TrimRight(tail, "\n")
+		start := bytes.LastIndexByte(line, '\n')
+		if start < 0 && offset > 0 {
+			continue
+		}
+		line = line[start+1:]
+		if len(line) == 0 {
+			break
+		}
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return Record{}, fmt.Errorf("the last line is not a record: %v", err)
+		}
+		return rec, nil
+	}
+	return Record{}, nil
+}
+
+// readRecords reads every record of a log file
+func readRecords(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("audit log %s line %d is not a record: %v", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s: %v", path, err)
+	}
+	return records, nil
+}
+
+// Verify checks that every record's hash matches its contents and that each record links to the
+// one before it. It returns the number of records and the first break in the chain.
+func Verify(path string) (int, error) {
+	records, err := readRecords(path)
+	if err != nil {
+		return 0, err
+	}
+
+	prevHash := ""
+	for i, rec := range records {
+		hash, err := rec.hash()
+		if err != nil {
+			return i, err
+		}
+
+		switch {
+		case rec.Hash != hash:
+			return i, fmt.Errorf("record %d (seq %d) was modified: its hash does not match its contents", i+1, rec.Sequence)
+		case rec.PrevHash != prevHash:
+			return i, fmt.Errorf("record %d (seq %d) does not follow the record before it: records were removed or reordered",
+				i+1, rec.Sequence)
+		case rec.Sequence != int64(i+1):
+			return i, fmt.Errorf("record %d has sequence %d, want %d", i+1, rec.Sequence, i+1)
+		}
+		prevHash = rec.Hash
+	}
+
+	return len(records), nil
+}
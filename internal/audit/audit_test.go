@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRecords(t *testing.T, path string, actions ...string) {
+	t.Helper()
+
+	log := New(path)
+	log.SetPrincipal(func() string { return "auditor@example.com" })
+	defer log.Close()
+
+	for _, action := range actions {
+		if err := log.Record(Record{Project: "proj", Resource: "projects/proj/zones/z/disks/d", Action: action, Outcome: OutcomeSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChainContinuesAcrossRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	writeRecords(t, path, "disks.updateLicenses", "instances.stop")
+	writeRecords(t, path, "instances.start")
+
+	count, err := Verify(path)
+	if err != nil || count != 3 {
+		t.Fatalf("Verify = %d, %v; want 3 records", count, err)
+	}
+
+	records, err := readRecords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[2].Sequence != 3 || records[2].PrevHash != records[1].Hash || records[0].Principal != "auditor@example.com" {
+		t.Errorf("records = %+v", records)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := map[string]func(lines []string) []string{
+		"modified": func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "instances.stop", "instances.start", 1)
+			return lines
+		},
+		"removed": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		},
+	}
+
+	for name, tamper := range tests {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		writeRecords(t, path, "disks.updateLicenses", "instances.stop", "instances.start")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := tamper(strings.Split(strings.TrimSpace(string(data)), "\n"))
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Verify(path); err == nil {
+			t.Errorf("%s record was not detected", name)
+		}
+	}
+}
+
+func TestLogsSharingAFileKeepOneChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	first, second := New(path), New(path)
+	defer first.Close()
+	defer second.Close()
+
+	// Each record follows the last one in the file, whichever log wrote it
+	for i, log := range []*Log{first, second, first, second} {
+		if err := log.Record(Record{Project: "proj", Action: "instances.stop", Outcome: OutcomeSuccess}); err != nil {
+			t.Fatalf("record %d: %v", i+1, err)
+		}
+	}
+
+	count, err := Verify(path)
+	if err != nil || count != 4 {
+		t.Fatalf("Verify = %d, %v; want 4 records in one chain", count, err)
+	}
+}
+
+func TestErrKeepsTheFirstFailedWrite(t *testing.T) {
+	log := New(filepath.Join(t.TempDir(), "missing", "audit.jsonl"))
+	if err := log.Err(); err != nil {
+		t.Fatalf("Err before any record = %v", err)
+	}
+
+	if err := log.Record(Record{Project: "proj", Action: "instances.stop", Outcome: OutcomeSuccess}); err == nil {
+		t.Fatal("a record in a missing directory was written")
+	}
+	if log.Err() == nil {
+		t.Error("Err did not report the failed write")
+	}
+}
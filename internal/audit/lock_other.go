@@ -0,0 +1,16 @@
+//go:build !unix
+
+package audit
+
+import "os"
+
+// lockFile does nothing where flock is not available; records from concurrent runs may then
+// break the chain, which Verify reports
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// unlockFile releases the lock taken by lockFile
+func unlockFile(file *os.File) error {
+	return nil
+}
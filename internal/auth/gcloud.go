@@ -2,61 +2,211 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	"google.golang.org/api/option"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
 	"google.golang.org/api/compute/v1"
-	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
+// Session holds the API clients built from one set of credentials
+type Session struct {
+	Credentials   *google.Credentials // Credentials found on this machine, before any impersonation
+	TokenSource   oauth2.TokenSource  // Source of the tokens every client sends
+	HTTPClient    *http.Client        // Authorized client for raw API requests, such as the alpha disk PATCH
+	CRM           *cloudresourcemanager.Service
+	Folders       *crmv2.Service
+	Compute       *compute.Service
+	Principal     string // Account the credentials act as; see ResolvePrincipal
+	Impersonating string // Service account every request acts as, if impersonating
+	QuotaProject  string // Project billed for API quota, if not the credentials' default
+}
+
+// Options choose the credentials a session is built from
+type Options struct {
+	CredentialsFile           string // Key or credentials file to use instead of application default credentials
+	ImpersonateServiceAccount string // Service account to impersonate; a comma-separated list is a delegation chain ending in the target
+	QuotaProject              string // Project to bill for API quota
+}
+
+// options are the credential options NewSession uses
+var options = struct {
+	sync.Mutex
+	opts Options
+}{}
+
+// SetOptions sets the credential options used by every later NewSession call
+func SetOptions(opts Options) {
+	options.Lock()
+	defer options.Unlock()
+	options.opts = opts
+}
+
 // Authenticate tries multiple authentication methods and returns service clients
 func Authenticate() (*cloudresourcemanager.Service, *compute.Service, error) {
+	session, err := NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return session.CRM, session.Compute, nil
+}
+
+// NewSession finds credentials and creates every API client the tool uses. Every client,
+// including the raw HTTP client, shares one token source.
+func NewSession() (*Session, error) {
 	ctx := context.Background()
-	
+	options.Lock()
+	opts := options.opts
+	options.Unlock()
+
+	creds, err := findCredentials(ctx, opts.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintln(os.Stderr, "Successfully obtained credentials")
+
+	session := &Session{
+		Credentials:  creds,
+		TokenSource:  creds.TokenSource,
+		QuotaProject: opts.QuotaProject,
+	}
+
+	// Clients built from a token source no longer see the quota project saved with the credentials
+	if session.QuotaProject == "" {
+		session.QuotaProject = savedQuotaProject(creds)
+	}
+
+	// Impersonation exchanges the found credentials for short-lived tokens of the service account
+	if opts.ImpersonateServiceAccount != "" {
+		chain := strings.Split(opts.ImpersonateServiceAccount, ",")
+		for i := range chain {
+			chain[i] = strings.TrimSpace(chain[i])
+		}
+		target := chain[len(chain)-1]
+
+		tokenSource, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: target,
+			Delegates:       chain[:len(chain)-1],
+			Scopes:          []string{compute.CloudPlatformScope},
+		}, option.WithCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate %s: %v\n\n"+
+				"Make sure your account has the Service Account Token Creator role on it", target, err)
+		}
+
+		// Fail here, not halfway through a change, if the account may not be impersonated
+		if _, err := tokenSource.Token(); err != nil {
+			return nil, fmt.Errorf("failed to impersonate %s: %v\n\n"+
+				"Make sure your account has the Service Account Token Creator role on it", target, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Impersonating service account %s\n", target)
+		session.TokenSource = tokenSource
+		session.Impersonating = target
+		session.Principal = target
+	}
+
+	clientOptions := []option.ClientOption{option.WithTokenSource(session.TokenSource)}
+	if session.QuotaProject != "" {
+		clientOptions = append(clientOptions, option.WithQuotaProject(session.QuotaProject))
+	}
+
+	// Create the Cloud Resource Manager service
+	session.CRM, err = cloudresourcemanager.NewService(ctx, clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Resource Manager service: %v\n\n"+
+			"Make sure the Cloud Resource Manager API is enabled in your GCP project", err)
+	}
+
+	// Create the Compute service
+	session.Compute, err = compute.NewService(ctx, clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Compute service: %v\n\n"+
+			"Make sure the Compute Engine API is enabled in your GCP project", err)
+	}
+
+	// Create the Cloud Resource Manager v2 service, used to walk folders
+	session.Folders, err = crmv2.NewService(ctx, clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Resource Manager folders service: %v", err)
+	}
+
+	// Create the raw HTTP client, used for the alpha disk API the Compute service does not cover
+	session.HTTPClient, _, err = htransport.NewClient(ctx, clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP client: %v", err)
+	}
+
+	return session, nil
+}
+
+// findCredentials loads a credentials file, or falls back to application default credentials
+func findCredentials(ctx context.Context, credentialsFile string) (*google.Credentials, error) {
+	if credentialsFile != "" {
+		data, err := os.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials file: %v", err)
+		}
+
+		creds, err := google.CredentialsFromJSON(ctx, data, compute.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credentials from %s: %v", credentialsFile, err)
+		}
+		fmt.Fprintf(os.Stderr, "Using credentials from %s\n", credentialsFile)
+		return creds, nil
+	}
+
 	// Check for GOOGLE_APPLICATION_CREDENTIALS environment variable
+	// Status messages go to stderr so command output on stdout stays pipeable
 	credPath := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	if (credPath != "") {
-		fmt.Println("Using credentials from GOOGLE_APPLICATION_CREDENTIALS")
+	if credPath != "" {
+		fmt.Fprintln(os.Stderr, "Using credentials from GOOGLE_APPLICATION_CREDENTIALS")
 	} else {
-		fmt.Println("GOOGLE_APPLICATION_CREDENTIALS not set, trying application default credentials...")
+		fmt.Fprintln(os.Stderr, "GOOGLE_APPLICATION_CREDENTIALS not set, trying application default credentials...")
 	}
-	
+
 	// Try to find default credentials
-	creds, err := google.FindDefaultCredentials(ctx, 
+	creds, err := google.FindDefaultCredentials(ctx,
 		cloudresourcemanager.CloudPlatformScope,
 		compute.CloudPlatformScope)
-	
+
 	if err != nil {
 		// If we couldn't find credentials, suggest solutions
 		homeDir, _ := os.UserHomeDir()
 		adcPath := filepath.Join(homeDir, ".config", "gcloud", "application_default_credentials.json")
-		
-		return nil, nil, fmt.Errorf("failed to obtain credentials: %v\n\nPossible solutions:\n"+
+
+		return nil, fmt.Errorf("failed to obtain credentials: %v\n\nPossible solutions:\n"+
 			"1. Run 'gcloud auth application-default login'\n"+
 			"2. Set GOOGLE_APPLICATION_CREDENTIALS to point to a service account key file\n"+
 			"3. Check if %s exists\n", err, adcPath)
 	}
-	
-	fmt.Println("Successfully obtained credentials")
-	
-	// Create the Cloud Resource Manager service
-	crmService, err := cloudresourcemanager.NewService(ctx, option.WithCredentials(creds))
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create Cloud Resource Manager service: %v\n\n"+
-			"Make sure the Cloud Resource Manager API is enabled in your GCP project", err)
+
+	return creds, nil
+}
+
+// savedQuotaProject returns the quota project recorded in a credentials file, such as the one
+// set with 'gcloud auth application-default set-quota-project'
+func savedQuotaProject(creds *google.Credentials) string {
+	var file struct {
+		QuotaProjectID string `json:"quota_project_id"`
 	}
-	
-	// Create the Compute service
-	computeService, err := compute.NewService(ctx, option.WithCredentials(creds))
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create Compute service: %v\n\n"+
-			"Make sure the Compute Engine API is enabled in your GCP project", err)
+	if len(creds.JSON) == 0 || json.Unmarshal(creds.JSON, &file) != nil {
+		return ""
 	}
-	
-	return crmService, computeService, nil
+	return file.QuotaProjectID
 }
 
 // HandleError checks for errors and prints them with helpful context
@@ -75,12 +225,12 @@ func TestAuth() {
 	if err != nil {
 		HandleError(err)
 	}
-	
+
 	resp, err := crmService.Projects.List().Do()
 	if err != nil {
 		HandleError(fmt.Errorf("failed to list projects: %v\n\n"+
 			"Check that your account has permission to list projects", err))
 	}
-	
+
 	fmt.Printf("Successfully authenticated! Found %d projects\n", len(resp.Projects))
-}
\ No newline at end of file
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewSessionFromCredentialsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	data := `{"type": "authorized_user", "client_id": "id", "client_secret": "secret",
+		"refresh_token": "token", "quota_project_id": "billing-project"}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	SetOptions(Options{CredentialsFile: path})
+	t.Cleanup(func() { SetOptions(Options{}) })
+
+	session, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.QuotaProject != "billing-project" {
+		t.Errorf("QuotaProject = %q, want the one saved with the credentials", session.QuotaProject)
+	}
+	if session.HTTPClient == nil || session.Compute == nil || session.CRM == nil {
+		t.Errorf("session is missing clients: %+v", session)
+	}
+	if got := session.CredentialSource(); got != "user credentials (gcloud auth application-default login)" {
+		t.Errorf("CredentialSource = %q", got)
+	}
+
+	// An explicit quota project wins over the saved one
+	SetOptions(Options{CredentialsFile: path, QuotaProject: "other-project"})
+	session, err = NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.QuotaProject != "other-project" {
+		t.Errorf("QuotaProject = %q, want other-project", session.QuotaProject)
+	}
+}
+
+func TestNewSessionMissingCredentialsFile(t *testing.T) {
+	SetOptions(Options{CredentialsFile: filepath.Join(t.TempDir(), "missing.json")})
+	t.Cleanup(func() { SetOptions(Options{}) })
+
+	if _, err := NewSession(); err == nil {
+		t.Error("NewSession succeeded without a credentials file")
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
+)
+
+// tokenInfoURL returns the account an access token belongs to
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// tokenInfoClient calls the token info endpoint. The principal is looked up while the first
+// audit record is written, so a slow endpoint must not hold up the change for long.
+var tokenInfoClient = &http.Client{Timeout: 10 * time.Second}
+
+// ResolvePrincipal returns the account the session's credentials act as, such as a user's email
+// or a service account. The result is cached in Principal; "" means it could not be determined.
+func (s *Session) ResolvePrincipal(ctx context.Context) string {
+	if s.Principal == "" {
+		s.Principal, _ = principalOf(ctx, s.Credentials)
+	}
+	return s.Principal
+}
+
+// CredentialSource describes the kind of credentials the session uses
+func (s *Session) CredentialSource() string {
+	if s.Impersonating != "" {
+		return "impersonated service account " + s.Impersonating + " via " + credentialSource(s.Credentials)
+	}
+	return credentialSource(s.Credentials)
+}
+
+// credentialSource describes the kind of credentials found on this machine
+func credentialSource(creds *google.Credentials) string {
+	if creds == nil {
+		return "none"
+	}
+	if len(creds.JSON) == 0 {
+		return "Compute Engine metadata server"
+	}
+
+	var file struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(creds.JSON, &file); err != nil || file.Type == "" {
+		return "credentials file"
+	}
+
+	switch file.Type {
+	case "service_account":
+		return "service account key file"
+	case "authorized_user":
+		return "user credentials (gcloud auth application-default login)"
+	case "impersonated_service_account":
+		return "impersonated service account"
+	case "external_account":
+		return "workload identity federation"
+	default:
+		return file.Type
+	}
+}
+
+// principalOf finds the account of a set of credentials: from the key file for service accounts,
+// from the metadata server on Google Cloud, and from the token info endpoint for user accounts
+func principalOf(ctx context.Context, creds *google.Credentials) (string, error) {
+	if creds == nil {
+		return "", fmt.Errorf("no credentials")
+	}
+
+	var file struct {
+		ClientEmail      string `json:"client_email"`
+		ImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if len(creds.JSON) > 0 && json.Unmarshal(creds.JSON, &file) == nil {
+		if file.ClientEmail != "" {
+			return file.ClientEmail, nil
+		}
+		// .../serviceAccounts/NAME@PROJECT.iam.gserviceaccount.com:generateAccessToken
+		if file.ImpersonationURL != "" {
+			return strings.TrimSuffix(path.Base(file.ImpersonationURL), ":generateAccessToken"), nil
+		}
+	}
+
+	if len(creds.JSON) == 0 && metadata.OnGCE() {
+		return metadata.EmailWithContext(ctx, "default")
+	}
+
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", err
+	}
+
+	// The token goes in the body so it never appears in a URL that proxies or logs may record
+	form := url.Values{"access_token": {token.AccessToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenInfoURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tokenInfoClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token info request failed: %s", resp.Status)
+	}
+
+	var info struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if info.Email == "" {
+		return "", fmt.Errorf("token info has no email")
+	}
+	return info.Email, nil
+}
@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"gcp-instance-explorer/internal/audit"
+)
+
+// runAudit dispatches the audit subcommands
+func runAudit(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: gcp-instance-explorer audit verify [-log file]")
+		fmt.Fprintln(os.Stderr, "\n  verify  Check that no audit record was modified, removed or reordered")
+		return errUsage
+	}
+
+	fs := newFlagSet("audit verify")
+	path := fs.String("log", audit.DefaultPath, "Audit log to verify")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	count, err := audit.Verify(*path)
+	if err != nil {
+		return fmt.Errorf("audit log %s failed verification after %d good records: %v", *path, count, err)
+	}
+
+	fmt.Printf("Audit log %s: %d records, hash chain intact\n", *path, count)
+	return nil
+}
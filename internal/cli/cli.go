@@ -0,0 +1,306 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/output"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// command describes a non-interactive subcommand
+type command struct {
+	Name    string
+	Summary string
+	Run     func(ctx context.Context, args []string) error
+}
+
+// commands returns every subcommand in the order shown by usage
+func commands() []command {
+	return []command{
+		{Name: "list", Summary: "List instances and their licenses", Run: runList},
+		{Name: "inventory", Summary: "List instances, disks, images, snapshots or templates across several projects", Run: runInventory},
+		{Name: "compliance", Summary: "Compare BYOS entitlements with the BYOS instances and vCPUs deployed", Run: runCompliance},
+		{Name: "start", Summary: "Turn ON one or more instances", Run: runStart},
+		{Name: "stop", Summary: "Turn OFF one or more instances", Run: runStop},
+		{Name: "export", Summary: "Export the instance list to <project>-instances.yml", Run: runExport},
+		{Name: "diff", Summary: "Compare an export with a later export or the live instances, failing on license drift", Run: runDiff},
+		{Name: "convert", Summary: "Convert instances between BYOS and PAYG licensing", Run: runConvert},
+		{Name: "plan", Summary: "Show and save what a conversion would change, without changing it", Run: runPlan},
+		{Name: "apply", Summary: "Apply a conversion plan saved by the plan command", Run: runApply},
+		{Name: "template", Summary: "Create a PAYG or BYOS image and instance template to replace a template", Run: runTemplate},
+		{Name: "rollback", Summary: "Restore the original licenses recorded in a conversion journal", Run: runRollback},
+		{Name: "verify", Summary: "Show the licenses currently applied to instance disks", Run: runVerify},
+		{Name: "licenses", Summary: "List, add, remove or replace individual licenses on instance disks", Run: runLicenses},
+		{Name: "audit", Summary: "Verify the hash chain of the audit log", Run: runAudit},
+		{Name: "whoami", Summary: "Show the account and kind of credentials in use", Run: runWhoami},
+		{Name: "preflight", Summary: "Show which features the account's permissions allow on a project", Run: runPreflight},
+	}
+}
+
+// errUsage signals that the command line was invalid and usage was already printed
+var errUsage = fmt.Errorf("invalid usage")
+
+// Run executes the subcommand named in args[0] and returns the process exit code
+func Run(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	for _, cmd := range commands() {
+		if cmd.Name != name {
+			continue
+		}
+
+		// Progress goes to stderr so stdout carries only the command's output
+		api.SetProgressOutput(os.Stderr)
+		err := cmd.Run(ctx, args[1:])
+
+		// A change missing from the audit log fails the command even if the change succeeded
+		if auditErr := api.AuditLog().Err(); auditErr != nil {
+			err = errors.Join(err, fmt.Errorf("not every change was recorded in the audit log: %v", auditErr))
+		}
+
+		switch {
+		case err == nil:
+			return 0
+		case err == errUsage || err == flag.ErrHelp:
+			return 2
+		default:
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	printUsage(os.Stderr)
+	return 2
+}
+
+// Usage prints the top-level usage, including the global flags, to stderr
+func Usage() {
+	printUsage(os.Stderr)
+}
+
+// printUsage lists the global flags and available subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: gcp-instance-explorer [global flags] [command] [flags]")
+	fmt.Fprintln(w, "\nRun without a command to start the interactive menu.")
+	fmt.Fprintln(w, "\nGlobal flags:")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintln(w, "\nRun 'gcp-instance-explorer <command> -h' for command flags.")
+}
+
+// targetFlags holds the flags shared by every command that works on instances
+type targetFlags struct {
+	Project   string
+	Zone      string
+	Instances string
+	Filter    string
+
+	filter *api.InstanceFilter
+}
+
+// register adds the target flags to a flag set
+func (t *targetFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.Project, "project", "", "GCP project ID (required)")
+	fs.StringVar(&t.Zone, "zone", "", "Only use instances in this zone")
+	fs.StringVar(&t.Instances, "instance", "", "Comma-separated instance names")
+	fs.StringVar(&t.Filter, "filter", "", "Filter expression, e.g. 'license~rhel-8 AND status=RUNNING AND label.env=prod'")
+}
+
+// names returns the instance names given on the command line
+func (t *targetFlags) names() []string {
+	return splitList(t.Instances)
+}
+
+// newFlagSet creates a flag set that reports errors instead of exiting
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// parseFlags parses args and checks that a project was given
+func parseFlags(fs *flag.FlagSet, target *targetFlags, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return errUsage
+	}
+
+	if target.Project == "" {
+		fmt.Fprintln(os.Stderr, "The -project flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	filter, err := api.ParseFilter(target.Filter)
+	if err != nil {
+		return err
+	}
+	target.filter = filter
+
+	return nil
+}
+
+// connect authenticates and returns the Compute service
+func connect() (*compute.Service, error) {
+	session, err := connectSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.Compute, nil
+}
+
+// registerOutput adds the -output flag shared by commands that print records
+func registerOutput(fs *flag.FlagSet) *string {
+	return fs.String("output", string(output.Table), "Output format: "+output.FormatList())
+}
+
+// registerDisks adds the flags that choose which disks a license change applies to
+func registerDisks(fs *flag.FlagSet, disks *api.DiskSelector) {
+	fs.StringVar(&disks.Name, "disk", "", "Use the disk with this name instead of the boot disk")
+	fs.BoolVar(&disks.All, "all-disks", false, "Use every disk of the instance, not just the boot disk")
+}
+
+// registerExportFile adds the flags that choose the export file a conversion reads when no
+// -instance or -filter is given
+func registerExportFile(fs *flag.FlagSet) *api.FileCheckOptions {
+	file := api.DefaultFileCheckOptions()
+	fs.StringVar(&file.File, "from-file", "", "Export file of the instances to convert (default <project>-instances.yml)")
+	fs.DurationVar(&file.MaxAge, "max-export-age", file.MaxAge, "Refuse export files older than this (0 for no limit)")
+	fs.BoolVar(&file.SkipChanged, "skip-changed", false,
+		"Leave out instances recreated or relicensed since the export instead of refusing the file")
+	return &file
+}
+
+// checkDisks rejects contradictory disk flags
+func checkDisks(disks api.DiskSelector) error {
+	if disks.All && disks.Name != "" {
+		return fmt.Errorf("give -disk or -all-disks, not both")
+	}
+	return nil
+}
+
+// writeFile renders records into a file
+func writeFile(filename string, format output.Format, records output.Records) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", filename, err)
+	}
+
+	if err := output.Write(file, format, records); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	return file.Close()
+}
+
+// newSession creates the API clients; tests replace it to talk to a fake server
+var newSession = auth.NewSession
+
+// connectSession authenticates and returns every API client
+func connectSession() (*auth.Session, error) {
+	session, err := newSession()
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed: %v", err)
+	}
+
+	// Raw disk API requests use the session's token source, so they act as the same account
+	if session.HTTPClient != nil {
+		api.SetAlphaClient(session.HTTPClient)
+	}
+
+	// Changes are audited under the account the credentials act as
+	api.AuditLog().SetPrincipal(func() string {
+		return session.ResolvePrincipal(context.Background())
+	})
+	return session, nil
+}
+
+// loadTargets lists the project's instances and narrows them to the requested filter, zone and names
+func loadTargets(ctx context.Context, target *targetFlags, computeService *compute.Service) ([]api.Instance, error) {
+	instances, err := api.ListInstancesFiltered(ctx, target.Project, computeService, target.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectInstances(instances, target.Zone, target.names())
+}
+
+// selectInstances filters instances by zone and name; every requested name must exist
+func selectInstances(instances []api.Instance, zone string, names []string) ([]api.Instance, error) {
+	var inZone []api.Instance
+	for _, instance := range instances {
+		if zone == "" || instance.Zone == zone {
+			inZone = append(inZone, instance)
+		}
+	}
+
+	if len(names) == 0 {
+		return inZone, nil
+	}
+
+	var selected []api.Instance
+	for _, name := range names {
+		var matches []api.Instance
+		for _, instance := range inZone {
+			if instance.Name == name {
+				matches = append(matches, instance)
+			}
+		}
+
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("instance %s not found", name)
+		case 1:
+			selected = append(selected, matches[0])
+		default:
+			return nil, fmt.Errorf("instance name %s exists in %d zones, use -zone to pick one", name, len(matches))
+		}
+	}
+
+	return selected, nil
+}
+
+// confirm asks a yes/no question on stdin unless assumeYes is set
+func confirm(question string, assumeYes bool) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%s (y/n): ", question)
+	reader := bufio.NewReader(os.Stdin)
+	input, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read input: %v", err)
+	}
+
+	return strings.ToLower(strings.TrimSpace(input)) == "y", nil
+}
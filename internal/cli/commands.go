@@ -0,0 +1,574 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/output"
+	"gcp-instance-explorer/internal/pricing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// runList prints the instances of a project
+func runList(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("list")
+	target.register(fs)
+	format := registerOutput(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	computeService, err := connect()
+	if err != nil {
+		return err
+	}
+
+	instances, err := loadTargets(ctx, &target, computeService)
+	if err != nil {
+		return err
+	}
+
+	return output.Write(os.Stdout, outputFormat, api.InstanceRecords(api.ToInstanceExports(instances)))
+}
+
+// runStart turns on the named instances
+func runStart(ctx context.Context, args []string) error {
+	return runPower(ctx, "start", args)
+}
+
+// runStop turns off the named instances
+func runStop(ctx context.Context, args []string) error {
+	return runPower(ctx, "stop", args)
+}
+
+// runPower starts or stops every instance named with -instance
+func runPower(ctx context.Context, action string, args []string) error {
+	var target targetFlags
+	fs := newFlagSet(action)
+	target.register(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	if len(target.names()) == 0 {
+		fmt.Fprintln(os.Stderr, "The -instance flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	computeService, err := connect()
+	if err != nil {
+		return err
+	}
+
+	instances, err := loadTargets(ctx, &target, computeService)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, instance := range instances {
+		if action == "start" {
+			fmt.Fprintf(os.Stderr, "Starting instance: %s\n", instance.Name)
+			err = api.StartInstance(ctx, instance, computeService)
+		} else {
+			fmt.Fprintf(os.Stderr, "Stopping instance: %s\n", instance.Name)
+			err = api.StopInstance(ctx, instance, computeService)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", instance.Name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Instance %s: %s completed successfully\n", instance.Name, action)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d instances failed to %s", failed, len(instances), action)
+	}
+
+	return nil
+}
+
+// runExport writes the instance list, after a header describing the export, to
+// <project>-instances.yml, to -out, or in another format with -output
+func runExport(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("export")
+	target.register(fs)
+	format := fs.String("output", string(output.YAML), "File format: yaml, json, csv or ndjson")
+	out := fs.String("out", "", "File to write (default <project>-instances.yml, or the -output extension)")
+	timestamp := fs.Bool("timestamp", false, "Add the export time to the file name, e.g. <project>-instances-20250101-120000.yml")
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	if outputFormat == output.Table {
+		return fmt.Errorf("export writes a file; use list -output table to print a table")
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	instances, err := loadTargets(ctx, &target, session.Compute)
+	if err != nil {
+		return err
+	}
+
+	if len(instances) == 0 {
+		return fmt.Errorf("no instances to export")
+	}
+
+	header := api.NewExportHeader(target.Project, session.ResolvePrincipal(ctx), target.Filter)
+	filename := *out
+	if filename == "" {
+		filename = api.DefaultExportFile(target.Project)
+		if outputFormat != output.YAML {
+			filename = fmt.Sprintf("%s-instances.%s", target.Project, outputFormat)
+		}
+	}
+	if *timestamp {
+		filename = api.TimestampedFile(filename, header.ExportedAt)
+	}
+
+	// YAML is the format convert reads back, so it keeps its original writer. CSV and NDJSON
+	// have no place for the header.
+	if outputFormat == output.YAML {
+		err = api.ExportInstancesToYAML(instances, header, filename)
+	} else {
+		err = writeFile(filename, outputFormat, &api.InstanceExportDocument{Header: header, Instances: api.ToInstanceExports(instances)})
+	}
+	if err != nil {
+		return fmt.Errorf("error exporting instances: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d instances to %s\n", len(instances), filename)
+	return nil
+}
+
+// runConvert converts instances between BYOS and PAYG, taking them from -instance, -filter or the exported file
+func runConvert(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("convert")
+	target.register(fs)
+	to := fs.String("to", "payg", "License to convert to: payg or byos")
+	var disks api.DiskSelector
+	registerDisks(fs, &disks)
+	file := registerExportFile(fs)
+	resume := fs.String("resume", "", "Resume an interrupted run from its journal file")
+	var apply applyFlags
+	apply.register(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	direction, err := api.ParseDirection(*to)
+	if err != nil {
+		return err
+	}
+
+	if err := checkDisks(disks); err != nil {
+		return err
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	if *resume != "" {
+		return resumeConvert(ctx, *resume, &target, session, &apply)
+	}
+
+	plan, err := planTargets(ctx, &target, direction, disks, *file, session.Compute)
+	if err != nil {
+		return err
+	}
+
+	return applyPlan(ctx, plan, session, &apply, nil)
+}
+
+// resumeConvert finishes a run that was interrupted, using its journal
+func resumeConvert(ctx context.Context, journalPath string, target *targetFlags, session *auth.Session, apply *applyFlags) error {
+	fmt.Fprintf(os.Stderr, "Resuming conversion from journal %s...\n", journalPath)
+	plan, journal, unsettled, err := api.ResumePlan(ctx, journalPath, session.Compute)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	if plan.Project != target.Project {
+		return fmt.Errorf("journal %s belongs to project %s, not %s", journalPath, plan.Project, target.Project)
+	}
+
+	// Disks whose state is unknown fail the resume even when everything else finishes
+	var unsettledErr error
+	if len(unsettled) > 0 {
+		unsettledErr = fmt.Errorf("%d disks in flight could not be re-verified, check them by hand:\n  - %s",
+			len(unsettled), strings.Join(unsettled, "\n  - "))
+	}
+
+	if len(plan.Items) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing left to convert.")
+		return unsettledErr
+	}
+
+	return errors.Join(applyPlan(ctx, plan, session, apply, journal), unsettledErr)
+}
+
+// runPlan resolves what a conversion would change and optionally saves it for a later apply
+func runPlan(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("plan")
+	target.register(fs)
+	to := fs.String("to", "payg", "License to convert to: payg or byos")
+	var disks api.DiskSelector
+	registerDisks(fs, &disks)
+	file := registerExportFile(fs)
+	out := fs.String("out", "", "Save the plan to this YAML file")
+	format := registerOutput(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	direction, err := api.ParseDirection(*to)
+	if err != nil {
+		return err
+	}
+
+	if err := checkDisks(disks); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	computeService, err := connect()
+	if err != nil {
+		return err
+	}
+
+	plan, err := planTargets(ctx, &target, direction, disks, *file, computeService)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nConversion plan for %d instances (%d will be converted):\n\n",
+		len(plan.Items), len(plan.Convertible()))
+
+	// The table form also lists the exact requests; other formats are for machines
+	if outputFormat == output.Table {
+		api.DisplayPlan(plan, os.Stdout)
+		displayEstimate(plan, os.Stdout)
+	} else {
+		if err := output.Write(os.Stdout, outputFormat, plan); err != nil {
+			return err
+		}
+		// The estimate is for people, so it stays out of the machine-readable output
+		displayEstimate(plan, os.Stderr)
+	}
+
+	if *out != "" {
+		if err := api.SavePlan(plan, *out); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\nPlan saved to %s\n", *out)
+	}
+
+	return nil
+}
+
+// runApply executes a plan previously saved by the plan command
+func runApply(ctx context.Context, args []string) error {
+	fs := newFlagSet("apply")
+	planFile := fs.String("plan", "", "Plan file written by the plan command (required)")
+	var apply applyFlags
+	apply.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *planFile == "" {
+		fmt.Fprintln(os.Stderr, "The -plan flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	plan, err := api.LoadPlan(*planFile)
+	if err != nil {
+		return err
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	return applyPlan(ctx, plan, session, &apply, nil)
+}
+
+// runRollback restores the original licenses recorded in a conversion journal
+func runRollback(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("rollback")
+	target.register(fs)
+	journalFile := fs.String("from", "", "Journal of the conversion run to roll back (required)")
+	out := fs.String("out", "", "Save the rollback plan to this YAML file")
+	var apply applyFlags
+	apply.register(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	if *journalFile == "" {
+		fmt.Fprintln(os.Stderr, "The -from flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Building rollback plan from journal %s...\n", *journalFile)
+	plan, err := api.PlanRollback(ctx, *journalFile, target.names(), session.Compute)
+	if err != nil {
+		return err
+	}
+
+	if plan.Project != target.Project {
+		return fmt.Errorf("journal %s belongs to project %s, not %s", *journalFile, plan.Project, target.Project)
+	}
+
+	if *out != "" {
+		if err := api.SavePlan(plan, *out); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Rollback plan saved to %s\n", *out)
+	}
+
+	return applyPlan(ctx, plan, session, &apply, nil)
+}
+
+// planTargets picks the instances to convert and resolves the conversion plan for them
+func planTargets(ctx context.Context, target *targetFlags, direction api.ConversionDirection, disks api.DiskSelector,
+	file api.FileCheckOptions, computeService *compute.Service) (*api.ConversionPlan, error) {
+	instances, err := loadTargets(ctx, target, computeService)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without explicit names or a filter the exported file decides what gets converted
+	if len(target.names()) == 0 && target.filter == nil {
+		instances, err = api.CheckInstancesFromFile(target.Project, instances, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances to convert")
+	}
+
+	fmt.Fprintf(os.Stderr, "Resolving conversion plan for %d instances (%s)...\n", len(instances), disks)
+	return api.PlanConversionOnDisks(ctx, instances, direction, disks, computeService)
+}
+
+// applyFlags holds the flags shared by the commands that apply a conversion plan
+type applyFlags struct {
+	AssumeYes     bool
+	NoVerify      bool
+	SkipPreflight bool
+	JournalPath   string
+	Output        string
+	Options       api.ConvertOptions
+}
+
+// register adds the apply flags to a flag set
+func (a *applyFlags) register(fs *flag.FlagSet) {
+	defaults := api.DefaultConvertOptions()
+	fs.BoolVar(&a.AssumeYes, "yes", false, "Convert without asking for confirmation")
+	fs.BoolVar(&a.NoVerify, "no-verify", false, "Skip verifying the license change afterwards")
+	fs.BoolVar(&a.SkipPreflight, "skip-preflight", false, "Change disks without checking permissions first")
+	fs.StringVar(&a.JournalPath, "journal", "", "Journal file for this run (default <project>-<to>-<time>.journal.jsonl)")
+	fs.IntVar(&a.Options.Parallel, "parallel", defaults.Parallel, "Number of disks to convert at the same time")
+	fs.Float64Var(&a.Options.RatePerProject, "rate", defaults.RatePerProject, "Maximum disk updates per second per project (0 for no limit)")
+	fs.StringVar(&a.Output, "output", string(output.Table), "Results format: "+output.FormatList())
+}
+
+// applyPlan shows the plan, checks permissions, asks for confirmation, applies it and reports the
+// results. A new journal is opened unless one is passed in from a resumed run.
+func applyPlan(ctx context.Context, plan *api.ConversionPlan, session *auth.Session, apply *applyFlags, journal *api.Journal) error {
+	computeService := session.Compute
+	outputFormat, err := output.ParseFormat(apply.Output)
+	if err != nil {
+		return err
+	}
+
+	// Everything before the results goes to stderr so stdout holds only the results
+	fmt.Fprintf(os.Stderr, "\nConversion plan for %d instances (%d will be converted):\n\n",
+		len(plan.Items), len(plan.Convertible()))
+	api.DisplayPlan(plan, os.Stderr)
+	displayEstimate(plan, os.Stderr)
+
+	if len(plan.Convertible()) == 0 {
+		return fmt.Errorf("no instances in the plan can be converted")
+	}
+
+	if err := preflightConversion(ctx, plan.Project, session, apply.SkipPreflight); err != nil {
+		return err
+	}
+
+	ok, err := confirm("\nDo you want to apply this plan?", apply.AssumeYes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Conversion cancelled.")
+		return nil
+	}
+
+	if journal == nil {
+		path := apply.JournalPath
+		if path == "" {
+			path = api.DefaultJournalPath(plan.Project, plan.Direction)
+		}
+
+		journal, err = api.OpenJournal(path)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+	}
+	fmt.Fprintf(os.Stderr, "\nRecording progress in journal %s\n", journal.Path)
+
+	fmt.Fprintf(os.Stderr, "\nConverting instances to %s licensing...\n", plan.Direction.Label())
+	options := apply.Options
+	options.Journal = journal
+	conversions, err := api.ApplyPlan(ctx, plan, computeService, options)
+	if err != nil {
+		return fmt.Errorf("error during conversion: %v", err)
+	}
+
+	if !apply.NoVerify {
+		fmt.Fprintln(os.Stderr, "\nVerifying license changes...")
+		conversions = api.VerifyConversion(ctx, conversions, computeService)
+	}
+
+	fmt.Fprintln(os.Stderr, "\nConversion Results:")
+	results := api.ToConversionResults(conversions)
+	if err := output.Write(os.Stdout, outputFormat, results); err != nil {
+		return err
+	}
+
+	successful := results.Succeeded()
+	if successful < len(conversions) {
+		return fmt.Errorf("converted %d/%d instances successfully", successful, len(conversions))
+	}
+
+	fmt.Fprintf(os.Stderr, "\nConverted %d/%d instances successfully.\n", successful, len(conversions))
+	return nil
+}
+
+// displayEstimate prints the monthly license cost of a plan when a price table was loaded
+func displayEstimate(plan *api.ConversionPlan, w io.Writer) {
+	table := pricing.Active()
+	if table == nil || len(plan.Convertible()) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nEstimated monthly license cost:")
+	fmt.Fprintln(w)
+	pricing.DisplayEstimate(table.EstimatePlan(plan), w)
+}
+
+// runVerify reports the licenses currently attached to the instances' boot disks
+func runVerify(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("verify")
+	target.register(fs)
+	var disks api.DiskSelector
+	registerDisks(fs, &disks)
+	format := registerOutput(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	if err := checkDisks(disks); err != nil {
+		return err
+	}
+
+	computeService, err := connect()
+	if err != nil {
+		return err
+	}
+
+	instances, err := loadTargets(ctx, &target, computeService)
+	if err != nil {
+		return err
+	}
+
+	if len(instances) == 0 {
+		return fmt.Errorf("no instances to verify")
+	}
+
+	// Treat each selected disk as already converted so VerifyConversion reads it
+	var conversions []api.PAYGConversion
+	for _, instance := range instances {
+		diskNames, err := disks.Select(instance)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %v\n", instance.Name, err)
+			continue
+		}
+
+		for _, diskName := range diskNames {
+			var licenses []string
+			for _, disk := range instance.Disks {
+				if disk.Name == diskName {
+					licenses = disk.Licenses
+				}
+			}
+			conversions = append(conversions, api.PAYGConversion{
+				Instance:         instance,
+				OriginalOS:       strings.Join(licenses, ", "),
+				Success:          true,
+				Disk:             diskName,
+				OriginalLicenses: licenses,
+			})
+		}
+	}
+
+	conversions = api.VerifyConversion(ctx, conversions, computeService)
+
+	fmt.Fprintln(os.Stderr, "\nVerification Results:")
+	return output.Write(os.Stdout, outputFormat, api.ToConversionResults(conversions))
+}
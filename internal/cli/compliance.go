@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/compliance"
+	"gcp-instance-explorer/internal/output"
+)
+
+// runCompliance compares BYOS entitlements with the BYOS instances deployed across projects
+func runCompliance(ctx context.Context, args []string) error {
+	fs := newFlagSet("compliance")
+	var projects projectFlags
+	projects.register(fs)
+	entitlementsFile := fs.String("entitlements", "", "Entitlements file, YAML or CSV (required)")
+	parallel := fs.Int("parallel", 8, "Number of projects listed at the same time")
+	filterExpr := fs.String("filter", "", "Only count instances matching this filter expression")
+	running := fs.Bool("running", false, "Only count RUNNING instances")
+	reportFile := fs.String("report", "", "Also write the full report to this JSON or YAML file")
+	format := registerOutput(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	filter, err := api.ParseFilter(*filterExpr)
+	if err != nil {
+		return err
+	}
+
+	if *entitlementsFile == "" {
+		fmt.Fprintln(os.Stderr, "The -entitlements flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	if projects.sources() != 1 || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Give exactly one of -projects, -folder, -organization or -all")
+		fs.Usage()
+		return errUsage
+	}
+
+	entitlements, err := compliance.LoadEntitlements(*entitlementsFile)
+	if err != nil {
+		return err
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	projectIDs, scopeErrors, err := projects.resolve(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Listing instances in %d projects...\n", len(projectIDs))
+	inventory := api.ListInstancesAcrossProjects(ctx, projectIDs, *parallel, filter, session.Compute)
+	inventory.Errors = append(scopeErrors, inventory.Errors...)
+	for _, projectErr := range inventory.Errors {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", projectErr.Project, projectErr.Err)
+	}
+
+	instances := inventory.Instances
+	if *running {
+		instances = nil
+		for _, instance := range inventory.Instances {
+			if instance.Status == "RUNNING" {
+				instances = append(instances, instance)
+			}
+		}
+	}
+
+	// Machine types whose name does not give the vCPU count are looked up
+	for _, err := range entitlements.ResolveVCPUs(ctx, instances, session.Compute) {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+
+	report := compliance.Check(instances, entitlements, projectIDs)
+	if outputFormat == output.Table {
+		compliance.DisplayReport(report, os.Stdout)
+	} else if err := output.Write(os.Stdout, outputFormat, report); err != nil {
+		return err
+	}
+
+	if *reportFile != "" {
+		if err := compliance.WriteReport(report, *reportFile); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\nCompliance report written to %s\n", *reportFile)
+	}
+
+	// A partial count could hide overuse, so unreadable projects fail the check too
+	if err := listingError(inventory.Errors, len(projectIDs)); err != nil {
+		return err
+	}
+	if !report.Compliant {
+		return fmt.Errorf("%s", strings.TrimSuffix(report.Summary(), "."))
+	}
+	return nil
+}
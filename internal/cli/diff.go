@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/drift"
+	"gcp-instance-explorer/internal/output"
+)
+
+// runDiff compares an export with a later export, or with the live instances of a project. It
+// fails when licenses drifted, so a scheduled run can alert on unapproved changes.
+func runDiff(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("diff")
+	target.register(fs)
+	before := fs.String("before", "", "Earlier export file (required)")
+	after := fs.String("after", "", "Later export file; without it the live instances of -project are used")
+	format := registerOutput(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *before == "" || fs.NArg() > 0 || (*after == "") == (target.Project == "") {
+		fmt.Fprintln(os.Stderr, "Give -before and exactly one of -after or -project")
+		fs.Usage()
+		return errUsage
+	}
+	if *after != "" && (target.Zone != "" || target.Instances != "" || target.Filter != "") {
+		return fmt.Errorf("-zone, -instance and -filter only apply when comparing with live instances")
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	document, err := api.LoadInstanceExport(*before)
+	if err != nil {
+		return fmt.Errorf("error loading %s: %v", *before, err)
+	}
+	old := document.Instances
+	beforeSource := describeExport(*before, document.Header)
+
+	var current []api.InstanceExport
+	var source string
+	if *after != "" {
+		document, err := api.LoadInstanceExport(*after)
+		if err != nil {
+			return fmt.Errorf("error loading %s: %v", *after, err)
+		}
+		current = document.Instances
+		source = describeExport(*after, document.Header)
+	} else {
+		if header := document.Header; header.Project != "" && header.Project != target.Project {
+			return fmt.Errorf("%s is an export of project %s, not %s", *before, header.Project, target.Project)
+		}
+
+		if target.filter, err = api.ParseFilter(target.Filter); err != nil {
+			return err
+		}
+
+		computeService, err := connect()
+		if err != nil {
+			return err
+		}
+		instances, err := api.ListInstancesFiltered(ctx, target.Project, computeService, target.filter)
+		if err != nil {
+			return err
+		}
+		source = "live instances of " + target.Project
+
+		// Both sides are scoped the same way, and an -instance deleted since the export is
+		// reported as removed instead of not found
+		old = scopeExports(old, &target)
+		current = scopeExports(api.ToInstanceExports(instances), &target)
+	}
+
+	report := drift.Compare(old, current, beforeSource, source)
+	if outputFormat == output.Table {
+		drift.DisplayReport(report, os.Stdout)
+	} else if err := output.Write(os.Stdout, outputFormat, report); err != nil {
+		return err
+	}
+
+	if licenseDrift := report.LicenseDrift(); len(licenseDrift) > 0 {
+		return fmt.Errorf("licenses drifted on %d instances", countInstances(licenseDrift))
+	}
+	return nil
+}
+
+// scopeExports keeps the instances of a diff that are in scope: those of the project being
+// compared, in -zone, named by -instance and matching -filter. Anything else in the export
+// would otherwise show up as removed.
+func scopeExports(instances []api.InstanceExport, target *targetFlags) []api.InstanceExport {
+	names := make(map[string]bool)
+	for _, name := range target.names() {
+		names[name] = true
+	}
+
+	var scoped []api.InstanceExport
+	for _, instance := range instances {
+		// Only the project being compared is relevant in a multi-project inventory file
+		inProject := instance
+		if inProject.Project == "" {
+			inProject.Project = target.Project
+		}
+		if inProject.Project != target.Project || (target.Zone != "" && instance.Zone != target.Zone) ||
+			(len(names) > 0 && !names[instance.Name]) || !target.filter.MatchExport(inProject) {
+			continue
+		}
+		scoped = append(scoped, instance)
+	}
+	return scoped
+}
+
+// describeExport names an export file and, when it has a header, when it was taken
+func describeExport(filename string, header api.ExportHeader) string {
+	if header.SchemaVersion == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s (exported %s)", filename, header.ExportedAt.Format(time.RFC3339))
+}
+
+// countInstances counts the distinct instances among changes
+func countInstances(changes []drift.Change) int {
+	seen := make(map[string]bool)
+	for _, change := range changes {
+		seen[change.Project+"/"+change.Zone+"/"+change.Instance] = true
+	}
+	return len(seen)
+}
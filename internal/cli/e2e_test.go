@@ -0,0 +1,933 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/audit"
+	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/fakecompute"
+
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	testProject = "test-project"
+	testZone    = "us-central1-a"
+	licenseBase = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/"
+)
+
+// newFakeEnvironment starts a fake Compute Engine with three instances, points the CLI and the
+// alpha disk API at it and runs the test in an empty working directory
+func newFakeEnvironment(t *testing.T) *fakecompute.Server {
+	t.Helper()
+
+	fake := fakecompute.NewServer()
+	t.Cleanup(fake.Close)
+
+	addInstance(fake, "rhel9-byos", "projects/rhel-cloud/global/images/rhel-9-v20250101", licenseBase+"rhel-9-byos")
+	addInstance(fake, "rhel8-byos", "projects/rhel-cloud/global/images/rhel-8-v20250101", licenseBase+"rhel-8-byos")
+	addInstance(fake, "debian", "projects/debian-cloud/global/images/debian-12-v20250101",
+		"https://www.googleapis.com/compute/v1/projects/debian-cloud/global/licenses/debian-12-bookworm")
+
+	computeService, err := fake.ComputeService(context.Background())
+	if err != nil {
+		t.Fatalf("creating compute service: %v", err)
+	}
+
+	crmService, err := fake.ResourceManagerService(context.Background())
+	if err != nil {
+		t.Fatalf("creating resource manager service: %v", err)
+	}
+
+	foldersService, err := fake.FoldersService(context.Background())
+	if err != nil {
+		t.Fatalf("creating folders service: %v", err)
+	}
+
+	previousSession := newSession
+	newSession = func() (*auth.Session, error) {
+		return &auth.Session{Compute: computeService, CRM: crmService, Folders: foldersService, Principal: "tester@example.com"}, nil
+	}
+	api.SetAlphaEndpoint(fake.AlphaEndpoint(), fake.HTTPClient())
+	t.Cleanup(func() {
+		newSession = previousSession
+		api.SetAlphaEndpoint("", nil)
+	})
+
+	dir := t.TempDir()
+	previousDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previousDir) })
+
+	return fake
+}
+
+// addInstance adds a running instance whose boot disk has the same name
+func addInstance(fake *fakecompute.Server, name, sourceImage string, licenses ...string) {
+	fake.AddDisk(testProject, testZone, &compute.Disk{
+		Name:        name,
+		SizeGb:      20,
+		SourceImage: sourceImage,
+		Licenses:    licenses,
+	})
+	fake.AddInstance(testProject, testZone, &compute.Instance{
+		Name:        name,
+		MachineType: "zones/" + testZone + "/machineTypes/e2-standard-2",
+		Disks:       []*compute.AttachedDisk{{Boot: true, Source: name, Type: "PERSISTENT"}},
+	})
+}
+
+// run executes a command line and fails the test on a non-zero exit status
+func run(t *testing.T, args ...string) {
+	t.Helper()
+	if code := Run(context.Background(), args); code != 0 {
+		t.Fatalf("%s exited with status %d", strings.Join(args, " "), code)
+	}
+}
+
+// runStdout executes a command line and returns what it wrote to stdout
+func runStdout(t *testing.T, args ...string) string {
+	t.Helper()
+
+	out, code := runOutput(t, args...)
+	if code != 0 {
+		t.Fatalf("%s exited with status %d", strings.Join(args, " "), code)
+	}
+	return out
+}
+
+// runOutput executes a command line and returns what it wrote to stdout and its exit status
+func runOutput(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	captured := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		captured <- string(data)
+	}()
+
+	code := Run(context.Background(), args)
+	os.Stdout = stdout
+	writer.Close()
+	return <-captured, code
+}
+
+// diskLicenses returns the license codes currently on a fake disk
+func diskLicenses(t *testing.T, fake *fakecompute.Server, disk string) string {
+	t.Helper()
+	d := fake.Disk(testProject, testZone, disk)
+	if d == nil {
+		t.Fatalf("disk %s not found", disk)
+	}
+
+	var codes []string
+	for _, license := range d.Licenses {
+		codes = append(codes, license[strings.LastIndex(license, "/")+1:])
+	}
+	return strings.Join(codes, ",")
+}
+
+func TestListExportConvertVerify(t *testing.T) {
+	fake := newFakeEnvironment(t)
+
+	run(t, "list", "-project", testProject)
+	run(t, "export", "-project", testProject, "-filter", "license~byos")
+	if _, err := os.Stat(testProject + "-instances.yml"); err != nil {
+		t.Fatalf("export file not written: %v", err)
+	}
+
+	// Without -instance the exported file decides what is converted
+	run(t, "convert", "-project", testProject, "-yes", "-journal", "run.journal.jsonl")
+	run(t, "verify", "-project", testProject)
+
+	for disk, want := range map[string]string{
+		"rhel9-byos": "rhel-9-server",
+		"rhel8-byos": "rhel-8-server",
+		"debian":     "debian-12-bookworm",
+	} {
+		if got := diskLicenses(t, fake, disk); got != want {
+			t.Errorf("disk %s licenses = %s, want %s", disk, got, want)
+		}
+	}
+
+	records, err := api.ReadJournal("run.journal.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := 0
+	for _, rec := range records {
+		if rec.State == api.JournalDone {
+			done++
+		}
+	}
+	if done != 2 {
+		t.Errorf("journal has %d done records, want 2", done)
+	}
+}
+
+func TestStructuredOutput(t *testing.T) {
+	newFakeEnvironment(t)
+
+	var instances []api.InstanceExport
+	out := runStdout(t, "list", "-project", testProject, "-output", "json")
+	if err := json.Unmarshal([]byte(out), &instances); err != nil {
+		t.Fatalf("list -output json is not valid JSON: %v\n%s", err, out)
+	}
+	if len(instances) != 3 {
+		t.Errorf("list returned %d instances, want 3", len(instances))
+	}
+
+	out = runStdout(t, "convert", "-project", testProject, "-instance", "rhel9-byos,rhel8-byos",
+		"-yes", "-journal", "run.journal.jsonl", "-output", "ndjson")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("convert -output ndjson wrote %d lines, want 2:\n%s", len(lines), out)
+	}
+	for _, line := range lines {
+		var result api.ConversionResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", line, err)
+		}
+		if result.Outcome != api.OutcomeSuccess || len(result.VerifiedLicenses) != 1 {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+
+	out = runStdout(t, "verify", "-project", testProject, "-instance", "rhel9-byos", "-output", "csv")
+	if !strings.HasPrefix(out, "project,zone,instance,") || !strings.Contains(out, "rhel-cloud:rhel-9-server") {
+		t.Errorf("unexpected verify CSV:\n%s", out)
+	}
+}
+
+func TestConvertThenRollback(t *testing.T) {
+	fake := newFakeEnvironment(t)
+
+	run(t, "convert", "-project", testProject, "-instance", "rhel9-byos", "-yes", "-journal", "run.journal.jsonl")
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-server" {
+		t.Fatalf("after convert licenses = %s, want rhel-9-server", got)
+	}
+
+	run(t, "rollback", "-project", testProject, "-from", "run.journal.jsonl", "-yes", "-journal", "rollback.journal.jsonl")
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-byos" {
+		t.Errorf("after rollback licenses = %s, want rhel-9-byos", got)
+	}
+}
+
+func TestPlanThenApply(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	planFile := filepath.Join(".", "change.yml")
+
+	run(t, "plan", "-project", testProject, "-instance", "rhel8-byos", "-out", planFile)
+	if got := diskLicenses(t, fake, "rhel8-byos"); got != "rhel-8-byos" {
+		t.Fatalf("plan changed the disk: licenses = %s", got)
+	}
+
+	run(t, "apply", "-plan", planFile, "-yes", "-journal", "apply.journal.jsonl")
+	if got := diskLicenses(t, fake, "rhel8-byos"); got != "rhel-8-server" {
+		t.Errorf("after apply licenses = %s, want rhel-8-server", got)
+	}
+
+	// Converting back to BYOS restores the Cloud Access license
+	run(t, "convert", "-project", testProject, "-instance", "rhel8-byos", "-to", "byos", "-yes", "-journal", "byos.journal.jsonl")
+	if got := diskLicenses(t, fake, "rhel8-byos"); got != "rhel-8-byos" {
+		t.Errorf("after convert to byos licenses = %s, want rhel-8-byos", got)
+	}
+}
+
+func TestFailedPatchIsReported(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.FailDiskPatch(testProject, testZone, "rhel9-byos", "license change rejected")
+
+	code := Run(context.Background(), []string{"convert", "-project", testProject, "-instance", "rhel9-byos",
+		"-yes", "-journal", "run.journal.jsonl"})
+	if code != 1 {
+		t.Errorf("convert exited with status %d, want 1", code)
+	}
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-byos" {
+		t.Errorf("failed patch changed the disk: licenses = %s", got)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	fake := newFakeEnvironment(t)
+
+	run(t, "stop", "-project", testProject, "-instance", "debian")
+	if status := fake.Instance(testProject, testZone, "debian").Status; status != "TERMINATED" {
+		t.Errorf("after stop status = %s, want TERMINATED", status)
+	}
+
+	run(t, "start", "-project", testProject, "-instance", "debian")
+	if status := fake.Instance(testProject, testZone, "debian").Status; status != "RUNNING" {
+		t.Errorf("after start status = %s, want RUNNING", status)
+	}
+}
+
+func TestPerDiskLicenses(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.AddDisk(testProject, testZone, &compute.Disk{Name: "app-data", SizeGb: 100, Licenses: []string{licenseBase + "rhel-9-byos"}})
+	fake.AddDisk(testProject, testZone, &compute.Disk{
+		Name:        "app-boot",
+		SizeGb:      20,
+		SourceImage: "projects/rhel-cloud/global/images/rhel-9-v20250101",
+		Licenses:    []string{licenseBase + "rhel-9-byos"},
+	})
+	// The data disk comes first so the boot flag, not the position, must decide
+	fake.AddInstance(testProject, testZone, &compute.Instance{
+		Name: "app",
+		Disks: []*compute.AttachedDisk{
+			{Source: "app-data", Type: "PERSISTENT"},
+			{Source: "app-boot", Boot: true, Type: "PERSISTENT"},
+		},
+	})
+
+	out := runStdout(t, "licenses", "list", "-project", testProject, "-instance", "app", "-output", "csv")
+	if !strings.Contains(out, "app-data,false") || !strings.Contains(out, "app-boot,true") {
+		t.Errorf("unexpected licenses list:\n%s", out)
+	}
+
+	// Converting without -disk leaves the data disk alone
+	run(t, "convert", "-project", testProject, "-instance", "app", "-yes", "-journal", "boot.journal.jsonl")
+	if got := diskLicenses(t, fake, "app-boot"); got != "rhel-9-server" {
+		t.Errorf("boot disk licenses = %s, want rhel-9-server", got)
+	}
+	if got := diskLicenses(t, fake, "app-data"); got != "rhel-9-byos" {
+		t.Fatalf("data disk changed: licenses = %s", got)
+	}
+
+	run(t, "convert", "-project", testProject, "-instance", "app", "-disk", "app-data", "-yes", "-journal", "data.journal.jsonl")
+	if got := diskLicenses(t, fake, "app-data"); got != "rhel-9-server" {
+		t.Errorf("data disk licenses = %s, want rhel-9-server", got)
+	}
+
+	run(t, "licenses", "add", "-project", testProject, "-instance", "app", "-disk", "app-data",
+		"-license", "rhel-cloud:rhel-9-sap", "-yes", "-journal", "add.journal.jsonl")
+	if got := diskLicenses(t, fake, "app-data"); got != "rhel-9-server,rhel-9-sap" {
+		t.Errorf("after add licenses = %s", got)
+	}
+
+	run(t, "licenses", "replace", "-project", testProject, "-instance", "app", "-disk", "app-data",
+		"-license", "rhel-cloud:rhel-9-server", "-with", "rhel-cloud:rhel-9-byos", "-yes", "-journal", "replace.journal.jsonl")
+	if got := diskLicenses(t, fake, "app-data"); got != "rhel-9-sap,rhel-9-byos" {
+		t.Errorf("after replace licenses = %s", got)
+	}
+
+	run(t, "licenses", "remove", "-project", testProject, "-instance", "app", "-disk", "app-data",
+		"-license", "rhel-cloud:rhel-9-sap", "-yes", "-journal", "remove.journal.jsonl")
+	if got := diskLicenses(t, fake, "app-data"); got != "rhel-9-byos" {
+		t.Errorf("after remove licenses = %s", got)
+	}
+
+	// Removing a license the disk does not carry changes nothing
+	code := Run(context.Background(), []string{"licenses", "remove", "-project", testProject, "-instance", "app",
+		"-disk", "app-data", "-license", "rhel-cloud:rhel-9-sap", "-yes", "-journal", "noop.journal.jsonl"})
+	if code == 0 {
+		t.Errorf("removing a missing license succeeded")
+	}
+
+	// Edits are journaled per disk and roll back like conversions
+	run(t, "rollback", "-project", testProject, "-from", "remove.journal.jsonl", "-yes", "-journal", "rollback.journal.jsonl")
+	if got := diskLicenses(t, fake, "app-data"); got != "rhel-9-sap,rhel-9-byos" {
+		t.Errorf("after rollback licenses = %s", got)
+	}
+}
+
+func TestInventoryEnumeratesProjects(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.AddProject(testProject, "folders/1", "")
+	fake.AddProject("deleted-project", "folders/1", "DELETE_REQUESTED")
+	fake.AddFolder("2", "folders/1")
+	fake.AddProject("team-project", "folders/2", "")
+	fake.AddFolder("3", "folders/1")
+	fake.FailFolder("3")
+
+	listed := func() map[string]bool {
+		projects := make(map[string]bool)
+		for _, request := range fake.Requests() {
+			if rest, ok := strings.CutPrefix(request, "GET /compute/v1/projects/"); ok && strings.HasSuffix(rest, "/aggregated/instances") {
+				projects[strings.TrimSuffix(rest, "/aggregated/instances")] = true
+			}
+		}
+		return projects
+	}
+
+	// Projects pending deletion are left out, as they are under a folder
+	run(t, "inventory", "-all", "-output", "csv")
+	if projects := listed(); !projects[testProject] || !projects["team-project"] || projects["deleted-project"] {
+		t.Errorf("-all listed %v, want the active projects only", projects)
+	}
+
+	// An unreadable sub-folder is reported, but the projects that could be read are still listed
+	out, code := runOutput(t, "inventory", "-folder", "1", "-output", "csv")
+	if code != 1 || !strings.Contains(out, "rhel9-byos") {
+		t.Errorf("inventory with an unreadable folder exited with status %d, want 1 with the readable projects:\n%s", code, out)
+	}
+}
+
+func TestInventoryResources(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.AddDisk(testProject, testZone, &compute.Disk{
+		Name:        "detached-boot",
+		SizeGb:      20,
+		SourceImage: "projects/rhel-cloud/global/images/rhel-8-v20250101",
+		Licenses:    []string{licenseBase + "rhel-8-byos"},
+	})
+	fake.AddImage(testProject, &compute.Image{
+		Name:     "golden-rhel-9",
+		Licenses: []string{licenseBase + "rhel-9-byos"},
+	})
+	fake.AddImage(testProject, &compute.Image{Name: "plain"})
+	fake.AddSnapshot(testProject, &compute.Snapshot{
+		Name:       "nightly",
+		SourceDisk: "projects/" + testProject + "/zones/" + testZone + "/disks/detached-boot",
+		Licenses:   []string{licenseBase + "rhel-8-byos"},
+	})
+
+	var disks []api.LicensedResource
+	out := runStdout(t, "inventory", "disks", "-projects", testProject, "-unattached", "-output", "json")
+	if err := json.Unmarshal([]byte(out), &disks); err != nil {
+		t.Fatalf("inventory disks output is not JSON: %v\n%s", err, out)
+	}
+	if len(disks) != 1 || disks[0].Name != "detached-boot" || disks[0].Attached {
+		t.Fatalf("unattached disks = %+v", disks)
+	}
+	if disks[0].MappingRule != "rhel-8-byos-to-payg" || disks[0].Licenses[0] != "rhel-cloud:rhel-8-byos" {
+		t.Errorf("detached disk = %+v", disks[0])
+	}
+
+	out = runStdout(t, "inventory", "disks", "-projects", testProject, "-output", "csv")
+	if !strings.Contains(out, ",true,rhel9-byos,") {
+		t.Errorf("attached disk not reported with its instance:\n%s", out)
+	}
+
+	out = runStdout(t, "inventory", "images", "-projects", testProject, "-licensed", "-output", "csv")
+	if !strings.Contains(out, "golden-rhel-9") || strings.Contains(out, "plain") || !strings.Contains(out, "rhel-9-byos-to-payg") {
+		t.Errorf("unexpected image inventory:\n%s", out)
+	}
+
+	out = runStdout(t, "inventory", "snapshots", "-projects", testProject, "-output", "csv")
+	if !strings.Contains(out, "nightly") || !strings.Contains(out, "detached-boot") {
+		t.Errorf("unexpected snapshot inventory:\n%s", out)
+	}
+}
+
+func TestCompliance(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	entitlements := "entitlements:\n" +
+		"  - name: rhel-9\n    licenses: [rhel-cloud:rhel-9-byos]\n    vcpus: 4\n" +
+		"  - name: rhel-8\n    licenses: [rhel-cloud:rhel-8-byos]\n    instances: 1\n"
+	if err := os.WriteFile("entitlements.yml", []byte(entitlements), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, "compliance", "-projects", testProject, "-entitlements", "entitlements.yml", "-report", "report.json")
+	data, err := os.ReadFile("report.json")
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+	var report struct {
+		Compliant    bool `json:"compliant"`
+		Entitlements []struct {
+			Name          string `json:"name"`
+			UsedVCPUs     int    `json:"usedVcpus"`
+			HeadroomVCPUs int    `json:"headroomVcpus"`
+		} `json:"entitlements"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Compliant || len(report.Entitlements) != 2 || report.Entitlements[0].UsedVCPUs != 2 ||
+		report.Entitlements[0].HeadroomVCPUs != 2 {
+		t.Errorf("unexpected report: %s", data)
+	}
+
+	// One more RHEL 8 instance than entitled fails the check
+	addInstance(fake, "rhel8-extra", "projects/rhel-cloud/global/images/rhel-8-v20250101", licenseBase+"rhel-8-byos")
+	code := Run(context.Background(), []string{"compliance", "-projects", testProject, "-entitlements", "entitlements.yml",
+		"-report", "report.yml"})
+	if code != 1 {
+		t.Errorf("compliance exited with status %d, want 1", code)
+	}
+	data, err = os.ReadFile("report.yml")
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+	if !strings.Contains(string(data), "overuseInstances: 1") || !strings.Contains(string(data), "moveToPayg:") {
+		t.Errorf("overuse not reported:\n%s", data)
+	}
+
+	// A machine type whose name does not give its vCPUs is looked up, so it counts against the vCPU limit
+	fake.AddMachineType(testProject, testZone, &compute.MachineType{Name: "a2-highgpu-1g", GuestCpus: 12})
+	fake.AddDisk(testProject, testZone, &compute.Disk{Name: "gpu", Licenses: []string{licenseBase + "rhel-9-byos"}})
+	fake.AddInstance(testProject, testZone, &compute.Instance{
+		Name:        "gpu",
+		MachineType: "zones/" + testZone + "/machineTypes/a2-highgpu-1g",
+		Disks:       []*compute.AttachedDisk{{Boot: true, Source: "gpu", Type: "PERSISTENT"}},
+	})
+	out, code := runOutput(t, "compliance", "-projects", testProject, "-entitlements", "entitlements.yml", "-output", "csv")
+	if code != 1 || !strings.Contains(out, "rhel-9,rhel-cloud:rhel-9-byos,4,14,0,10,") {
+		t.Errorf("compliance exited with status %d, want the a2 instance's 12 vCPUs counted:\n%s", code, out)
+	}
+}
+
+func TestResumeConvert(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	addInstance(fake, "rhel9-other", "projects/rhel-cloud/global/images/rhel-9-v20250101", licenseBase+"rhel-9-byos")
+	fake.FailDiskPatch(testProject, testZone, "rhel8-byos", "license change rejected")
+
+	code := Run(context.Background(), []string{"convert", "-project", testProject, "-filter", "license~byos",
+		"-yes", "-journal", "run.journal.jsonl"})
+	if code != 1 {
+		t.Fatalf("convert with a failing disk exited with status %d, want 1", code)
+	}
+
+	// The run is cut short: rhel8-byos and rhel9-other lose their final record and stay in flight
+	records, err := api.ReadJournal("run.journal.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []byte
+	for i, rec := range records {
+		if rec.Instance != "rhel9-byos" && lastRecordOf(records, i) {
+			continue
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(append(kept, line...), '\n')
+	}
+	if err := os.WriteFile("run.journal.jsonl", kept, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// rhel8-byos is unchanged and retried; someone else relicenses rhel9-other meanwhile
+	fake.FailDiskPatch(testProject, testZone, "rhel8-byos", "")
+	other := fake.Disk(testProject, testZone, "rhel9-other")
+	other.Licenses = []string{licenseBase + "rhel-8-byos"}
+	fake.AddDisk(testProject, testZone, other)
+
+	code = Run(context.Background(), []string{"convert", "-project", testProject, "-resume", "run.journal.jsonl", "-yes"})
+	if code != 1 {
+		t.Errorf("resume with a disk changed unexpectedly exited with status %d, want 1", code)
+	}
+	for disk, want := range map[string]string{
+		"rhel9-byos":  "rhel-9-server",
+		"rhel8-byos":  "rhel-8-server",
+		"rhel9-other": "rhel-8-byos",
+	} {
+		if got := diskLicenses(t, fake, disk); got != want {
+			t.Errorf("after resume %s licenses = %s, want %s", disk, got, want)
+		}
+	}
+
+	records, err = api.ReadJournal("run.journal.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]api.JournalState)
+	for _, rec := range records {
+		states[rec.Instance] = rec.State
+	}
+	want := map[string]api.JournalState{"rhel9-byos": api.JournalDone, "rhel8-byos": api.JournalDone, "rhel9-other": api.JournalFailed}
+	for instance, state := range want {
+		if states[instance] != state {
+			t.Errorf("%s journal state = %s, want %s", instance, states[instance], state)
+		}
+	}
+
+	patches := 0
+	for _, request := range fake.Requests() {
+		if strings.HasPrefix(request, "PATCH ") && strings.Contains(request, "/disks/rhel9-byos") {
+			patches++
+		}
+	}
+	if patches != 1 {
+		t.Errorf("rhel9-byos was patched %d times, want the done item left alone on resume", patches)
+	}
+}
+
+// lastRecordOf reports whether records[i] is the last record of its instance
+func lastRecordOf(records []api.JournalRecord, i int) bool {
+	for _, rec := range records[i+1:] {
+		if rec.Instance == records[i].Instance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAuditLog(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.FailDiskPatch(testProject, testZone, "rhel8-byos", "license change rejected")
+
+	api.SetAuditLog(audit.New("audit.jsonl"))
+	t.Cleanup(func() {
+		api.AuditLog().Close()
+		api.SetAuditLog(nil)
+	})
+
+	run(t, "stop", "-project", testProject, "-instance", "rhel9-byos")
+	Run(context.Background(), []string{"convert", "-project", testProject, "-filter", "license~byos",
+		"-yes", "-journal", "run.journal.jsonl"})
+
+	data, err := os.ReadFile("audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec audit.Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	outcomes := map[string]string{}
+	for _, rec := range records {
+		if rec.Principal != "tester@example.com" {
+			t.Errorf("record %d principal = %q", rec.Sequence, rec.Principal)
+		}
+		outcomes[rec.Action+" "+rec.Resource] = rec.Outcome
+	}
+	want := map[string]string{
+		"instances.stop projects/test-project/zones/us-central1-a/instances/rhel9-byos":   audit.OutcomeSuccess,
+		"disks.updateLicenses projects/test-project/zones/us-central1-a/disks/rhel9-byos": audit.OutcomeSuccess,
+		"disks.updateLicenses projects/test-project/zones/us-central1-a/disks/rhel8-byos": audit.OutcomeFailure,
+	}
+	for action, outcome := range want {
+		if outcomes[action] != outcome {
+			t.Errorf("%s outcome = %q, want %q (records: %+v)", action, outcomes[action], outcome, records)
+		}
+	}
+
+	run(t, "audit", "verify", "-log", "audit.jsonl")
+
+	tampered := strings.Replace(string(data), "rhel-9-byos", "rhel-9-server", 1)
+	if err := os.WriteFile("audit.jsonl", []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := Run(context.Background(), []string{"audit", "verify", "-log", "audit.jsonl"}); code != 1 {
+		t.Errorf("audit verify of a tampered log exited with status %d, want 1", code)
+	}
+}
+
+func TestUnrecordedChangeFailsTheCommand(t *testing.T) {
+	fake := newFakeEnvironment(t)
+
+	api.SetAuditLog(audit.New(filepath.Join("missing", "audit.jsonl")))
+	t.Cleanup(func() { api.SetAuditLog(nil) })
+
+	if code := Run(context.Background(), []string{"stop", "-project", testProject, "-instance", "rhel9-byos"}); code != 1 {
+		t.Errorf("stop exited with status %d, want 1 for the missing audit record", code)
+	}
+	if status := fake.Instance(testProject, testZone, "rhel9-byos").Status; status != "TERMINATED" {
+		t.Errorf("instance status = %s, the stop itself should still happen", status)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	fake := newFakeEnvironment(t)
+
+	out := runStdout(t, "preflight", "-project", testProject, "-require", "convert", "-output", "csv")
+	if !strings.Contains(out, "test-project,tester@example.com,convert,true,") {
+		t.Errorf("unexpected preflight CSV:\n%s", out)
+	}
+
+	fake.DenyPermission(testProject, "compute.disks.update")
+	out = runStdout(t, "preflight", "-project", testProject, "-output", "csv")
+	if !strings.Contains(out, ",convert,false,") || !strings.Contains(out, "compute.disks.update") || !strings.Contains(out, ",list,true,") {
+		t.Errorf("denied permission not reported:\n%s", out)
+	}
+	if code := Run(context.Background(), []string{"preflight", "-project", testProject, "-require", "convert"}); code != 1 {
+		t.Errorf("preflight -require convert exited with status %d, want 1", code)
+	}
+
+	// The Mass Mover refuses before patching anything
+	code := Run(context.Background(), []string{"convert", "-project", testProject, "-instance", "rhel9-byos",
+		"-yes", "-journal", "run.journal.jsonl"})
+	if code != 1 {
+		t.Errorf("convert without compute.disks.update exited with status %d, want 1", code)
+	}
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-byos" {
+		t.Errorf("convert changed the disk despite missing permissions: licenses = %s", got)
+	}
+	for _, request := range fake.Requests() {
+		if strings.HasPrefix(request, "PATCH ") {
+			t.Errorf("disk patched despite missing permissions: %s", request)
+		}
+	}
+}
+
+func TestPreflightThatCannotRunStopsTheConversion(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.FailPermissionTests()
+
+	code := Run(context.Background(), []string{"convert", "-project", testProject, "-instance", "rhel9-byos",
+		"-yes", "-journal", "run.journal.jsonl"})
+	if code != 1 {
+		t.Errorf("convert with untestable permissions exited with status %d, want 1", code)
+	}
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-byos" {
+		t.Errorf("convert changed the disk without a permission check: licenses = %s", got)
+	}
+
+	// An explicit -skip-preflight goes ahead without the check
+	run(t, "convert", "-project", testProject, "-instance", "rhel9-byos", "-yes", "-skip-preflight",
+		"-journal", "skipped.journal.jsonl")
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-server" {
+		t.Errorf("convert -skip-preflight left licenses = %s", got)
+	}
+}
+
+func TestSafetyChecksBlockRiskyInstances(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	image := "projects/rhel-cloud/global/images/rhel-9-v20250101"
+
+	fake.AddDisk(testProject, testZone, &compute.Disk{Name: "cluster-disk", SourceImage: image, Licenses: []string{licenseBase + "rhel-9-byos"}})
+	for _, name := range []string{"cluster-a", "cluster-b"} {
+		fake.AddInstance(testProject, testZone, &compute.Instance{
+			Name:        name,
+			MachineType: "zones/" + testZone + "/machineTypes/e2-standard-2",
+			Disks:       []*compute.AttachedDisk{{Boot: true, Source: "cluster-disk", Type: "PERSISTENT"}},
+		})
+	}
+
+	addInstance(fake, "web-x1z", image, licenseBase+"rhel-9-byos")
+	web := fake.Instance(testProject, testZone, "web-x1z")
+	manager := "projects/123/zones/" + testZone + "/instanceGroupManagers/web"
+	web.Metadata.Items = []*compute.MetadataItems{{Key: "created-by", Value: &manager}}
+	fake.AddInstance(testProject, testZone, web)
+
+	addInstance(fake, "frozen", image, licenseBase+"rhel-9-byos")
+	frozen := fake.Instance(testProject, testZone, "frozen")
+	frozen.Labels = map[string]string{"do-not-touch": "true"}
+	frozen.DeletionProtection = true
+	fake.AddInstance(testProject, testZone, frozen)
+
+	out := runStdout(t, "plan", "-project", testProject, "-filter", "license~byos", "-output", "csv")
+	for _, want := range []string{
+		`cluster-a,RUNNING,cluster-disk,rhel-cloud:rhel-9-byos,,,"blocked by safety check shared-disk: disk is attached to 2 instances`,
+		"blocked by safety check managed-instance-group: member of managed instance group web",
+		"blocked by safety check protected: instance is labeled do-not-touch",
+		"rhel9-byos,RUNNING,rhel9-byos,rhel-cloud:rhel-9-byos,rhel-cloud:rhel-9-server,",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("plan CSV lacks %q:\n%s", want, out)
+		}
+	}
+
+	// Blocked disks are reported as skipped, so the run does not count as a full success
+	code := Run(context.Background(), []string{"convert", "-project", testProject, "-filter", "license~byos",
+		"-yes", "-journal", "run.journal.jsonl"})
+	if code != 1 {
+		t.Errorf("convert exited with status %d, want 1", code)
+	}
+	for disk, want := range map[string]string{
+		"cluster-disk": "rhel-9-byos",
+		"web-x1z":      "rhel-9-byos",
+		"frozen":       "rhel-9-byos",
+		"rhel9-byos":   "rhel-9-server",
+	} {
+		if got := diskLicenses(t, fake, disk); got != want {
+			t.Errorf("after convert %s licenses = %s, want %s", disk, got, want)
+		}
+	}
+}
+
+func TestManagedInstanceGroupTemplates(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	fake.AddImage(testProject, &compute.Image{
+		Name:       "golden-rhel-9",
+		Family:     "golden-rhel",
+		DiskSizeGb: 20,
+		Licenses:   []string{licenseBase + "rhel-9-byos"},
+	})
+	for name, image := range map[string]string{
+		"web-template": "global/images/family/golden-rhel",
+		"old-template": "projects/" + testProject + "/global/images/golden-rhel-9",
+	} {
+		fake.AddTemplate(testProject, &compute.InstanceTemplate{
+			Name: name,
+			Properties: &compute.InstanceProperties{
+				MachineType: "e2-standard-2",
+				Disks: []*compute.AttachedDisk{{Boot: true, Type: "PERSISTENT",
+					InitializeParams: &compute.AttachedDiskInitializeParams{SourceImage: image}}},
+			},
+		})
+	}
+	fake.AddInstanceGroupManager(testProject, testZone, &compute.InstanceGroupManager{
+		Name:             "web",
+		InstanceTemplate: "projects/" + testProject + "/global/instanceTemplates/web-template",
+	})
+
+	addInstance(fake, "web-x1z", "projects/"+testProject+"/global/images/golden-rhel-9", licenseBase+"rhel-9-byos")
+	web := fake.Instance(testProject, testZone, "web-x1z")
+	manager := "projects/123/zones/" + testZone + "/instanceGroupManagers/web"
+	web.Metadata.Items = []*compute.MetadataItems{{Key: "created-by", Value: &manager}}
+	fake.AddInstance(testProject, testZone, web)
+
+	out := runStdout(t, "list", "-project", testProject, "-filter", "mig=web", "-output", "csv")
+	if !strings.Contains(out, "web-x1z") || strings.Contains(out, "rhel9-byos") || !strings.HasSuffix(out, ",web\n") {
+		t.Errorf("MIG members not marked:\n%s", out)
+	}
+
+	var templates []api.LicensedResource
+	out = runStdout(t, "inventory", "templates", "-projects", testProject, "-output", "json")
+	if err := json.Unmarshal([]byte(out), &templates); err != nil {
+		t.Fatalf("inventory templates output is not JSON: %v\n%s", err, out)
+	}
+	if len(templates) != 2 || templates[0].Name != "old-template" || templates[0].Attached {
+		t.Fatalf("templates = %+v", templates)
+	}
+	if web := templates[1]; len(web.Users) != 1 || web.Users[0] != "web" || web.Family != "golden-rhel" ||
+		len(web.Licenses) != 1 || web.Licenses[0] != "rhel-cloud:rhel-9-byos" || web.MappingRule != "rhel-9-byos-to-payg" {
+		t.Errorf("web-template = %+v", web)
+	}
+
+	out = runStdout(t, "template", "convert", "-project", testProject, "-template", "web-template", "-zone", testZone, "-yes")
+	if !strings.Contains(out, "set-instance-template web --template=web-template-payg --zone="+testZone) {
+		t.Errorf("rollout guidance missing:\n%s", out)
+	}
+
+	image := fake.Image(testProject, "golden-rhel-9-payg")
+	if image == nil || len(image.Licenses) != 1 || !strings.HasSuffix(image.Licenses[0], "/rhel-9-server") {
+		t.Fatalf("new image = %+v", image)
+	}
+	template := fake.Template(testProject, "web-template-payg")
+	if template == nil || !strings.HasSuffix(template.Properties.Disks[0].InitializeParams.SourceImage, "/images/golden-rhel-9-payg") ||
+		template.Properties.MachineType != "e2-standard-2" {
+		t.Fatalf("new template = %+v", template)
+	}
+	if fake.Disk(testProject, testZone, "golden-rhel-9-payg-tmp") != nil {
+		t.Error("temporary disk was not deleted")
+	}
+	if got := diskLicenses(t, fake, "web-x1z"); got != "rhel-9-byos" {
+		t.Errorf("MIG member licenses = %s, want them untouched", got)
+	}
+}
+
+func TestDiffDetectsLicenseDrift(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	run(t, "export", "-project", testProject)
+	exported := testProject + "-instances.yml"
+
+	out := runStdout(t, "diff", "-before", exported, "-after", exported)
+	if !strings.Contains(out, "No drift.") {
+		t.Errorf("identical exports reported drift:\n%s", out)
+	}
+
+	// Someone starts a BYOS instance outside the approved process and stops another one
+	addInstance(fake, "rogue", "projects/rhel-cloud/global/images/rhel-9-v20250101", licenseBase+"rhel-9-byos")
+	debian := fake.Instance(testProject, testZone, "debian")
+	debian.Status = "TERMINATED"
+	fake.AddInstance(testProject, testZone, debian)
+
+	out, code := runOutput(t, "diff", "-before", exported, "-project", testProject, "-output", "csv")
+	if code != 1 {
+		t.Errorf("diff with license drift exited with status %d, want 1", code)
+	}
+	for _, want := range []string{
+		testProject + "," + testZone + ",debian,status,,RUNNING,TERMINATED,false",
+		testProject + "," + testZone + ",rogue,added,,,status=RUNNING machineType=e2-standard-2 licenses=rhel-cloud:rhel-9-byos,true",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("diff CSV lacks %q:\n%s", want, out)
+		}
+	}
+
+	// A scoped diff compares only the exported instances in the same scope, so the others are not "removed"
+	for _, scope := range [][]string{{"-instance", "rhel9-byos"}, {"-filter", "name=rhel9-byos"}} {
+		args := append([]string{"diff", "-before", exported, "-project", testProject, "-output", "csv"}, scope...)
+		if out := runStdout(t, args...); strings.Contains(out, "removed") || strings.Contains(out, "debian") ||
+			strings.Contains(out, "rogue") {
+			t.Errorf("diff %v reported instances outside its scope:\n%s", scope, out)
+		}
+	}
+
+	// An instance deleted since the export is reported as removed, not as not found
+	fake.DeleteInstance(testProject, testZone, "rhel8-byos")
+	out, code = runOutput(t, "diff", "-before", exported, "-project", testProject, "-instance", "rhel8-byos", "-output", "csv")
+	if code != 0 || !strings.Contains(out, testProject+","+testZone+",rhel8-byos,removed,") || strings.Contains(out, "rhel9-byos") {
+		t.Errorf("diff -instance of a deleted instance exited with status %d:\n%s", code, out)
+	}
+
+	run(t, "export", "-project", testProject)
+	current := testProject + "-instances.yml"
+	if err := os.Rename(current, "current.yml"); err != nil {
+		t.Fatal(err)
+	}
+	out = runStdout(t, "diff", "-before", "current.yml", "-project", testProject, "-output", "csv")
+	if strings.Contains(out, "rogue") {
+		t.Errorf("diff against a fresh export reported changes:\n%s", out)
+	}
+}
+
+func TestExportHeader(t *testing.T) {
+	newFakeEnvironment(t)
+	run(t, "export", "-project", testProject, "-filter", "license~byos", "-out", "reviewed.yml", "-timestamp")
+
+	files, err := filepath.Glob("reviewed-*.yml")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("timestamped export files = %v, %v", files, err)
+	}
+	document, err := api.LoadInstanceExport(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := document.Header
+	if header.SchemaVersion != api.ExportSchemaVersion || header.Project != testProject || header.Principal != "tester@example.com" ||
+		header.Filter != "license~byos" || header.ExportedAt.IsZero() || len(document.Instances) != 2 {
+		t.Errorf("export = %+v", document)
+	}
+
+	out := runStdout(t, "plan", "-project", testProject, "-from-file", files[0], "-output", "csv")
+	if !strings.Contains(out, "rhel9-byos") || !strings.Contains(out, "rhel8-byos") {
+		t.Errorf("plan from the export file:\n%s", out)
+	}
+
+	if code := Run(context.Background(), []string{"plan", "-project", testProject, "-from-file", files[0], "-max-export-age", "1ns"}); code != 1 {
+		t.Errorf("plan from a stale export exited with status %d, want 1", code)
+	}
+}
+
+func TestConvertRefusesRecreatedInstances(t *testing.T) {
+	fake := newFakeEnvironment(t)
+	run(t, "export", "-project", testProject, "-filter", "license~byos")
+
+	// rhel8-byos is deleted and recreated under the same name after the export was reviewed
+	addInstance(fake, "rhel8-byos", "projects/rhel-cloud/global/images/rhel-8-v20250101", licenseBase+"rhel-8-byos")
+
+	if code := Run(context.Background(), []string{"convert", "-project", testProject, "-yes", "-journal", "refused.journal.jsonl"}); code != 1 {
+		t.Errorf("convert with a recreated instance exited with status %d, want 1", code)
+	}
+	if got := diskLicenses(t, fake, "rhel9-byos"); got != "rhel-9-byos" {
+		t.Errorf("refused run changed rhel9-byos to %s", got)
+	}
+
+	run(t, "convert", "-project", testProject, "-yes", "-skip-changed", "-journal", "run.journal.jsonl")
+	for disk, want := range map[string]string{"rhel9-byos": "rhel-9-server", "rhel8-byos": "rhel-8-byos"} {
+		if got := diskLicenses(t, fake, disk); got != want {
+			t.Errorf("after -skip-changed %s licenses = %s, want %s", disk, got, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/output"
+)
+
+// runInventory lists instances across many projects and reports projects it could not read.
+// "inventory disks|images|snapshots|templates" lists those resources and their licenses instead.
+func runInventory(ctx context.Context, args []string) error {
+	var kind api.ResourceKind
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		var err error
+		if kind, err = api.ParseResourceKind(args[0]); err != nil {
+			return err
+		}
+		args = args[1:]
+	}
+
+	name := "inventory"
+	if kind != "" {
+		name += " " + string(kind)
+	}
+	fs := newFlagSet(name)
+	var projects projectFlags
+	projects.register(fs)
+	parallel := fs.Int("parallel", 8, "Number of projects listed at the same time")
+	exportFile := fs.String("export", "", "Also write the combined inventory to this YAML file")
+	filterExpr := fs.String("filter", "", "Filter expression, e.g. 'license~rhel-8 AND status=RUNNING' (instances only)")
+	licensedOnly := fs.Bool("licensed", false, "Only show disks, images, snapshots or templates that carry licenses")
+	unattachedOnly := fs.Bool("unattached", false, "Only show disks attached to no instance, or templates used by no managed instance group")
+	format := registerOutput(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	filter, err := api.ParseFilter(*filterExpr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case kind != "" && filter != nil:
+		return fmt.Errorf("-filter only applies to instances")
+	case kind == "" && (*licensedOnly || *unattachedOnly):
+		return fmt.Errorf("-licensed and -unattached apply to inventory disks, images, snapshots or templates")
+	case *unattachedOnly && kind != api.DiskResources && kind != api.TemplateResources:
+		return fmt.Errorf("-unattached only applies to disks and templates")
+	}
+
+	if projects.sources() != 1 || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Give exactly one of -projects, -folder, -organization or -all")
+		fs.Usage()
+		return errUsage
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	projectIDs, scopeErrors, err := projects.resolve(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	if kind != "" {
+		fmt.Fprintf(os.Stderr, "Listing %s in %d projects...\n", kind, len(projectIDs))
+		inventory := api.ListResourcesAcrossProjects(ctx, kind, projectIDs, *parallel, session.Compute)
+		inventory.Errors = append(scopeErrors, inventory.Errors...)
+		inventory.Resources = selectResources(inventory.Resources, *licensedOnly, *unattachedOnly)
+		return reportResources(inventory, outputFormat, *exportFile)
+	}
+
+	fmt.Fprintf(os.Stderr, "Listing instances in %d projects...\n", len(projectIDs))
+	inventory := api.ListInstancesAcrossProjects(ctx, projectIDs, *parallel, filter, session.Compute)
+	inventory.Errors = append(scopeErrors, inventory.Errors...)
+
+	// The table keeps its summary and error section; other formats carry errors as data
+	if outputFormat == output.Table {
+		api.DisplayInventory(inventory, os.Stdout)
+	} else {
+		if err := output.Write(os.Stdout, outputFormat, api.ToInventoryExport(inventory)); err != nil {
+			return err
+		}
+		for _, projectErr := range inventory.Errors {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", projectErr.Project, projectErr.Err)
+		}
+	}
+
+	if *exportFile != "" {
+		if err := api.ExportInventoryToYAML(inventory, *exportFile); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\nInventory exported to %s\n", *exportFile)
+	}
+
+	return listingError(inventory.Errors, len(projectIDs))
+}
+
+// selectResources keeps the resources that carry licenses or are unattached, when asked to
+func selectResources(resources []api.LicensedResource, licensedOnly, unattachedOnly bool) []api.LicensedResource {
+	var selected []api.LicensedResource
+	for _, resource := range resources {
+		if licensedOnly && len(resource.Licenses) == 0 {
+			continue
+		}
+		if unattachedOnly && resource.Attached {
+			continue
+		}
+		selected = append(selected, resource)
+	}
+	return selected
+}
+
+// reportResources prints a disk, image, snapshot or template inventory and optionally exports it
+func reportResources(inventory *api.ResourceInventory, outputFormat output.Format, exportFile string) error {
+	records := api.LicensedResources(inventory.Resources)
+	if outputFormat == output.Table {
+		api.DisplayResourceInventory(inventory, os.Stdout)
+	} else {
+		if err := output.Write(os.Stdout, outputFormat, records); err != nil {
+			return err
+		}
+		for _, projectErr := range inventory.Errors {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", projectErr.Project, projectErr.Err)
+		}
+	}
+
+	if exportFile != "" {
+		if err := writeFile(exportFile, output.YAML, records); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\nInventory exported to %s\n", exportFile)
+	}
+
+	return listingError(inventory.Errors, len(inventory.Projects))
+}
+
+// projectFlags holds the flags that choose the projects of an inventory
+type projectFlags struct {
+	List         string
+	Folder       string
+	Organization string
+	All          bool
+	Recursive    bool
+}
+
+// register adds the project flags to a flag set
+func (p *projectFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&p.List, "projects", "", "Comma-separated project IDs")
+	fs.StringVar(&p.Folder, "folder", "", "Inventory every project under this folder ID")
+	fs.StringVar(&p.Organization, "organization", "", "Inventory every project under this organization ID")
+	fs.BoolVar(&p.All, "all", false, "Inventory every project the credentials can see")
+	fs.BoolVar(&p.Recursive, "recursive", true, "Include projects in sub-folders of -folder or -organization")
+}
+
+// sources counts how many ways of choosing projects were given
+func (p *projectFlags) sources() int {
+	sources := 0
+	for _, value := range []string{p.List, p.Folder, p.Organization} {
+		if value != "" {
+			sources++
+		}
+	}
+	if p.All {
+		sources++
+	}
+	return sources
+}
+
+// resolve returns the IDs of the chosen projects, enumerating them through Resource Manager when
+// needed, and the folders that could not be read while enumerating them
+func (p *projectFlags) resolve(ctx context.Context, session *auth.Session) ([]string, []api.ProjectError, error) {
+	var projectIDs []string
+	var scopeErrors []api.ProjectError
+	switch {
+	case p.List != "":
+		projectIDs = splitList(p.List)
+	case p.All:
+		fmt.Fprintln(os.Stderr, "Enumerating accessible projects...")
+		projects, err := api.ListProjects(ctx, session.CRM)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, project := range projects {
+			projectIDs = append(projectIDs, project.ID)
+		}
+	default:
+		parentType, parentID := "folder", p.Folder
+		if p.Organization != "" {
+			parentType, parentID = "organization", p.Organization
+		}
+
+		fmt.Fprintf(os.Stderr, "Enumerating projects in %s %s...\n", parentType, parentID)
+		projects, folderErrors, err := api.ListProjectsUnder(ctx, parentType, parentID, p.Recursive, session.CRM, session.Folders)
+		if err != nil {
+			return nil, nil, err
+		}
+		scopeErrors = folderErrors
+		for _, project := range projects {
+			projectIDs = append(projectIDs, project.ID)
+		}
+	}
+
+	if len(projectIDs) == 0 {
+		for _, scopeErr := range scopeErrors {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", scopeErr.Project, scopeErr.Err)
+		}
+		return nil, nil, fmt.Errorf("no projects to inventory")
+	}
+	return projectIDs, scopeErrors, nil
+}
+
+// listingError fails a command when projects, or folders holding projects, could not be listed.
+// Folder errors are named folders/ID or organizations/ID.
+func listingError(listErrors []api.ProjectError, projects int) error {
+	// A folder can fail both its project and its sub-folder listing
+	failedProjects, folders := 0, make(map[string]bool)
+	for _, listErr := range listErrors {
+		if strings.HasPrefix(listErr.Project, "folders/") || strings.HasPrefix(listErr.Project, "organizations/") {
+			folders[listErr.Project] = true
+		} else {
+			failedProjects++
+		}
+	}
+	failedFolders := len(folders)
+
+	switch {
+	case failedFolders == 0 && failedProjects == 0:
+		return nil
+	case failedFolders == 0:
+		return fmt.Errorf("%d of %d projects could not be listed", failedProjects, projects)
+	case failedProjects == 0:
+		return fmt.Errorf("%d folders could not be read, their projects are missing", failedFolders)
+	default:
+		return fmt.Errorf("%d of %d projects could not be listed and %d folders could not be read, their projects are missing",
+			failedProjects, projects, failedFolders)
+	}
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/output"
+)
+
+// runLicenses dispatches the licenses subcommands
+func runLicenses(ctx context.Context, args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: gcp-instance-explorer licenses list|add|remove|replace [flags]")
+		fmt.Fprintln(os.Stderr, "\n  list     Show the licenses of every disk")
+		fmt.Fprintln(os.Stderr, "  add      Add licenses to a disk")
+		fmt.Fprintln(os.Stderr, "  remove   Remove licenses from a disk")
+		fmt.Fprintln(os.Stderr, "  replace  Replace one license on a disk with another")
+	}
+
+	if len(args) == 0 {
+		usage()
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return runLicensesList(ctx, args[1:])
+	case "add", "remove", "replace":
+		return runLicensesEdit(ctx, args[0], args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown licenses command: %s\n\n", args[0])
+		usage()
+		return errUsage
+	}
+}
+
+// runLicensesList shows one row per disk with the licenses it carries
+func runLicensesList(ctx context.Context, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("licenses list")
+	target.register(fs)
+	format := registerOutput(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	computeService, err := connect()
+	if err != nil {
+		return err
+	}
+
+	instances, err := loadTargets(ctx, &target, computeService)
+	if err != nil {
+		return err
+	}
+
+	return output.Write(os.Stdout, outputFormat, api.ToDiskLicenseRecords(instances))
+}
+
+// runLicensesEdit adds, removes or replaces licenses on the selected disks
+func runLicensesEdit(ctx context.Context, action string, args []string) error {
+	var target targetFlags
+	fs := newFlagSet("licenses " + action)
+	target.register(fs)
+	var disks api.DiskSelector
+	registerDisks(fs, &disks)
+	licenses := fs.String("license", "", "Comma-separated licenses as project:code or URL (required)")
+	with := fs.String("with", "", "License that replaces -license (replace only)")
+	var apply applyFlags
+	apply.register(fs)
+	if err := parseFlags(fs, &target, args); err != nil {
+		return err
+	}
+
+	if err := checkDisks(disks); err != nil {
+		return err
+	}
+
+	codes := splitList(*licenses)
+	if len(codes) == 0 {
+		fmt.Fprintln(os.Stderr, "The -license flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	var edit api.LicenseEdit
+	switch action {
+	case "add":
+		edit.Add = codes
+	case "remove":
+		edit.Remove = codes
+	case "replace":
+		if *with == "" {
+			fmt.Fprintln(os.Stderr, "The -with flag is required for replace")
+			fs.Usage()
+			return errUsage
+		}
+		edit.Remove = codes
+		edit.Add = []string{*with}
+	}
+	if action != "replace" && *with != "" {
+		return fmt.Errorf("-with is only used by replace")
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+	computeService := session.Compute
+
+	// Editing needs explicit targets; the exported file is only used for conversions
+	if len(target.names()) == 0 && target.filter == nil {
+		return fmt.Errorf("give -instance or -filter to choose the instances to edit")
+	}
+
+	instances, err := loadTargets(ctx, &target, computeService)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return fmt.Errorf("no instances to edit")
+	}
+
+	fmt.Fprintf(os.Stderr, "Resolving license edit %q for %d instances (%s)...\n", edit, len(instances), disks)
+	plan, err := api.PlanLicenseEdit(ctx, instances, disks, edit, computeService)
+	if err != nil {
+		return err
+	}
+
+	return applyPlan(ctx, plan, session, &apply, nil)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
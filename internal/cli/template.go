@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"gcp-instance-explorer/internal/api"
+)
+
+// runTemplate dispatches the template subcommands
+func runTemplate(ctx context.Context, args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: gcp-instance-explorer template convert [flags]")
+		fmt.Fprintln(os.Stderr, "\n  convert  Create an image and instance template with the other license model")
+	}
+
+	if len(args) == 0 {
+		usage()
+		return errUsage
+	}
+
+	switch args[0] {
+	case "convert":
+		return runTemplateConvert(ctx, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown template command: %s\n\n", args[0])
+		usage()
+		return errUsage
+	}
+}
+
+// runTemplateConvert creates a copy of an instance template whose boot image carries the
+// licenses of the other model. Managed instance groups are left for the user to roll over.
+func runTemplateConvert(ctx context.Context, args []string) error {
+	fs := newFlagSet("template convert")
+	project := fs.String("project", "", "GCP project ID (required)")
+	template := fs.String("template", "", "Instance template to convert (required)")
+	zone := fs.String("zone", "", "Zone of the temporary disk the new image is made from (required)")
+	to := fs.String("to", string(api.ToPAYG), "License model of the new template: payg or byos")
+	imageName := fs.String("image", "", "Name of the new image (default: the old image name with a -payg or -byos suffix)")
+	newTemplate := fs.String("new-template", "", "Name of the new template (default: the old name with a -payg or -byos suffix)")
+	yes := fs.Bool("yes", false, "Create the image and template without asking for confirmation")
+	skipPreflight := fs.Bool("skip-preflight", false, "Create the image and template without checking permissions first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *project == "" || *template == "" || *zone == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "The -project, -template and -zone flags are required")
+		fs.Usage()
+		return errUsage
+	}
+
+	direction, err := api.ParseDirection(*to)
+	if err != nil {
+		return err
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	conversion, err := api.PlanTemplateConversion(ctx, *project, *template, direction, api.TemplateConversionOptions{
+		Zone:        *zone,
+		ImageName:   *imageName,
+		NewTemplate: *newTemplate,
+	}, session.Compute)
+	if err != nil {
+		return err
+	}
+	api.DisplayTemplateConversion(conversion, os.Stdout)
+
+	if err := preflightFeature(ctx, *project, api.TemplateConvertFeature, "create images and templates", session, *skipPreflight); err != nil {
+		return err
+	}
+
+	ok, err := confirm(fmt.Sprintf("\nCreate image %s and template %s?", conversion.ImageName, conversion.NewTemplate), *yes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Cancelled, nothing was created.")
+		return nil
+	}
+
+	if err := api.ConvertTemplate(ctx, conversion, session.Compute); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\n✅ Created image %s and instance template %s\n", conversion.ImageName, conversion.NewTemplate)
+	return nil
+}
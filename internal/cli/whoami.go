@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/output"
+)
+
+// runWhoami prints the account and kind of credentials the tool authenticates with
+func runWhoami(ctx context.Context, args []string) error {
+	fs := newFlagSet("whoami")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	principal := session.ResolvePrincipal(ctx)
+	if principal == "" {
+		principal = "unknown (the credentials do not name their account)"
+	}
+	fmt.Printf("Principal:   %s\n", principal)
+	fmt.Printf("Credentials: %s\n", session.CredentialSource())
+	if session.QuotaProject != "" {
+		fmt.Printf("Quota:       %s\n", session.QuotaProject)
+	}
+	return nil
+}
+
+// runPreflight tests which features the caller's permissions allow on a project
+func runPreflight(ctx context.Context, args []string) error {
+	fs := newFlagSet("preflight")
+	project := fs.String("project", "", "GCP project ID (required)")
+	require := fs.String("require", "", "Exit with status 1 unless these comma-separated features are available, e.g. convert")
+	format := registerOutput(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *project == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "The -project flag is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	outputFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	required := splitList(*require)
+	for _, name := range required {
+		if _, err := api.FeatureByName(name); err != nil {
+			return err
+		}
+	}
+
+	session, err := connectSession()
+	if err != nil {
+		return err
+	}
+
+	report, err := api.Preflight(ctx, *project, nil, session.CRM)
+	if err != nil {
+		return err
+	}
+	report.Principal = session.ResolvePrincipal(ctx)
+
+	if outputFormat == output.Table {
+		api.DisplayPreflight(report, os.Stdout)
+	} else if err := output.Write(os.Stdout, outputFormat, report); err != nil {
+		return err
+	}
+
+	var unavailable []string
+	for _, name := range required {
+		if check, _ := report.Feature(name); !check.Available {
+			unavailable = append(unavailable, name)
+		}
+	}
+	if len(unavailable) > 0 {
+		return fmt.Errorf("required features are not available on project %s: %v", *project, unavailable)
+	}
+	return nil
+}
+
+// preflightConversion refuses to change disk licenses in a project where the caller lacks the
+// permissions to do so
+func preflightConversion(ctx context.Context, project string, session *auth.Session, skip bool) error {
+	return preflightFeature(ctx, project, api.ConvertFeature, "change disk licenses", session, skip)
+}
+
+// preflightFeature checks the permissions of a feature before it changes anything, in the same
+// way as preflightConversion. Permissions that cannot be tested at all also stop the command,
+// unless skip is set by an explicit -skip-preflight.
+func preflightFeature(ctx context.Context, project, feature, action string, session *auth.Session, skip bool) error {
+	if skip {
+		fmt.Fprintln(os.Stderr, "\nWarning: permission preflight skipped with -skip-preflight")
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "\nChecking permissions of %s on project %s...\n",
+		orUnknown(session.ResolvePrincipal(ctx)), project)
+	missing, err := api.PreflightFeature(ctx, project, feature, session.CRM)
+	if err != nil {
+		return fmt.Errorf("permissions on project %s could not be checked: %v; nothing was changed "+
+			"(-skip-preflight runs without the check)", project, err)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions on project %s: %s; nothing was changed",
+			project, strings.Join(missing, ", "))
+	}
+
+	fmt.Fprintf(os.Stderr, "All permissions needed to %s are granted.\n", action)
+	return nil
+}
+
+// orUnknown names an account that could not be determined
+func orUnknown(principal string) string {
+	if principal == "" {
+		return "the current account"
+	}
+	return principal
+}
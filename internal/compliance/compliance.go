@@ -0,0 +1,618 @@
+// Package compliance compares BYOS entitlements, such as Red Hat Cloud Access subscriptions,
+// with the BYOS instances and vCPUs actually deployed.
+package compliance
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gcp-instance-explorer/internal/api"
+
+	"google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Unentitled names the report entry for BYOS instances no entitlement covers
+const Unentitled = "(no entitlement)"
+
+// Entitlement is one subscription pool. A limit of zero means the pool does not limit it.
+type Entitlement struct {
+	Name           string   `yaml:"name" json:"name"`
+	Licenses       []string `yaml:"licenses" json:"licenses"` // project:code BYOS licenses the pool covers
+	VCPUs          int      `yaml:"vcpus,omitempty" json:"vcpus,omitempty"`
+	Sockets        int      `yaml:"sockets,omitempty" json:"sockets,omitempty"`
+	VCPUsPerSocket int      `yaml:"vcpusPerSocket,omitempty" json:"vcpusPerSocket,omitempty"` // vCPUs one socket covers
+	Instances      int      `yaml:"instances,omitempty" json:"instances,omitempty"`
+}
+
+// EntitledVCPUs is the number of vCPUs the pool covers, counting sockets as VCPUsPerSocket each
+func (e Entitlement) EntitledVCPUs() int {
+	return e.VCPUs + e.Sockets*e.VCPUsPerSocket
+}
+
+// covers reports whether the pool covers one of the licenses
+func (e Entitlement) covers(licenses []string) bool {
+	for _, license := range licenses {
+		for _, covered := range e.Licenses {
+			if license == covered {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Entitlements is an entitlements file
+type Entitlements struct {
+	VCPUs        map[string]int `yaml:"vcpus,omitempty"` // vCPU counts of machine types whose name does not tell
+	Entitlements []Entitlement  `yaml:"entitlements"`
+}
+
+// LoadEntitlements reads a YAML file, or a CSV file when the name ends in .csv. CSV files have a
+// header row naming the columns name, licenses, vcpus, sockets, vcpusPerSocket and instances;
+// several licenses in one cell are separated by semicolons.
+func LoadEntitlements(filename string) (*Entitlements, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading entitlements file: %v", err)
+	}
+
+	var entitlements *Entitlements
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		entitlements, err = parseCSV(data)
+	} else {
+		entitlements = &Entitlements{}
+		err = yaml.Unmarshal(data, entitlements)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing entitlements file %s: %v", filename, err)
+	}
+
+	if err := entitlements.validate(); err != nil {
+		return nil, fmt.Errorf("entitlements file %s: %v", filename, err)
+	}
+	return entitlements, nil
+}
+
+// parseCSV reads entitlements exported from a spreadsheet
+func parseCSV(data []byte) (*Entitlements, error) {
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no header row")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"name", "licenses"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing %s column", required)
+		}
+	}
+
+	cell := func(row []string, name string) string {
+		if i, ok := columns[strings.ToLower(name)]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	number := func(row []string, line int, name string) (int, error) {
+		value := cell(row, name)
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %s %q is not a number", line, name, value)
+		}
+		return n, nil
+	}
+
+	entitlements := &Entitlements{}
+	for n, row := range rows[1:] {
+		line := n + 2
+		entitlement := Entitlement{Name: cell(row, "name")}
+		for _, license := range strings.Split(cell(row, "licenses"), ";") {
+			if license = strings.TrimSpace(license); license != "" {
+				entitlement.Licenses = append(entitlement.Licenses, license)
+			}
+		}
+
+		var err error
+		if entitlement.VCPUs, err = number(row, line, "vcpus"); err != nil {
+			return nil, err
+		}
+		if entitlement.Sockets, err = number(row, line, "sockets"); err != nil {
+			return nil, err
+		}
+		if entitlement.VCPUsPerSocket, err = number(row, line, "vcpusPerSocket"); err != nil {
+			return nil, err
+		}
+		if entitlement.Instances, err = number(row, line, "instances"); err != nil {
+			return nil, err
+		}
+
+		entitlements.Entitlements = append(entitlements.Entitlements, entitlement)
+	}
+	return entitlements, nil
+}
+
+// validate checks every entitlement names its licenses and a limit
+func (e *Entitlements) validate() error {
+	if len(e.Entitlements) == 0 {
+		return fmt.Errorf("no entitlements")
+	}
+
+	for i, entitlement := range e.Entitlements {
+		name := entitlement.Name
+		if name == "" {
+			name = fmt.Sprintf("entitlement %d", i+1)
+		}
+
+		switch {
+		case len(entitlement.Licenses) == 0:
+			return fmt.Errorf("%s: no licenses", name)
+		case entitlement.Sockets > 0 && entitlement.VCPUsPerSocket <= 0:
+			return fmt.Errorf("%s: sockets need vcpusPerSocket", name)
+		case entitlement.VCPUs < 0 || entitlement.Sockets < 0 || entitlement.Instances < 0:
+			return fmt.Errorf("%s: limits cannot be negative", name)
+		case entitlement.EntitledVCPUs() == 0 && entitlement.Instances == 0:
+			return fmt.Errorf("%s: no vcpus, sockets or instances", name)
+		}
+
+		for _, license := range entitlement.Licenses {
+			if !strings.Contains(license, ":") {
+				return fmt.Errorf("%s: license %q must be project:code", name, license)
+			}
+		}
+	}
+	return nil
+}
+
+// machineVCPUs returns the vCPU count of a machine type, preferring the file's vcpus entries
+func (e *Entitlements) machineVCPUs(machineType string) (int, error) {
+	if vcpus, ok := e.VCPUs[machineType]; ok {
+		return vcpus, nil
+	}
+	return api.MachineTypeVCPUs(machineType)
+}
+
+// ResolveVCPUs looks up the vCPU count of machine types that neither the file nor their name
+// gives, and records it under VCPUs so Check counts it. Machine types that cannot be looked up
+// stay unknown and their errors are returned.
+func (e *Entitlements) ResolveVCPUs(ctx context.Context, instances []api.Instance, computeService *compute.Service) []error {
+	var errs []error
+	failed := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.MachineType == "" || failed[instance.MachineType] {
+			continue
+		}
+		if _, err := e.machineVCPUs(instance.MachineType); err == nil {
+			continue
+		}
+
+		vcpus, err := api.LookupMachineTypeVCPUs(ctx, instance.Project, instance.Zone, instance.MachineType, computeService)
+		if err != nil {
+			failed[instance.MachineType] = true
+			errs = append(errs, err)
+			continue
+		}
+		if e.VCPUs == nil {
+			e.VCPUs = make(map[string]int)
+		}
+		e.VCPUs[instance.MachineType] = vcpus
+	}
+	return errs
+}
+
+// InstanceUsage is one deployed instance counted against an entitlement
+type InstanceUsage struct {
+	Project     string   `yaml:"project" json:"project"`
+	Zone        string   `yaml:"zone" json:"zone"`
+	Name        string   `yaml:"name" json:"name"`
+	MachineType string   `yaml:"machineType" json:"machineType"`
+	Status      string   `yaml:"status" json:"status"`
+	VCPUs       int      `yaml:"vcpus" json:"vcpus"` // 0 when unknown
+	Licenses    []string `yaml:"licenses" json:"licenses"`
+}
+
+// EntitlementReport is the usage of one entitlement
+type EntitlementReport struct {
+	Name              string          `yaml:"name" json:"name"`
+	Licenses          []string        `yaml:"licenses" json:"licenses"`
+	EntitledVCPUs     int             `yaml:"entitledVcpus" json:"entitledVcpus"`         // 0 when vCPUs are not limited
+	EntitledInstances int             `yaml:"entitledInstances" json:"entitledInstances"` // 0 when instances are not limited
+	UsedVCPUs         int             `yaml:"usedVcpus" json:"usedVcpus"`
+	UsedInstances     int             `yaml:"usedInstances" json:"usedInstances"`
+	OveruseVCPUs      int             `yaml:"overuseVcpus" json:"overuseVcpus"`
+	OveruseInstances  int             `yaml:"overuseInstances" json:"overuseInstances"`
+	HeadroomVCPUs     int             `yaml:"headroomVcpus" json:"headroomVcpus"`
+	HeadroomInstances int             `yaml:"headroomInstances" json:"headroomInstances"`
+	Compliant         bool            `yaml:"compliant" json:"compliant"`
+	Indeterminate     bool            `yaml:"indeterminate,omitempty" json:"indeterminate,omitempty"` // vCPUs are limited but some counts are unknown
+	Instances         []InstanceUsage `yaml:"instances" json:"instances"`
+	UnknownVCPUs      []InstanceUsage `yaml:"unknownVcpus,omitempty" json:"unknownVcpus,omitempty"` // Counted as instances only
+	MoveToPAYG        []InstanceUsage `yaml:"moveToPayg,omitempty" json:"moveToPayg,omitempty"`     // Moving these restores compliance
+}
+
+// Report is the result of a compliance check
+type Report struct {
+	GeneratedAt  time.Time           `yaml:"generatedAt" json:"generatedAt"`
+	Projects     []string            `yaml:"projects" json:"projects"`
+	Compliant    bool                `yaml:"compliant" json:"compliant"`
+	Entitlements []EntitlementReport `yaml:"entitlements" json:"entitlements"`
+}
+
+// Check counts the instances carrying each entitlement's licenses. An instance is counted against
+// the first entitlement covering one of its licenses. BYOS instances no entitlement covers are
+// reported under Unentitled, where every one of them is out of compliance.
+func Check(instances []api.Instance, entitlements *Entitlements, projects []string) *Report {
+	report := &Report{GeneratedAt: time.Now().UTC(), Projects: projects, Compliant: true}
+
+	used := make([][]InstanceUsage, len(entitlements.Entitlements))
+	var unentitled []InstanceUsage
+	unentitledLicenses := make(map[string]bool)
+
+	for _, instance := range instances {
+		usage := InstanceUsage{
+			Project:     instance.Project,
+			Zone:        instance.Zone,
+			Name:        instance.Name,
+			MachineType: instance.MachineType,
+			Status:      instance.Status,
+			Licenses:    instanceLicenses(instance),
+		}
+		if vcpus, err := entitlements.machineVCPUs(instance.MachineType); err == nil {
+			usage.VCPUs = vcpus
+		}
+
+		matched := false
+		for i, entitlement := range entitlements.Entitlements {
+			if entitlement.covers(usage.Licenses) {
+				used[i] = append(used[i], usage)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		for _, license := range usage.Licenses {
+			if strings.HasSuffix(license, "-byos") {
+				unentitledLicenses[license] = true
+				matched = true
+			}
+		}
+		if matched {
+			unentitled = append(unentitled, usage)
+		}
+	}
+
+	for i, entitlement := range entitlements.Entitlements {
+		report.add(newEntitlementReport(entitlement.Name, entitlement.Licenses,
+			entitlement.EntitledVCPUs(), entitlement.Instances, used[i]))
+	}
+
+	if len(unentitled) > 0 {
+		var licenses []string
+		for license := range unentitledLicenses {
+			licenses = append(licenses, license)
+		}
+		sort.Strings(licenses)
+		report.add(newEntitlementReport(Unentitled, licenses, 0, 0, unentitled))
+	}
+
+	return report
+}
+
+// add appends an entitlement's usage and updates the overall result
+func (r *Report) add(entitlement EntitlementReport) {
+	r.Entitlements = append(r.Entitlements, entitlement)
+	if !entitlement.Compliant {
+		r.Compliant = false
+	}
+}
+
+// Overused returns the entitlements that are over one of their limits
+func (r *Report) Overused() []EntitlementReport {
+	var overused []EntitlementReport
+	for _, entitlement := range r.Entitlements {
+		if entitlement.OveruseVCPUs > 0 || entitlement.OveruseInstances > 0 {
+			overused = append(overused, entitlement)
+		}
+	}
+	return overused
+}
+
+// Indeterminate returns the entitlements whose vCPU limit could not be checked
+func (r *Report) Indeterminate() []EntitlementReport {
+	var indeterminate []EntitlementReport
+	for _, entitlement := range r.Entitlements {
+		if entitlement.Indeterminate {
+			indeterminate = append(indeterminate, entitlement)
+		}
+	}
+	return indeterminate
+}
+
+// Summary describes the overall result in one line
+func (r *Report) Summary() string {
+	if r.Compliant {
+		return fmt.Sprintf("All %d entitlements are within their limits.", len(r.Entitlements))
+	}
+
+	summary := fmt.Sprintf("%d of %d entitlements are overused", len(r.Overused()), len(r.Entitlements))
+	if indeterminate := len(r.Indeterminate()); indeterminate > 0 {
+		summary += fmt.Sprintf(", %d could not be checked because vCPU counts are unknown", indeterminate)
+	}
+	return summary + "."
+}
+
+// newEntitlementReport totals the usage of a pool and picks the instances to move to PAYG.
+// Zero limits are not enforced, except for Unentitled, which has no allowance at all.
+func newEntitlementReport(name string, licenses []string, entitledVCPUs, entitledInstances int,
+	instances []InstanceUsage) EntitlementReport {
+	report := EntitlementReport{
+		Name:              name,
+		Licenses:          licenses,
+		EntitledVCPUs:     entitledVCPUs,
+		EntitledInstances: entitledInstances,
+		UsedInstances:     len(instances),
+		Instances:         instances,
+	}
+	for _, instance := range instances {
+		report.UsedVCPUs += instance.VCPUs
+		if instance.VCPUs == 0 {
+			report.UnknownVCPUs = append(report.UnknownVCPUs, instance)
+		}
+	}
+
+	if name == Unentitled {
+		report.OveruseVCPUs = report.UsedVCPUs
+		report.OveruseInstances = report.UsedInstances
+		report.MoveToPAYG = instances
+	} else {
+		if entitledVCPUs > 0 {
+			report.HeadroomVCPUs = entitledVCPUs - report.UsedVCPUs
+		}
+		if entitledInstances > 0 {
+			report.HeadroomInstances = entitledInstances - report.UsedInstances
+		}
+		if report.HeadroomVCPUs < 0 {
+			report.OveruseVCPUs, report.HeadroomVCPUs = -report.HeadroomVCPUs, 0
+		}
+		if report.HeadroomInstances < 0 {
+			report.OveruseInstances, report.HeadroomInstances = -report.HeadroomInstances, 0
+		}
+		report.MoveToPAYG = pickMoves(instances, report.OveruseVCPUs, report.OveruseInstances)
+	}
+
+	report.Compliant = report.OveruseVCPUs == 0 && report.OveruseInstances == 0
+
+	// Instances of unknown size could hide overuse of a vCPU limit, so the pool cannot be called compliant
+	if report.Compliant && entitledVCPUs > 0 && len(report.UnknownVCPUs) > 0 {
+		report.Compliant = false
+		report.Indeterminate = true
+	}
+	return report
+}
+
+// pickMoves chooses instances whose move to PAYG removes the overuse. While vCPUs are over it
+// takes the smallest instance that covers the rest on its own, else the largest one; for
+// instance counts alone it takes the smallest. This keeps both moves and waste low. Instances
+// of unknown size cannot reduce vCPU overuse, but count like any other against an instance
+// limit, after the ones of known size.
+func pickMoves(instances []InstanceUsage, overVCPUs, overInstances int) []InstanceUsage {
+	candidates := append([]InstanceUsage{}, instances...)
+	sort.SliceStable(candidates, func(a, b int) bool {
+		va, vb := candidates[a].VCPUs, candidates[b].VCPUs
+		if (va == 0) != (vb == 0) {
+			return vb == 0
+		}
+		if va != vb {
+			return va < vb
+		}
+		return candidates[a].Project+"/"+candidates[a].Zone+"/"+candidates[a].Name <
+			candidates[b].Project+"/"+candidates[b].Zone+"/"+candidates[b].Name
+	})
+
+	var moves []InstanceUsage
+	for (overVCPUs > 0 || overInstances > 0) && len(candidates) > 0 {
+		pick := -1
+		if overVCPUs > 0 {
+			for i, candidate := range candidates {
+				if candidate.VCPUs == 0 {
+					continue
+				}
+				pick = i
+				if candidate.VCPUs >= overVCPUs {
+					break
+				}
+			}
+		}
+		if pick < 0 {
+			// Nothing of known size is left to lower the vCPUs; only the instance count can still improve
+			if overInstances <= 0 {
+				break
+			}
+			pick = 0
+		}
+
+		moves = append(moves, candidates[pick])
+		overVCPUs -= candidates[pick].VCPUs
+		overInstances--
+		candidates = append(candidates[:pick], candidates[pick+1:]...)
+	}
+	return moves
+}
+
+// instanceLicenses returns the licenses of every disk of an instance, without duplicates
+func instanceLicenses(instance api.Instance) []string {
+	var licenses []string
+	seen := make(map[string]bool)
+	add := func(license string) {
+		if !seen[license] {
+			seen[license] = true
+			licenses = append(licenses, license)
+		}
+	}
+
+	for _, license := range instance.LicenseCodes {
+		add(license)
+	}
+	for _, disk := range instance.Disks {
+		for _, license := range disk.Licenses {
+			add(license)
+		}
+	}
+	return licenses
+}
+
+// DisplayReport prints the usage of every entitlement and the instances to move to PAYG
+func DisplayReport(report *Report, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENTITLEMENT\tLICENSES\tVCPUS USED/ENTITLED\tHEADROOM\tINSTANCES USED/ENTITLED\tHEADROOM\tSTATUS")
+	for _, entitlement := range report.Entitlements {
+		status := "OK"
+		switch {
+		case entitlement.Indeterminate:
+			status = fmt.Sprintf("UNKNOWN: vCPUs of %d instances unknown", len(entitlement.UnknownVCPUs))
+		case !entitlement.Compliant:
+			status = fmt.Sprintf("OVERUSED by %d vCPUs, %d instances", entitlement.OveruseVCPUs, entitlement.OveruseInstances)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d/%s\t%s\t%d/%s\t%s\t%s\n",
+			entitlement.Name,
+			strings.Join(entitlement.Licenses, ", "),
+			entitlement.UsedVCPUs, limit(entitlement.EntitledVCPUs, entitlement.Name),
+			headroom(entitlement.HeadroomVCPUs, entitlement.EntitledVCPUs),
+			entitlement.UsedInstances, limit(entitlement.EntitledInstances, entitlement.Name),
+			headroom(entitlement.HeadroomInstances, entitlement.EntitledInstances),
+			status)
+	}
+	tw.Flush()
+
+	for _, entitlement := range report.Entitlements {
+		if len(entitlement.UnknownVCPUs) > 0 {
+			consequence := "they are counted as instances only"
+			if entitlement.EntitledVCPUs > 0 {
+				consequence = "so the vCPU limit cannot be checked; add their machine types under vcpus in the entitlements file"
+			}
+			fmt.Fprintf(w, "\n%s: vCPU count unknown for %d instances, %s:\n",
+				entitlement.Name, len(entitlement.UnknownVCPUs), consequence)
+			for _, instance := range entitlement.UnknownVCPUs {
+				fmt.Fprintf(w, "  - %s/%s/%s (%s)\n", instance.Project, instance.Zone, instance.Name, instance.MachineType)
+			}
+		}
+	}
+
+	for _, entitlement := range report.Overused() {
+		fmt.Fprintf(w, "\nMove to PAYG to bring %s back into compliance (%d instances):\n",
+			entitlement.Name, len(entitlement.MoveToPAYG))
+		for _, instance := range entitlement.MoveToPAYG {
+			fmt.Fprintf(w, "  - %s/%s/%s (%s, %d vCPUs)\n",
+				instance.Project, instance.Zone, instance.Name, instance.MachineType, instance.VCPUs)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%s\n", report.Summary())
+}
+
+// limit formats an entitlement limit; zero means unlimited except for Unentitled
+func limit(value int, name string) string {
+	if value == 0 && name != Unentitled {
+		return "unlimited"
+	}
+	return strconv.Itoa(value)
+}
+
+// headroom formats the room left under a limit
+func headroom(value, entitled int) string {
+	if entitled == 0 {
+		return "-"
+	}
+	return strconv.Itoa(value)
+}
+
+// WriteReport saves the report as JSON, or as YAML when the file name ends in .yml or .yaml
+func WriteReport(report *Report, filename string) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yml", ".yaml":
+		data, err = yaml.Marshal(report)
+	default:
+		data, err = json.MarshalIndent(report, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode compliance report: %v", err)
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write compliance report: %v", err)
+	}
+	return nil
+}
+
+// Columns returns the field names of an entitlement row
+func (r *Report) Columns() []string {
+	return []string{"name", "licenses", "entitledVcpus", "usedVcpus", "headroomVcpus", "overuseVcpus",
+		"entitledInstances", "usedInstances", "headroomInstances", "overuseInstances", "compliant", "indeterminate", "moveToPayg"}
+}
+
+// Rows returns one row per entitlement
+func (r *Report) Rows() [][]string {
+	rows := make([][]string, 0, len(r.Entitlements))
+	for _, entitlement := range r.Entitlements {
+		var moves []string
+		for _, instance := range entitlement.MoveToPAYG {
+			moves = append(moves, instance.Project+"/"+instance.Zone+"/"+instance.Name)
+		}
+		rows = append(rows, []string{
+			entitlement.Name,
+			strings.Join(entitlement.Licenses, ";"),
+			strconv.Itoa(entitlement.EntitledVCPUs),
+			strconv.Itoa(entitlement.UsedVCPUs),
+			strconv.Itoa(entitlement.HeadroomVCPUs),
+			strconv.Itoa(entitlement.OveruseVCPUs),
+			strconv.Itoa(entitlement.EntitledInstances),
+			strconv.Itoa(entitlement.UsedInstances),
+			strconv.Itoa(entitlement.HeadroomInstances),
+			strconv.Itoa(entitlement.OveruseInstances),
+			strconv.FormatBool(entitlement.Compliant),
+			strconv.FormatBool(entitlement.Indeterminate),
+			strings.Join(moves, ";"),
+		})
+	}
+	return rows
+}
+
+// Records returns the entitlements for NDJSON, JSON and YAML output
+func (r *Report) Records() []interface{} {
+	records := make([]interface{}, len(r.Entitlements))
+	for i := range r.Entitlements {
+		records[i] = r.Entitlements[i]
+	}
+	return records
+}
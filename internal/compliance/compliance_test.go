@@ -0,0 +1,126 @@
+package compliance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gcp-instance-explorer/internal/api"
+)
+
+func instance(name, machineType string, licenses ...string) api.Instance {
+	return api.Instance{Project: "proj", Zone: "us-central1-a", Name: name, MachineType: machineType, Status: "RUNNING", LicenseCodes: licenses}
+}
+
+func TestCheck(t *testing.T) {
+	entitlements := &Entitlements{Entitlements: []Entitlement{
+		{Name: "rhel-9", Licenses: []string{"rhel-cloud:rhel-9-byos"}, VCPUs: 10},
+		{Name: "rhel-8", Licenses: []string{"rhel-cloud:rhel-8-byos"}, Sockets: 2, VCPUsPerSocket: 4, Instances: 3},
+	}}
+
+	instances := []api.Instance{
+		instance("a", "n2-standard-8", "rhel-cloud:rhel-9-byos"),
+		instance("b", "n2-standard-4", "rhel-cloud:rhel-9-byos"),
+		instance("c", "n2-standard-2", "rhel-cloud:rhel-9-byos"),
+		instance("d", "e2-standard-2", "rhel-cloud:rhel-8-byos"),
+		instance("e", "e2-standard-2", "rhel-cloud:rhel-8-byos"),
+		instance("f", "a2-highgpu-1g", "rhel-cloud:rhel-8-byos"),
+		instance("g", "e2-standard-4", "rhel-cloud:rhel-7-byos"),
+		instance("h", "e2-standard-4", "rhel-cloud:rhel-9-server"),
+	}
+
+	report := Check(instances, entitlements, []string{"proj"})
+	if report.Compliant || len(report.Entitlements) != 3 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// 14 of 10 vCPUs used: moving the 4 vCPU instance is enough
+	rhel9 := report.Entitlements[0]
+	if rhel9.UsedVCPUs != 14 || rhel9.OveruseVCPUs != 4 || rhel9.Compliant {
+		t.Errorf("rhel-9 = %+v", rhel9)
+	}
+	if len(rhel9.MoveToPAYG) != 1 || rhel9.MoveToPAYG[0].Name != "b" {
+		t.Errorf("rhel-9 moves = %+v", rhel9.MoveToPAYG)
+	}
+
+	// 4 of 8 vCPUs are known; the a2 instance could use the rest, so the vCPU limit cannot be checked
+	rhel8 := report.Entitlements[1]
+	if rhel8.EntitledVCPUs != 8 || rhel8.UsedVCPUs != 4 || rhel8.HeadroomVCPUs != 4 || rhel8.UsedInstances != 3 ||
+		rhel8.HeadroomInstances != 0 || rhel8.Compliant || !rhel8.Indeterminate || len(rhel8.UnknownVCPUs) != 1 {
+		t.Errorf("rhel-8 = %+v", rhel8)
+	}
+	if len(report.Overused()) != 2 || len(report.Indeterminate()) != 1 {
+		t.Errorf("overused = %+v, indeterminate = %+v", report.Overused(), report.Indeterminate())
+	}
+
+	// With the a2 instance's vCPUs known the pool is over its vCPU limit
+	entitlements.VCPUs = map[string]int{"a2-highgpu-1g": 12}
+	rhel8 = Check(instances, entitlements, []string{"proj"}).Entitlements[1]
+	if rhel8.UsedVCPUs != 16 || rhel8.OveruseVCPUs != 8 || rhel8.Compliant || rhel8.Indeterminate {
+		t.Errorf("rhel-8 with known vCPUs = %+v", rhel8)
+	}
+
+	// BYOS licenses no entitlement covers are always overuse; PAYG instances are not counted
+	unentitled := report.Entitlements[2]
+	if unentitled.Name != Unentitled || unentitled.UsedInstances != 1 || len(unentitled.MoveToPAYG) != 1 ||
+		unentitled.MoveToPAYG[0].Name != "g" {
+		t.Errorf("unentitled = %+v", unentitled)
+	}
+}
+
+func TestPickMovesCoversInstanceOveruse(t *testing.T) {
+	instances := []InstanceUsage{{Name: "big", VCPUs: 16}, {Name: "small", VCPUs: 2}, {Name: "mid", VCPUs: 4}}
+
+	moves := pickMoves(instances, 20, 0)
+	if len(moves) != 2 || moves[0].Name != "big" || moves[1].Name != "mid" {
+		t.Errorf("vCPU moves = %+v", moves)
+	}
+
+	moves = pickMoves(instances, 0, 2)
+	if len(moves) != 2 || moves[0].Name != "small" || moves[1].Name != "mid" {
+		t.Errorf("instance moves = %+v", moves)
+	}
+
+	// Instances of unknown size still count against an instance limit, after the known ones
+	unknown := []InstanceUsage{{Name: "gpu"}, {Name: "small", VCPUs: 2}}
+	moves = pickMoves(unknown, 0, 2)
+	if len(moves) != 2 || moves[0].Name != "small" || moves[1].Name != "gpu" {
+		t.Errorf("instance moves with an unknown size = %+v", moves)
+	}
+	moves = pickMoves(unknown, 2, 0)
+	if len(moves) != 1 || moves[0].Name != "small" {
+		t.Errorf("vCPU moves with an unknown size = %+v", moves)
+	}
+}
+
+func TestLoadEntitlementsCSV(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "entitlements.csv")
+	data := "Name,Licenses,vCPUs,Sockets,vcpusPerSocket,Instances\n" +
+		"Premium,rhel-cloud:rhel-9-byos;rhel-cloud:rhel-8-byos,64,,,\n" +
+		"SAP,rhel-sap-cloud:rhel-9-sap-byos,,4,2,10\n"
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entitlements, err := LoadEntitlements(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entitlements.Entitlements) != 2 {
+		t.Fatalf("got %d entitlements", len(entitlements.Entitlements))
+	}
+	premium, sap := entitlements.Entitlements[0], entitlements.Entitlements[1]
+	if len(premium.Licenses) != 2 || premium.EntitledVCPUs() != 64 {
+		t.Errorf("premium = %+v", premium)
+	}
+	if sap.EntitledVCPUs() != 8 || sap.Instances != 10 {
+		t.Errorf("sap = %+v", sap)
+	}
+
+	if err := os.WriteFile(filename, []byte("name,licenses,sockets\nbad,rhel-cloud:rhel-9-byos,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadEntitlements(filename); err == nil {
+		t.Errorf("sockets without vcpusPerSocket were accepted")
+	}
+}
@@ -0,0 +1,286 @@
+// Package drift compares two instance exports, or an export with live state, and reports the
+// instances that were added or removed and the changes in status, machine type and licenses.
+package drift
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gcp-instance-explorer/internal/api"
+)
+
+// Kinds of change
+const (
+	Added       = "added"
+	Removed     = "removed"
+	Status      = "status"
+	MachineType = "machineType"
+	Licenses    = "licenses"
+)
+
+// Change is one difference between the before and after state of an instance
+type Change struct {
+	Project  string `yaml:"project,omitempty" json:"project,omitempty"`
+	Zone     string `yaml:"zone" json:"zone"`
+	Instance string `yaml:"instance" json:"instance"`
+	Kind     string `yaml:"change" json:"change"`
+	Disk     string `yaml:"disk,omitempty" json:"disk,omitempty"` // Disk whose licenses changed
+	Before   string `yaml:"before,omitempty" json:"before,omitempty"`
+	After    string `yaml:"after,omitempty" json:"after,omitempty"`
+	License  bool   `yaml:"licenseDrift" json:"licenseDrift"`
+}
+
+// Report lists every change between two states of the same instances
+type Report struct {
+	Before  string   `yaml:"before" json:"before"` // Where each state came from, such as a file name
+	After   string   `yaml:"after" json:"after"`
+	Changes []Change `yaml:"changes" json:"changes"`
+}
+
+// LicenseDrift returns the changes that count as license drift: changed licenses, and added
+// instances that carry licenses
+func (r *Report) LicenseDrift() []Change {
+	var drift []Change
+	for _, change := range r.Changes {
+		if change.License {
+			drift = append(drift, change)
+		}
+	}
+	return drift
+}
+
+// Compare reports the differences between two exports. Instances are matched by project, zone
+// and name; an entry without a project matches on zone and name alone.
+func Compare(before, after []api.InstanceExport, beforeSource, afterSource string) *Report {
+	report := &Report{Before: beforeSource, After: afterSource, Changes: []Change{}}
+
+	afterByKey := make(map[string]api.InstanceExport, len(after))
+	for _, instance := range after {
+		afterByKey[key(instance)] = instance
+	}
+
+	matched := make(map[string]bool)
+	for _, old := range before {
+		k := key(old)
+		current, ok := afterByKey[k]
+		if !ok && old.Project == "" {
+			current, k, ok = findByZoneName(after, old)
+		}
+		if !ok {
+			report.Changes = append(report.Changes, change(old, Removed, summary(old), "", false))
+			continue
+		}
+		matched[k] = true
+		report.Changes = append(report.Changes, compareInstance(old, current)...)
+	}
+
+	for _, instance := range after {
+		if matched[key(instance)] {
+			continue
+		}
+		licensed := len(instanceLicenses(instance)) > 0
+		report.Changes = append(report.Changes, change(instance, Added, "", summary(instance), licensed))
+	}
+
+	sort.SliceStable(report.Changes, func(a, b int) bool {
+		ca, cb := report.Changes[a], report.Changes[b]
+		if ca.Project != cb.Project {
+			return ca.Project < cb.Project
+		}
+		if ca.Zone != cb.Zone {
+			return ca.Zone < cb.Zone
+		}
+		return ca.Instance < cb.Instance
+	})
+	return report
+}
+
+// compareInstance reports the changes of one instance present in both states
+func compareInstance(before, after api.InstanceExport) []Change {
+	var changes []Change
+	if before.Status != after.Status {
+		changes = append(changes, change(after, Status, before.Status, after.Status, false))
+	}
+	if before.MachineType != after.MachineType {
+		changes = append(changes, change(after, MachineType, before.MachineType, after.MachineType, false))
+	}
+
+	// Older exports only carry the boot disk's licenses
+	if len(before.Disks) == 0 || len(after.Disks) == 0 {
+		if !sameSet(before.Licenses, after.Licenses) {
+			changes = append(changes, change(after, Licenses, licenseCell(before.Licenses), licenseCell(after.Licenses), true))
+		}
+		return changes
+	}
+
+	disks := make(map[string][2][]string)
+	var names []string
+	for i, instance := range []api.InstanceExport{before, after} {
+		for _, disk := range instance.Disks {
+			entry, seen := disks[disk.Name]
+			if !seen {
+				names = append(names, disk.Name)
+			}
+			entry[i] = disk.Licenses
+			disks[disk.Name] = entry
+		}
+	}
+	for _, name := range names {
+		entry := disks[name]
+		if !sameSet(entry[0], entry[1]) {
+			c := change(after, Licenses, licenseCell(entry[0]), licenseCell(entry[1]), true)
+			c.Disk = name
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// change builds a change of an instance
+func change(instance api.InstanceExport, kind, before, after string, license bool) Change {
+	return Change{
+		Project:  instance.Project,
+		Zone:     instance.Zone,
+		Instance: instance.Name,
+		Kind:     kind,
+		Before:   before,
+		After:    after,
+		License:  license,
+	}
+}
+
+// summary describes an added or removed instance
+func summary(instance api.InstanceExport) string {
+	return fmt.Sprintf("status=%s machineType=%s licenses=%s", instance.Status, instance.MachineType, licenseCell(instanceLicenses(instance)))
+}
+
+// instanceLicenses returns the licenses of every disk of an instance, without duplicates
+func instanceLicenses(instance api.InstanceExport) []string {
+	licenses := append([]string{}, instance.Licenses...)
+	for _, disk := range instance.Disks {
+		for _, license := range disk.Licenses {
+			if !contains(licenses, license) {
+				licenses = append(licenses, license)
+			}
+		}
+	}
+	return licenses
+}
+
+// findByZoneName finds the instance with the same zone and name as one without a project
+func findByZoneName(instances []api.InstanceExport, instance api.InstanceExport) (api.InstanceExport, string, bool) {
+	for _, candidate := range instances {
+		if candidate.Zone == instance.Zone && candidate.Name == instance.Name {
+			return candidate, key(candidate), true
+		}
+	}
+	return api.InstanceExport{}, "", false
+}
+
+// key identifies an instance across exports
+func key(instance api.InstanceExport) string {
+	return instance.Project + "/" + instance.Zone + "/" + instance.Name
+}
+
+// sameSet reports whether two license lists hold the same licenses in any order
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, license := range a {
+		if !contains(b, license) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// licenseCell joins licenses with ";" like every other list in a cell, or returns "none"
+func licenseCell(licenses []string) string {
+	if len(licenses) == 0 {
+		return "none"
+	}
+	sorted := append([]string{}, licenses...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ";")
+}
+
+// DisplayReport prints every change followed by a summary
+func DisplayReport(report *Report, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	fmt.Fprintf(w, "Comparing %s with %s\n\n", report.Before, report.After)
+	if len(report.Changes) == 0 {
+		fmt.Fprintln(w, "No drift.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tZONE\tINSTANCE\tCHANGE\tDISK\tBEFORE\tAFTER\tLICENSE DRIFT")
+	for _, change := range report.Changes {
+		drift := ""
+		if change.License {
+			drift = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			orDash(change.Project), change.Zone, change.Instance, change.Kind, orDash(change.Disk),
+			orDash(change.Before), orDash(change.After), drift)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d changes, %d with license drift\n", len(report.Changes), len(report.LicenseDrift()))
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Columns returns the field names of a change
+func (r *Report) Columns() []string {
+	return []string{"project", "zone", "instance", "change", "disk", "before", "after", "licenseDrift"}
+}
+
+// Rows returns one row per change
+func (r *Report) Rows() [][]string {
+	rows := make([][]string, 0, len(r.Changes))
+	for _, change := range r.Changes {
+		rows = append(rows, []string{
+			change.Project,
+			change.Zone,
+			change.Instance,
+			change.Kind,
+			change.Disk,
+			change.Before,
+			change.After,
+			fmt.Sprintf("%t", change.License),
+		})
+	}
+	return rows
+}
+
+// Records returns one record per change
+func (r *Report) Records() []interface{} {
+	records := make([]interface{}, len(r.Changes))
+	for i := range r.Changes {
+		records[i] = r.Changes[i]
+	}
+	return records
+}
@@ -0,0 +1,71 @@
+package drift
+
+import (
+	"strings"
+	"testing"
+
+	"gcp-instance-explorer/internal/api"
+)
+
+func export(name, status, machineType string, licenses ...string) api.InstanceExport {
+	return api.InstanceExport{
+		Project:     "proj",
+		Zone:        "us-central1-a",
+		Name:        name,
+		Status:      status,
+		MachineType: machineType,
+		Licenses:    licenses,
+		Disks:       []api.DiskExport{{Name: name, Boot: true, Licenses: licenses}},
+	}
+}
+
+func TestCompare(t *testing.T) {
+	before := []api.InstanceExport{
+		export("same", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-server"),
+		export("stopped", "RUNNING", "e2-standard-2"),
+		export("resized", "RUNNING", "e2-standard-2"),
+		export("converted", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-server"),
+		export("deleted", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-byos"),
+	}
+	after := []api.InstanceExport{
+		export("same", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-server"),
+		export("stopped", "TERMINATED", "e2-standard-2"),
+		export("resized", "RUNNING", "n2-standard-8"),
+		export("converted", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-byos"),
+		export("new-byos", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-byos"),
+		export("new-debian", "RUNNING", "e2-standard-2"),
+	}
+
+	report := Compare(before, after, "old.yml", "new.yml")
+
+	var got []string
+	for _, change := range report.Changes {
+		got = append(got, change.Instance+"="+change.Kind)
+	}
+	want := "converted=licenses,deleted=removed,new-byos=added,new-debian=added,resized=machineType,stopped=status"
+	if strings.Join(got, ",") != want {
+		t.Errorf("changes = %v, want %s", got, want)
+	}
+
+	var drifted []string
+	for _, change := range report.LicenseDrift() {
+		drifted = append(drifted, change.Instance)
+	}
+	if strings.Join(drifted, ",") != "converted,new-byos" {
+		t.Errorf("license drift = %v, want converted and new-byos", drifted)
+	}
+	if c := report.Changes[0]; c.Disk != "converted" || c.Before != "rhel-cloud:rhel-9-server" || c.After != "rhel-cloud:rhel-9-byos" {
+		t.Errorf("license change = %+v", c)
+	}
+}
+
+func TestCompareMatchesEntriesWithoutProject(t *testing.T) {
+	old := export("web", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-byos")
+	old.Project = ""
+	old.Disks = nil
+
+	report := Compare([]api.InstanceExport{old}, []api.InstanceExport{export("web", "RUNNING", "e2-standard-2", "rhel-cloud:rhel-9-byos")}, "a", "b")
+	if len(report.Changes) != 0 {
+		t.Errorf("changes = %+v, want none", report.Changes)
+	}
+}
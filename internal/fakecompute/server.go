@@ -0,0 +1,1122 @@
+// Package fakecompute is an in-process fake of the parts of the Compute Engine API this tool uses.
+// It keeps instances, disks and operations in memory so the list, export, convert and verify
+// flows can run offline in tests. It also answers Resource Manager permission tests and lists
+// projects and folders.
+package fakecompute
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// selfLinkBase is used for self links so resource names parse the same way as real ones
+const selfLinkBase = "https://www.googleapis.com/compute/v1/"
+
+// Server serves the v1 instances, disks, machine types, images, snapshots, instance templates,
+// instance group managers and operations endpoints, the alpha disk PATCH and Resource Manager's
+// projects.testIamPermissions
+type Server struct {
+	URL string // Base URL of the fake, without a trailing slash
+
+	server *httptest.Server
+
+	mu           sync.Mutex
+	instances    map[string]*compute.Instance
+	disks        map[string]*compute.Disk
+	images       map[string]*compute.Image
+	snapshots    map[string]*compute.Snapshot
+	templates    map[string]*compute.InstanceTemplate
+	managers     map[string]*compute.InstanceGroupManager
+	machineTypes map[string]*compute.MachineType
+	operations   map[string]*compute.Operation
+	failPatches  map[string]string
+	denied       map[string]bool
+	requests     []string
+	filters      []string
+	nextOp       int
+	nextID       uint64
+
+	// Operations stay RUNNING for this many polls before they report DONE
+	operationPolls int
+	pendingPolls   map[string]int
+	rejectFilters  bool
+
+	// Permission tests fail with 403, as when the Resource Manager API is disabled
+	failPermissionTests bool
+
+	// Resource Manager projects and folders, in the order they were added
+	projects      []*cloudresourcemanager.Project
+	folders       []*crmv2.Folder
+	failedFolders map[string]bool
+}
+
+// NewServer starts a fake with no resources. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		instances:    make(map[string]*compute.Instance),
+		disks:        make(map[string]*compute.Disk),
+		images:       make(map[string]*compute.Image),
+		snapshots:    make(map[string]*compute.Snapshot),
+		templates:    make(map[string]*compute.InstanceTemplate),
+		managers:     make(map[string]*compute.InstanceGroupManager),
+		machineTypes: make(map[string]*compute.MachineType),
+		operations:   make(map[string]*compute.Operation),
+		failPatches:  make(map[string]string),
+		denied:       make(map[string]bool),
+		pendingPolls: make(map[string]int),
+
+		failedFolders: make(map[string]bool),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the fake down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// ComputeService returns a compute.Service that talks to the fake without credentials
+func (s *Server) ComputeService(ctx context.Context) (*compute.Service, error) {
+	return compute.NewService(ctx,
+		option.WithEndpoint(s.URL+"/compute/v1/"),
+		option.WithHTTPClient(s.server.Client()))
+}
+
+// ResourceManagerService returns a Resource Manager client that talks to the fake without credentials
+func (s *Server) ResourceManagerService(ctx context.Context) (*cloudresourcemanager.Service, error) {
+	return cloudresourcemanager.NewService(ctx,
+		option.WithEndpoint(s.URL+"/crm/"),
+		option.WithHTTPClient(s.server.Client()))
+}
+
+// FoldersService returns a Resource Manager v2 client for folders that talks to the fake
+func (s *Server) FoldersService(ctx context.Context) (*crmv2.Service, error) {
+	return crmv2.NewService(ctx,
+		option.WithEndpoint(s.URL+"/crm/"),
+		option.WithHTTPClient(s.server.Client()))
+}
+
+// AlphaEndpoint is the base URL to pass to api.SetAlphaEndpoint
+func (s *Server) AlphaEndpoint() string {
+	return s.URL + "/compute/alpha/"
+}
+
+// HTTPClient is the client to pass to api.SetAlphaEndpoint
+func (s *Server) HTTPClient() *http.Client {
+	return s.server.Client()
+}
+
+// AddDisk stores a disk. Name is required; the self link and zone are filled in.
+func (s *Server) AddDisk(project, zone string, disk *compute.Disk) {
+	stored := clone(disk)
+	stored.Zone = zoneURL(project, zone)
+	stored.SelfLink = fmt.Sprintf("%s/disks/%s", stored.Zone, stored.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored.Id == 0 {
+		s.nextID++
+		stored.Id = s.nextID
+	}
+	s.disks[key(project, zone, disk.Name)] = stored
+}
+
+// AddImage stores a global image. Name is required; the self link is filled in.
+func (s *Server) AddImage(project string, image *compute.Image) {
+	stored := clone(image)
+	stored.SelfLink = fmt.Sprintf("%sprojects/%s/global/images/%s", selfLinkBase, project, stored.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored.Id == 0 {
+		s.nextID++
+		stored.Id = s.nextID
+	}
+	s.images[project+"/"+stored.Name] = stored
+}
+
+// AddSnapshot stores a snapshot. Name is required; the self link is filled in.
+func (s *Server) AddSnapshot(project string, snapshot *compute.Snapshot) {
+	stored := clone(snapshot)
+	stored.SelfLink = fmt.Sprintf("%sprojects/%s/global/snapshots/%s", selfLinkBase, project, stored.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored.Id == 0 {
+		s.nextID++
+		stored.Id = s.nextID
+	}
+	s.snapshots[project+"/"+stored.Name] = stored
+}
+
+// AddTemplate stores a global instance template. Name is required; the self link is filled in.
+func (s *Server) AddTemplate(project string, template *compute.InstanceTemplate) {
+	stored := clone(template)
+	stored.SelfLink = templateURL(project, stored.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored.Id == 0 {
+		s.nextID++
+		stored.Id = s.nextID
+	}
+	s.templates[project+"/"+stored.Name] = stored
+}
+
+// AddInstanceGroupManager stores a zonal managed instance group. Name is required; the self link
+// and zone are filled in.
+func (s *Server) AddInstanceGroupManager(project, zone string, manager *compute.InstanceGroupManager) {
+	stored := clone(manager)
+	stored.Zone = zoneURL(project, zone)
+	stored.SelfLink = fmt.Sprintf("%s/instanceGroupManagers/%s", stored.Zone, stored.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.managers[key(project, zone, stored.Name)] = stored
+}
+
+// AddInstance stores an instance. Attached disks refer to disks added with AddDisk by their
+// Source, which may be a bare disk name. Status defaults to RUNNING.
+func (s *Server) AddInstance(project, zone string, instance *compute.Instance) {
+	stored := clone(instance)
+	stored.Zone = zoneURL(project, zone)
+	stored.SelfLink = fmt.Sprintf("%s/instances/%s", stored.Zone, stored.Name)
+	if stored.Status == "" {
+		stored.Status = "RUNNING"
+	}
+	if stored.CreationTimestamp == "" {
+		stored.CreationTimestamp = "2025-01-01T00:00:00.000-08:00"
+	}
+	if stored.Metadata == nil {
+		stored.Metadata = &compute.Metadata{}
+	}
+	if stored.Metadata.Fingerprint == "" {
+		stored.Metadata.Fingerprint = "fp-0"
+	}
+	for _, attached := range stored.Disks {
+		if !strings.Contains(attached.Source, "/") {
+			attached.Source = fmt.Sprintf("%s/disks/%s", stored.Zone, attached.Source)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored.Id == 0 {
+		s.nextID++
+		stored.Id = s.nextID
+	}
+	s.instances[key(project, zone, instance.Name)] = stored
+}
+
+// DeleteInstance removes a stored instance, leaving its disks
+func (s *Server) DeleteInstance(project, zone, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, key(project, zone, name))
+}
+
+// Instance returns a copy of a stored instance, or nil
+func (s *Server) Instance(project, zone, name string) *compute.Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instance, ok := s.instances[key(project, zone, name)]
+	if !ok {
+		return nil
+	}
+	return s.withDiskLicenses(instance)
+}
+
+// Disk returns a copy of a stored disk, or nil
+func (s *Server) Disk(project, zone, name string) *compute.Disk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	disk, ok := s.disks[key(project, zone, name)]
+	if !ok {
+		return nil
+	}
+	return clone(disk)
+}
+
+// Image returns a copy of a stored image, or nil
+func (s *Server) Image(project, name string) *compute.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image, ok := s.images[project+"/"+name]
+	if !ok {
+		return nil
+	}
+	return clone(image)
+}
+
+// Template returns a copy of a stored instance template, or nil
+func (s *Server) Template(project, name string) *compute.InstanceTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template, ok := s.templates[project+"/"+name]
+	if !ok {
+		return nil
+	}
+	return clone(template)
+}
+
+// AddMachineType stores a machine type of a zone. Name is required.
+func (s *Server) AddMachineType(project, zone string, machineType *compute.MachineType) {
+	stored := clone(machineType)
+	stored.Zone = zone
+	stored.SelfLink = fmt.Sprintf("%s/machineTypes/%s", zoneURL(project, zone), stored.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.machineTypes[key(project, zone, stored.Name)] = stored
+}
+
+// FailDiskPatch makes license updates of a disk finish with an operation error, leaving it
+// unchanged. An empty message lets updates succeed again.
+func (s *Server) FailDiskPatch(project, zone, disk, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPatches[key(project, zone, disk)] = message
+}
+
+// DenyPermission makes permission tests on a project report a permission as not granted.
+// Every other permission is granted.
+func (s *Server) DenyPermission(project, permission string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[project+"/"+permission] = true
+}
+
+// AddProject adds a project to projects.list. parent is "folders/ID", "organizations/ID" or ""
+// and state is the lifecycle state, ACTIVE when empty.
+func (s *Server) AddProject(id, parent, state string) {
+	if state == "" {
+		state = "ACTIVE"
+	}
+	project := &cloudresourcemanager.Project{ProjectId: id, Name: id, LifecycleState: state}
+	if parentType, parentID, ok := strings.Cut(parent, "s/"); ok {
+		project.Parent = &cloudresourcemanager.ResourceId{Type: parentType, Id: parentID}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.projects = append(s.projects, project)
+}
+
+// AddFolder adds an active folder under parent, "folders/ID" or "organizations/ID"
+func (s *Server) AddFolder(id, parent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.folders = append(s.folders, &crmv2.Folder{Name: "folders/" + id, Parent: parent, LifecycleState: "ACTIVE"})
+}
+
+// FailFolder makes listing the projects or sub-folders of a folder fail with 403
+func (s *Server) FailFolder(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedFolders[id] = true
+}
+
+// FailPermissionTests makes every permission test fail, so permissions cannot be checked at all
+func (s *Server) FailPermissionTests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPermissionTests = true
+}
+
+// DelayOperations makes every new operation report RUNNING for the given number of polls
+// before it reports DONE. Changes are still applied when the request is served.
+func (s *Server) DelayOperations(polls int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operationPolls = polls
+}
+
+// RejectFilters makes instance lists with a filter fail with 400, the way the API answers a
+// filter it cannot parse
+func (s *Server) RejectFilters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectFilters = true
+}
+
+// Filters returns the filter of every instance aggregatedList served so far, in order; ""
+// stands for a request without a filter
+func (s *Server) Filters() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.filters...)
+}
+
+// Requests returns "METHOD path" for every request served so far, in order
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// handle routes a request by API version and path
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	var version string
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/compute/v1/"):
+		version, path = "v1", strings.TrimPrefix(path, "/compute/v1/")
+	case strings.HasPrefix(path, "/compute/alpha/"):
+		version, path = "alpha", strings.TrimPrefix(path, "/compute/alpha/")
+	case path == "/crm/v1/projects" && r.Method == http.MethodGet:
+		s.listProjects(w, r.URL.Query().Get("filter"))
+		return
+	case path == "/crm/v2/folders" && r.Method == http.MethodGet:
+		s.listFolders(w, r.URL.Query().Get("parent"))
+		return
+	case strings.HasPrefix(path, "/crm/v1/projects/") && strings.HasSuffix(path, ":testIamPermissions") && r.Method == http.MethodPost:
+		project := strings.TrimSuffix(strings.TrimPrefix(path, "/crm/v1/projects/"), ":testIamPermissions")
+		s.testPermissions(w, r, project)
+		return
+	default:
+		writeError(w, http.StatusNotFound, "unknown API path %s", r.URL.Path)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "projects" {
+		writeError(w, http.StatusNotFound, "unknown resource %s", r.URL.Path)
+		return
+	}
+	project := parts[1]
+	parts = parts[2:]
+
+	switch {
+	case version == "v1" && r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "aggregated" && parts[1] == "instances":
+		s.aggregatedInstances(w, project, r.URL.Query().Get("filter"))
+	case version == "v1" && r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "aggregated" && parts[1] == "disks":
+		s.aggregatedDisks(w, project)
+	case version == "v1" && r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "aggregated" && parts[1] == "instanceGroupManagers":
+		s.aggregatedManagers(w, project)
+	case version == "v1" && len(parts) >= 2 && parts[0] == "global":
+		s.handleGlobal(w, r, project, parts[1:])
+	case version == "v1" && r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "zones" && parts[2] == "disks":
+		s.insertDisk(w, r, project, parts[1])
+	case len(parts) >= 4 && parts[0] == "zones":
+		s.handleZonal(w, r, version, project, parts[1], parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, "unknown resource %s", r.URL.Path)
+	}
+}
+
+// handleZonal serves instances, disks and operations inside a zone
+func (s *Server) handleZonal(w http.ResponseWriter, r *http.Request, version, project, zone string, parts []string) {
+	collection, name := parts[0], parts[1]
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	} else if len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "unknown resource %s", r.URL.Path)
+		return
+	}
+
+	switch {
+	case version == "v1" && collection == "instances" && r.Method == http.MethodGet && action == "":
+		s.getInstance(w, project, zone, name)
+	case version == "v1" && collection == "instances" && r.Method == http.MethodPost && action == "start":
+		s.setStatus(w, project, zone, name, "start", "RUNNING")
+	case version == "v1" && collection == "instances" && r.Method == http.MethodPost && action == "stop":
+		s.setStatus(w, project, zone, name, "stop", "TERMINATED")
+	case version == "v1" && collection == "instances" && r.Method == http.MethodPost && action == "setMetadata":
+		s.setMetadata(w, r, project, zone, name)
+	case version == "v1" && collection == "machineTypes" && r.Method == http.MethodGet && action == "":
+		s.getMachineType(w, project, zone, name)
+	case version == "v1" && collection == "disks" && r.Method == http.MethodGet && action == "":
+		s.getDisk(w, project, zone, name)
+	case version == "v1" && collection == "disks" && r.Method == http.MethodDelete && action == "":
+		s.deleteDisk(w, project, zone, name)
+	case version == "alpha" && collection == "disks" && r.Method == http.MethodPatch && action == "":
+		s.patchDisk(w, r, project, zone, name)
+	case version == "v1" && collection == "operations" && r.Method == http.MethodGet && action == "",
+		version == "v1" && collection == "operations" && r.Method == http.MethodPost && action == "wait":
+		s.getOperation(w, project, zone, name)
+	default:
+		writeError(w, http.StatusNotFound, "unsupported %s on %s", r.Method, r.URL.Path)
+	}
+}
+
+// handleGlobal serves images, snapshots, instance templates and global operations
+func (s *Server) handleGlobal(w http.ResponseWriter, r *http.Request, project string, parts []string) {
+	collection := parts[0]
+	switch {
+	case collection == "images" && r.Method == http.MethodGet && len(parts) == 1:
+		s.listImages(w, project)
+	case collection == "images" && r.Method == http.MethodPost && len(parts) == 1:
+		s.insertImage(w, r, project)
+	case collection == "images" && r.Method == http.MethodGet && len(parts) == 2:
+		s.getImage(w, project, parts[1])
+	case collection == "images" && r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "family":
+		s.getImageFromFamily(w, project, parts[2])
+	case collection == "snapshots" && r.Method == http.MethodGet && len(parts) == 1:
+		s.listSnapshots(w, project)
+	case collection == "instanceTemplates" && r.Method == http.MethodGet && len(parts) == 1:
+		s.listTemplates(w, project)
+	case collection == "instanceTemplates" && r.Method == http.MethodPost && len(parts) == 1:
+		s.insertTemplate(w, r, project)
+	case collection == "instanceTemplates" && r.Method == http.MethodGet && len(parts) == 2:
+		s.getTemplate(w, project, parts[1])
+	case collection == "operations" && len(parts) == 2 && r.Method == http.MethodGet,
+		collection == "operations" && len(parts) == 3 && r.Method == http.MethodPost && parts[2] == "wait":
+		s.getOperation(w, project, "global", parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "unsupported %s on %s", r.Method, r.URL.Path)
+	}
+}
+
+// aggregatedInstances lists the instances of a project grouped by zone. A filter made of
+// (field = "value") terms on name, status and labels.KEY is applied; anything else is a 400.
+func (s *Server) aggregatedInstances(w http.ResponseWriter, project, filter string) {
+	s.filters = append(s.filters, filter)
+
+	var terms []filterTerm
+	if filter != "" {
+		var err error
+		if terms, err = parseFilter(filter); err != nil || s.rejectFilters {
+			if err == nil {
+				err = fmt.Errorf("filters are rejected")
+			}
+			writeError(w, http.StatusBadRequest, "Invalid value for field 'filter': '%s'. %v", filter, err)
+			return
+		}
+	}
+
+	list := &compute.InstanceAggregatedList{
+		Kind:  "compute#instanceAggregatedList",
+		Items: make(map[string]compute.InstancesScopedList),
+	}
+
+	var keys []string
+	for k := range s.instances {
+		if strings.HasPrefix(k, project+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !matchesFilter(s.instances[k], terms) {
+			continue
+		}
+		instance := s.withDiskLicenses(s.instances[k])
+		scope := "zones/" + lastSegment(instance.Zone)
+		scoped := list.Items[scope]
+		scoped.Instances = append(scoped.Instances, instance)
+		list.Items[scope] = scoped
+	}
+
+	writeJSON(w, list)
+}
+
+// aggregatedDisks lists every disk of a project grouped by zone
+func (s *Server) aggregatedDisks(w http.ResponseWriter, project string) {
+	list := &compute.DiskAggregatedList{
+		Kind:  "compute#diskAggregatedList",
+		Items: make(map[string]compute.DisksScopedList),
+	}
+
+	var keys []string
+	for k := range s.disks {
+		if strings.HasPrefix(k, project+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		disk := s.withUsers(s.disks[k])
+		scope := "zones/" + lastSegment(disk.Zone)
+		scoped := list.Items[scope]
+		scoped.Disks = append(scoped.Disks, disk)
+		list.Items[scope] = scoped
+	}
+
+	writeJSON(w, list)
+}
+
+// listImages lists the global images of a project
+func (s *Server) listImages(w http.ResponseWriter, project string) {
+	list := &compute.ImageList{Kind: "compute#imageList"}
+	for _, k := range sortedKeys(s.images, project) {
+		list.Items = append(list.Items, clone(s.images[k]))
+	}
+	writeJSON(w, list)
+}
+
+// getImage returns one global image
+func (s *Server) getImage(w http.ResponseWriter, project, name string) {
+	image, ok := s.images[project+"/"+name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/global/images/%s' was not found", project, name)
+		return
+	}
+	writeJSON(w, clone(image))
+}
+
+// getImageFromFamily returns the newest image of a family, taking the last one by name
+func (s *Server) getImageFromFamily(w http.ResponseWriter, project, family string) {
+	var newest *compute.Image
+	for _, k := range sortedKeys(s.images, project) {
+		if image := s.images[k]; image.Family == family {
+			newest = image
+		}
+	}
+	if newest == nil {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/global/images/family/%s' was not found", project, family)
+		return
+	}
+	writeJSON(w, clone(newest))
+}
+
+// insertImage creates an image from a disk, which passes on its licenses
+func (s *Server) insertImage(w http.ResponseWriter, r *http.Request, project string) {
+	var image compute.Image
+	if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid image: %v", err)
+		return
+	}
+	if _, exists := s.images[project+"/"+image.Name]; exists {
+		writeError(w, http.StatusConflict, "The resource 'projects/%s/global/images/%s' already exists", project, image.Name)
+		return
+	}
+
+	diskProject, diskZone, diskName := splitDiskURL(image.SourceDisk)
+	disk, ok := s.disks[key(diskProject, diskZone, diskName)]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "source disk %q was not found", image.SourceDisk)
+		return
+	}
+	image.Licenses = append(append([]string{}, disk.Licenses...), image.Licenses...)
+	image.DiskSizeGb = disk.SizeGb
+	image.Status = "READY"
+	image.SelfLink = fmt.Sprintf("%sprojects/%s/global/images/%s", selfLinkBase, project, image.Name)
+	s.nextID++
+	image.Id = s.nextID
+	s.images[project+"/"+image.Name] = &image
+
+	writeJSON(w, s.newOperation(project, "", "insert", image.SelfLink, ""))
+}
+
+// listSnapshots lists the snapshots of a project
+func (s *Server) listSnapshots(w http.ResponseWriter, project string) {
+	list := &compute.SnapshotList{Kind: "compute#snapshotList"}
+	for _, k := range sortedKeys(s.snapshots, project) {
+		list.Items = append(list.Items, clone(s.snapshots[k]))
+	}
+	writeJSON(w, list)
+}
+
+// listProjects serves projects.list with filters of space-separated parent.type:, parent.id: and
+// lifecycleState: terms, the only ones the tool sends
+func (s *Server) listProjects(w http.ResponseWriter, filter string) {
+	terms := make(map[string]string)
+	for _, term := range strings.Fields(filter) {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok || (field != "parent.type" && field != "parent.id" && field != "lifecycleState") {
+			writeError(w, http.StatusBadRequest, "unsupported filter term %q", term)
+			return
+		}
+		terms[field] = value
+	}
+	if terms["parent.type"] == "folder" && s.failedFolders[terms["parent.id"]] {
+		writeError(w, http.StatusForbidden, "The caller does not have permission on folders/%s", terms["parent.id"])
+		return
+	}
+
+	resp := &cloudresourcemanager.ListProjectsResponse{}
+	for _, project := range s.projects {
+		var parentType, parentID string
+		if project.Parent != nil {
+			parentType, parentID = project.Parent.Type, project.Parent.Id
+		}
+		if (terms["parent.type"] != "" && terms["parent.type"] != parentType) ||
+			(terms["parent.id"] != "" && terms["parent.id"] != parentID) ||
+			(terms["lifecycleState"] != "" && terms["lifecycleState"] != project.LifecycleState) {
+			continue
+		}
+		resp.Projects = append(resp.Projects, project)
+	}
+	writeJSON(w, resp)
+}
+
+// listFolders serves folders.list for a parent
+func (s *Server) listFolders(w http.ResponseWriter, parent string) {
+	if s.failedFolders[strings.TrimPrefix(parent, "folders/")] {
+		writeError(w, http.StatusForbidden, "The caller does not have permission on %s", parent)
+		return
+	}
+
+	resp := &crmv2.ListFoldersResponse{}
+	for _, folder := range s.folders {
+		if folder.Parent == parent {
+			resp.Folders = append(resp.Folders, folder)
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// testPermissions grants every requested permission that was not denied
+func (s *Server) testPermissions(w http.ResponseWriter, r *http.Request, project string) {
+	if s.failPermissionTests {
+		writeError(w, http.StatusForbidden, "Cloud Resource Manager API has not been used in project %s or it is disabled", project)
+		return
+	}
+
+	var req cloudresourcemanager.TestIamPermissionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+
+	resp := &cloudresourcemanager.TestIamPermissionsResponse{}
+	for _, permission := range req.Permissions {
+		if !s.denied[project+"/"+permission] {
+			resp.Permissions = append(resp.Permissions, permission)
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// listTemplates lists the global instance templates of a project
+func (s *Server) listTemplates(w http.ResponseWriter, project string) {
+	list := &compute.InstanceTemplateList{Kind: "compute#instanceTemplateList"}
+	for _, k := range sortedKeys(s.templates, project) {
+		list.Items = append(list.Items, clone(s.templates[k]))
+	}
+	writeJSON(w, list)
+}
+
+// getTemplate returns one global instance template
+func (s *Server) getTemplate(w http.ResponseWriter, project, name string) {
+	template, ok := s.templates[project+"/"+name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/global/instanceTemplates/%s' was not found", project, name)
+		return
+	}
+	writeJSON(w, clone(template))
+}
+
+// insertTemplate creates a global instance template
+func (s *Server) insertTemplate(w http.ResponseWriter, r *http.Request, project string) {
+	var template compute.InstanceTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid instance template: %v", err)
+		return
+	}
+	if _, exists := s.templates[project+"/"+template.Name]; exists {
+		writeError(w, http.StatusConflict, "The resource 'projects/%s/global/instanceTemplates/%s' already exists", project, template.Name)
+		return
+	}
+
+	template.SelfLink = templateURL(project, template.Name)
+	s.nextID++
+	template.Id = s.nextID
+	s.templates[project+"/"+template.Name] = &template
+
+	writeJSON(w, s.newOperation(project, "", "insert", template.SelfLink, ""))
+}
+
+// aggregatedManagers lists every managed instance group of a project grouped by zone
+func (s *Server) aggregatedManagers(w http.ResponseWriter, project string) {
+	list := &compute.InstanceGroupManagerAggregatedList{
+		Kind:  "compute#instanceGroupManagerAggregatedList",
+		Items: make(map[string]compute.InstanceGroupManagersScopedList),
+	}
+
+	for _, k := range sortedKeys(s.managers, project) {
+		manager := clone(s.managers[k])
+		scope := "zones/" + lastSegment(manager.Zone)
+		scoped := list.Items[scope]
+		scoped.InstanceGroupManagers = append(scoped.InstanceGroupManagers, manager)
+		list.Items[scope] = scoped
+	}
+
+	writeJSON(w, list)
+}
+
+func (s *Server) getInstance(w http.ResponseWriter, project, zone, name string) {
+	instance, ok := s.instances[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/instances/%s' was not found", project, zone, name)
+		return
+	}
+	writeJSON(w, s.withDiskLicenses(instance))
+}
+
+func (s *Server) setStatus(w http.ResponseWriter, project, zone, name, operationType, status string) {
+	instance, ok := s.instances[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/instances/%s' was not found", project, zone, name)
+		return
+	}
+	instance.Status = status
+	writeJSON(w, s.newOperation(project, zone, operationType, instance.SelfLink, ""))
+}
+
+func (s *Server) setMetadata(w http.ResponseWriter, r *http.Request, project, zone, name string) {
+	instance, ok := s.instances[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/instances/%s' was not found", project, zone, name)
+		return
+	}
+
+	var metadata compute.Metadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid metadata: %v", err)
+		return
+	}
+	if metadata.Fingerprint != instance.Metadata.Fingerprint {
+		writeError(w, http.StatusPreconditionFailed, "Supplied fingerprint does not match current metadata fingerprint.")
+		return
+	}
+
+	s.nextOp++
+	metadata.Fingerprint = fmt.Sprintf("fp-%d", s.nextOp)
+	instance.Metadata = &metadata
+	writeJSON(w, s.newOperation(project, zone, "setMetadata", instance.SelfLink, ""))
+}
+
+func (s *Server) getMachineType(w http.ResponseWriter, project, zone, name string) {
+	machineType, ok := s.machineTypes[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/machineTypes/%s' was not found", project, zone, name)
+		return
+	}
+	writeJSON(w, machineType)
+}
+
+func (s *Server) getDisk(w http.ResponseWriter, project, zone, name string) {
+	disk, ok := s.disks[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/disks/%s' was not found", project, zone, name)
+		return
+	}
+	writeJSON(w, s.withUsers(disk))
+}
+
+// insertDisk creates a disk from an image, which passes on its licenses
+func (s *Server) insertDisk(w http.ResponseWriter, r *http.Request, project, zone string) {
+	var disk compute.Disk
+	if err := json.NewDecoder(r.Body).Decode(&disk); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid disk: %v", err)
+		return
+	}
+	if _, exists := s.disks[key(project, zone, disk.Name)]; exists {
+		writeError(w, http.StatusConflict, "The resource 'projects/%s/zones/%s/disks/%s' already exists", project, zone, disk.Name)
+		return
+	}
+
+	if disk.SourceImage != "" {
+		imageProject, imageName := splitImageURL(disk.SourceImage)
+		image, ok := s.images[imageProject+"/"+imageName]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "source image %q was not found", disk.SourceImage)
+			return
+		}
+		disk.Licenses = append([]string{}, image.Licenses...)
+		if disk.SizeGb == 0 {
+			disk.SizeGb = image.DiskSizeGb
+		}
+	}
+
+	disk.Zone = zoneURL(project, zone)
+	disk.SelfLink = fmt.Sprintf("%s/disks/%s", disk.Zone, disk.Name)
+	disk.Status = "READY"
+	s.nextID++
+	disk.Id = s.nextID
+	s.disks[key(project, zone, disk.Name)] = &disk
+
+	writeJSON(w, s.newOperation(project, zone, "insert", disk.SelfLink, ""))
+}
+
+// deleteDisk deletes a disk that no instance uses
+func (s *Server) deleteDisk(w http.ResponseWriter, project, zone, name string) {
+	disk, ok := s.disks[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/disks/%s' was not found", project, zone, name)
+		return
+	}
+	if users := s.withUsers(disk).Users; len(users) > 0 {
+		writeError(w, http.StatusBadRequest, "disk %s is in use by %s", name, strings.Join(users, ", "))
+		return
+	}
+
+	delete(s.disks, key(project, zone, name))
+	writeJSON(w, s.newOperation(project, zone, "delete", disk.SelfLink, ""))
+}
+
+// patchDisk implements the alpha disks.patch with paths=licenses
+func (s *Server) patchDisk(w http.ResponseWriter, r *http.Request, project, zone, name string) {
+	disk, ok := s.disks[key(project, zone, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/disks/%s' was not found", project, zone, name)
+		return
+	}
+	if r.URL.Query().Get("paths") != "licenses" {
+		writeError(w, http.StatusBadRequest, "only paths=licenses is supported")
+		return
+	}
+
+	var body struct {
+		Name     string   `json:"name"`
+		Licenses []string `json:"licenses"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid disk: %v", err)
+		return
+	}
+	if body.Name != name {
+		writeError(w, http.StatusBadRequest, "disk name %q does not match %q", body.Name, name)
+		return
+	}
+
+	failure := s.failPatches[key(project, zone, name)]
+	if failure == "" {
+		disk.Licenses = body.Licenses
+	}
+	writeJSON(w, s.newOperation(project, zone, "patch", disk.SelfLink, failure))
+}
+
+// getOperation serves operations get and wait; delayed operations count down one poll per call
+func (s *Server) getOperation(w http.ResponseWriter, project, zone, name string) {
+	k := key(project, zone, name)
+	op, ok := s.operations[k]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The resource 'projects/%s/zones/%s/operations/%s' was not found", project, zone, name)
+		return
+	}
+
+	if s.pendingPolls[k] > 0 {
+		s.pendingPolls[k]--
+		op.Status = "RUNNING"
+		op.Progress = 50
+	} else {
+		op.Status = "DONE"
+		op.Progress = 100
+	}
+	writeJSON(w, op)
+}
+
+// newOperation records an operation; changes are applied synchronously. It is DONE straight
+// away unless DelayOperations was called. An empty zone makes a global operation.
+func (s *Server) newOperation(project, zone, operationType, target, failure string) *compute.Operation {
+	s.nextOp++
+	op := &compute.Operation{
+		Kind:          "compute#operation",
+		Name:          fmt.Sprintf("operation-%d", s.nextOp),
+		OperationType: operationType,
+		TargetLink:    target,
+		Status:        "DONE",
+		Progress:      100,
+	}
+	if failure != "" {
+		op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "FAKE_FAILURE", Message: failure}}}
+	}
+
+	scope := zone
+	if zone == "" {
+		scope = "global"
+		op.SelfLink = fmt.Sprintf("%sprojects/%s/global/operations/%s", selfLinkBase, project, op.Name)
+	} else {
+		op.Zone = zoneURL(project, zone)
+		op.SelfLink = fmt.Sprintf("%s/operations/%s", op.Zone, op.Name)
+	}
+
+	if s.operationPolls > 0 {
+		op.Status = "PENDING"
+		op.Progress = 0
+		s.pendingPolls[key(project, scope, op.Name)] = s.operationPolls
+	}
+	s.operations[key(project, scope, op.Name)] = op
+
+	// The caller gets a copy so later polls do not change what it was sent
+	return clone(op)
+}
+
+// filterTerm is one (field = "value") term of a list filter
+type filterTerm struct {
+	field, value string
+}
+
+// parseFilter reads a filter of space-separated (field = "value") terms, all of which must hold
+func parseFilter(filter string) ([]filterTerm, error) {
+	var terms []filterTerm
+	rest := strings.TrimSpace(filter)
+	for rest != "" {
+		if !strings.HasPrefix(rest, "(") {
+			return nil, fmt.Errorf("expected ( at %q", rest)
+		}
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return nil, fmt.Errorf("missing ) in %q", rest)
+		}
+
+		field, value, ok := strings.Cut(rest[1:end], " = ")
+		field, value = strings.TrimSpace(field), strings.Trim(strings.TrimSpace(value), `"`)
+		if !ok || field == "" {
+			return nil, fmt.Errorf("only field = \"value\" terms are supported, got %q", rest[:end+1])
+		}
+		if field != "name" && field != "status" && !strings.HasPrefix(field, "labels.") {
+			return nil, fmt.Errorf("unsupported filter field %q", field)
+		}
+
+		terms = append(terms, filterTerm{field: field, value: value})
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+	return terms, nil
+}
+
+// matchesFilter reports whether an instance satisfies every filter term
+func matchesFilter(instance *compute.Instance, terms []filterTerm) bool {
+	for _, term := range terms {
+		var actual string
+		switch {
+		case term.field == "name":
+			actual = instance.Name
+		case term.field == "status":
+			actual = instance.Status
+		default:
+			actual = instance.Labels[strings.TrimPrefix(term.field, "labels.")]
+		}
+		if actual != term.value {
+			return false
+		}
+	}
+	return true
+}
+
+// withDiskLicenses copies an instance with attached disk licenses taken from the stored disks,
+// the way the real API reports them
+func (s *Server) withDiskLicenses(instance *compute.Instance) *compute.Instance {
+	copied := clone(instance)
+	for _, attached := range copied.Disks {
+		project, zone, name := splitDiskURL(attached.Source)
+		if disk, ok := s.disks[key(project, zone, name)]; ok {
+			attached.Licenses = append([]string{}, disk.Licenses...)
+			attached.DiskSizeGb = disk.SizeGb
+		}
+	}
+	return copied
+}
+
+// withUsers copies a disk with its users set to the instances it is attached to
+func (s *Server) withUsers(disk *compute.Disk) *compute.Disk {
+	copied := clone(disk)
+	copied.Users = nil
+	for _, k := range sortedKeys(s.instances, "") {
+		instance := s.instances[k]
+		for _, attached := range instance.Disks {
+			if attached.Source == disk.SelfLink {
+				copied.Users = append(copied.Users, instance.SelfLink)
+			}
+		}
+	}
+	return copied
+}
+
+// sortedKeys returns the keys of a resource map that belong to project, or all keys when project
+// is empty, in order
+func sortedKeys[T any](resources map[string]T, project string) []string {
+	var keys []string
+	for k := range resources {
+		if project == "" || strings.HasPrefix(k, project+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitDiskURL extracts project, zone and disk name from a disk URL
+func splitDiskURL(url string) (string, string, string) {
+	parts := strings.Split(url, "/")
+	for i := 0; i+5 < len(parts); i++ {
+		if parts[i] == "projects" && parts[i+2] == "zones" && parts[i+4] == "disks" {
+			return parts[i+1], parts[i+3], parts[i+5]
+		}
+	}
+	return "", "", ""
+}
+
+// splitImageURL extracts project and image name from an image URL
+func splitImageURL(url string) (string, string) {
+	parts := strings.Split(url, "/")
+	for i := 0; i+4 < len(parts); i++ {
+		if parts[i] == "projects" && parts[i+2] == "global" && parts[i+3] == "images" {
+			return parts[i+1], parts[i+4]
+		}
+	}
+	return "", ""
+}
+
+func key(project, zone, name string) string {
+	return project + "/" + zone + "/" + name
+}
+
+func templateURL(project, name string) string {
+	return fmt.Sprintf("%sprojects/%s/global/instanceTemplates/%s", selfLinkBase, project, name)
+}
+
+func zoneURL(project, zone string) string {
+	return fmt.Sprintf("%sprojects/%s/zones/%s", selfLinkBase, project, zone)
+}
+
+func lastSegment(url string) string {
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+// clone deep-copies an API object through JSON, as the real server would
+func clone[T any](v *T) *T {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	copied := new(T)
+	if err := json.Unmarshal(data, copied); err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError replies with the error format the Google API client parses
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": fmt.Sprintf(format, args...),
+		},
+	})
+}
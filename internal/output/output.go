@@ -0,0 +1,125 @@
+// Package output renders lists of records as a table, JSON, YAML, CSV or newline-delimited JSON
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is an output format accepted by --output
+type Format string
+
+const (
+	Table  Format = "table"
+	JSON   Format = "json"
+	YAML   Format = "yaml"
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+// Formats lists every supported format in the order shown in help text
+var Formats = []Format{Table, JSON, YAML, CSV, NDJSON}
+
+// ParseFormat validates a --output value
+func ParseFormat(value string) (Format, error) {
+	for _, format := range Formats {
+		if strings.EqualFold(value, string(format)) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported output format %q, expected one of %s", value, FormatList())
+}
+
+// FormatList returns the supported formats joined with |, for flag help
+func FormatList() string {
+	names := make([]string, len(Formats))
+	for i, format := range Formats {
+		names[i] = string(format)
+	}
+	return strings.Join(names, "|")
+}
+
+// Records is implemented by everything Write can render. JSON and YAML marshal the value itself,
+// using its json and yaml tags; table and CSV use Columns and Rows; NDJSON writes one line per record.
+type Records interface {
+	Columns() []string
+	Rows() [][]string
+	Records() []interface{}
+}
+
+// Write renders records in the given format
+func Write(w io.Writer, format Format, records Records) error {
+	switch format {
+	case Table:
+		return writeTable(w, records)
+	case JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case YAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(records); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case CSV:
+		return writeCSV(w, records)
+	case NDJSON:
+		encoder := json.NewEncoder(w)
+		for _, record := range records.Records() {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// writeTable aligns columns with a tabwriter, with upper-case headers
+func writeTable(w io.Writer, records Records) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	headers := make([]string, len(records.Columns()))
+	for i, column := range records.Columns() {
+		headers[i] = strings.ToUpper(column)
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+
+	for _, row := range records.Rows() {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			// Tabs and newlines would break the alignment
+			cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(cell)
+			if cells[i] == "" {
+				cells[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// writeCSV writes a header row of field names followed by one row per record
+func writeCSV(w io.Writer, records Records) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(records.Columns()); err != nil {
+		return err
+	}
+	for _, row := range records.Rows() {
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
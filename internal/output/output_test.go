@@ -0,0 +1,84 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type testRecord struct {
+	Name     string   `json:"name" yaml:"name"`
+	Licenses []string `json:"licenses" yaml:"licenses"`
+}
+
+type testRecords []testRecord
+
+func (r testRecords) Columns() []string { return []string{"name", "licenses"} }
+
+func (r testRecords) Rows() [][]string {
+	var rows [][]string
+	for _, record := range r {
+		rows = append(rows, []string{record.Name, strings.Join(record.Licenses, ";")})
+	}
+	return rows
+}
+
+func (r testRecords) Records() []interface{} {
+	var records []interface{}
+	for _, record := range r {
+		records = append(records, record)
+	}
+	return records
+}
+
+var records = testRecords{
+	{Name: "web-1", Licenses: []string{"rhel-cloud:rhel-9-byos"}},
+	{Name: "web, 2", Licenses: nil},
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{Table, "NAME    LICENSES\nweb-1   rhel-cloud:rhel-9-byos\nweb, 2  -\n"},
+		{CSV, "name,licenses\nweb-1,rhel-cloud:rhel-9-byos\n\"web, 2\",\n"},
+		{NDJSON, `{"name":"web-1","licenses":["rhel-cloud:rhel-9-byos"]}` + "\n" + `{"name":"web, 2","licenses":null}` + "\n"},
+		{YAML, "- name: web-1\n  licenses:\n    - rhel-cloud:rhel-9-byos\n- name: web, 2\n  licenses: []\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := Write(&buf, tt.format, records); err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s output:\n%s\nwant:\n%s", tt.format, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, JSON, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []testRecord
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if len(decoded) != 2 || decoded[0].Name != "web-1" {
+		t.Errorf("decoded %+v", decoded)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if format, err := ParseFormat("JSON"); err != nil || format != JSON {
+		t.Errorf("ParseFormat(JSON) = %q, %v", format, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("ParseFormat(xml) should fail")
+	}
+}
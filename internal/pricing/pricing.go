@@ -0,0 +1,257 @@
+// Package pricing estimates the monthly license cost of conversion plans from a local price table.
+// Prices are keyed by license and by the vCPU count of the machine type, the way RHEL PAYG
+// licenses are billed. No billing API is called; the table is maintained by hand.
+package pricing
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gcp-instance-explorer/internal/api"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultHoursPerMonth is the number of hours Compute Engine bills per month
+const defaultHoursPerMonth = 730
+
+// PriceTable is a local price file
+type PriceTable struct {
+	Currency      string         `yaml:"currency"`
+	HoursPerMonth float64        `yaml:"hoursPerMonth,omitempty"`
+	VCPUs         map[string]int `yaml:"vcpus,omitempty"` // vCPU counts of machine types whose name does not tell
+	Prices        []Price        `yaml:"prices"`
+}
+
+// Price is the cost of one license on machines within a vCPU range. Subscriptions already
+// owned, such as BYOS licenses, can be priced at their amortized monthly cost to compare.
+type Price struct {
+	License  string  `yaml:"license"`            // project:code
+	MinVCPUs int     `yaml:"minVcpus,omitempty"` // Inclusive, 0 for no lower bound
+	MaxVCPUs int     `yaml:"maxVcpus,omitempty"` // Inclusive, 0 for no upper bound
+	Hourly   float64 `yaml:"hourly,omitempty"`
+	Monthly  float64 `yaml:"monthly,omitempty"` // Used instead of Hourly when set
+}
+
+// activeTable is the price table used for estimates; nil until a price file is loaded
+var activeTable *PriceTable
+
+// Active returns the price table loaded with LoadPriceFile, or nil
+func Active() *PriceTable {
+	return activeTable
+}
+
+// LoadPriceFile reads a price file and uses it for every later estimate
+func LoadPriceFile(filename string) error {
+	table, err := LoadPriceTable(filename)
+	if err != nil {
+		return err
+	}
+	activeTable = table
+	return nil
+}
+
+// LoadPriceTable reads a price file
+func LoadPriceTable(filename string) (*PriceTable, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading price file: %v", err)
+	}
+	return parsePriceTable(data, filename)
+}
+
+// parsePriceTable parses and checks a price file
+func parsePriceTable(data []byte, source string) (*PriceTable, error) {
+	var table PriceTable
+	if err := yaml.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("error parsing price file %s: %v", source, err)
+	}
+
+	if table.HoursPerMonth == 0 {
+		table.HoursPerMonth = defaultHoursPerMonth
+	}
+	if table.Currency == "" {
+		table.Currency = "USD"
+	}
+
+	for i, price := range table.Prices {
+		switch {
+		case price.License == "" || !strings.Contains(price.License, ":"):
+			return nil, fmt.Errorf("price %d in %s: license must be project:code", i+1, source)
+		case price.MaxVCPUs != 0 && price.MaxVCPUs < price.MinVCPUs:
+			return nil, fmt.Errorf("price %d in %s: maxVcpus is below minVcpus", i+1, source)
+		case price.Hourly < 0 || price.Monthly < 0:
+			return nil, fmt.Errorf("price %d in %s: prices cannot be negative", i+1, source)
+		}
+	}
+
+	return &table, nil
+}
+
+// MachineVCPUs returns the vCPU count of a machine type, preferring the price file's vcpus entries
+func (t *PriceTable) MachineVCPUs(machineType string) (int, error) {
+	if vcpus, ok := t.VCPUs[machineType]; ok {
+		return vcpus, nil
+	}
+
+	vcpus, err := api.MachineTypeVCPUs(machineType)
+	if err != nil {
+		return 0, fmt.Errorf("%v, add it under vcpus in the price file", err)
+	}
+	return vcpus, nil
+}
+
+// MonthlyCost returns the monthly cost of a license on a machine with vcpus vCPUs. The first
+// matching price wins; ok is false when the table has no price for the license.
+func (t *PriceTable) MonthlyCost(license string, vcpus int) (cost float64, ok bool) {
+	for _, price := range t.Prices {
+		if price.License != license || vcpus < price.MinVCPUs || (price.MaxVCPUs != 0 && vcpus > price.MaxVCPUs) {
+			continue
+		}
+		if price.Monthly != 0 {
+			return price.Monthly, true
+		}
+		return price.Hourly * t.HoursPerMonth, true
+	}
+	return 0, false
+}
+
+// Estimate is the monthly license cost of one disk before and after a plan item
+type Estimate struct {
+	Project     string
+	Zone        string
+	Instance    string
+	Disk        string
+	MachineType string
+	VCPUs       int
+	Current     float64
+	New         float64
+	Unpriced    []string // Licenses the price table has no price for; counted as zero
+	Err         string   // Why no estimate could be made
+}
+
+// Delta is the change in monthly cost
+func (e Estimate) Delta() float64 {
+	return e.New - e.Current
+}
+
+// PlanEstimate is the cost estimate of every convertible item of a plan
+type PlanEstimate struct {
+	Currency     string
+	Items        []Estimate
+	CurrentTotal float64
+	NewTotal     float64
+}
+
+// Instances returns the number of distinct instances the estimated disks belong to
+func (e *PlanEstimate) Instances() int {
+	seen := make(map[string]bool)
+	for _, item := range e.Items {
+		seen[item.Project+"/"+item.Zone+"/"+item.Instance] = true
+	}
+	return len(seen)
+}
+
+// EstimatePlan estimates the monthly license cost of each disk the plan changes and of the batch
+func (t *PriceTable) EstimatePlan(plan *api.ConversionPlan) *PlanEstimate {
+	estimate := &PlanEstimate{Currency: t.Currency}
+
+	for _, item := range plan.Convertible() {
+		itemEstimate := Estimate{Project: item.Project, Zone: item.Zone, Instance: item.Instance, Disk: item.Disk,
+			MachineType: item.MachineType}
+
+		if item.MachineType == "" {
+			itemEstimate.Err = "plan does not record the machine type"
+			estimate.Items = append(estimate.Items, itemEstimate)
+			continue
+		}
+
+		vcpus, err := t.MachineVCPUs(item.MachineType)
+		if err != nil {
+			itemEstimate.Err = err.Error()
+			estimate.Items = append(estimate.Items, itemEstimate)
+			continue
+		}
+		itemEstimate.VCPUs = vcpus
+
+		itemEstimate.Current = t.licensesCost(item.CurrentLicenseCodes(), vcpus, &itemEstimate.Unpriced)
+		itemEstimate.New = t.licensesCost(item.NewLicenseCodes(), vcpus, &itemEstimate.Unpriced)
+		estimate.CurrentTotal += itemEstimate.Current
+		estimate.NewTotal += itemEstimate.New
+		estimate.Items = append(estimate.Items, itemEstimate)
+	}
+
+	return estimate
+}
+
+// licensesCost adds up the monthly cost of licenses and records the ones without a price
+func (t *PriceTable) licensesCost(licenses []string, vcpus int, unpriced *[]string) float64 {
+	total := 0.0
+	for _, license := range licenses {
+		cost, ok := t.MonthlyCost(license, vcpus)
+		if !ok {
+			if !contains(*unpriced, license) {
+				*unpriced = append(*unpriced, license)
+			}
+			continue
+		}
+		total += cost
+	}
+	return total
+}
+
+// DisplayEstimate prints the per-instance estimates followed by the batch totals
+func DisplayEstimate(estimate *PlanEstimate, w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tDISK\tMACHINE TYPE\tVCPUS\tCURRENT/MONTH\tNEW/MONTH\tCHANGE\tNOTE\n")
+	for _, item := range estimate.Items {
+		if item.Err != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t-\tNO ESTIMATE: %s\n", item.Instance, item.Disk, item.MachineType, item.Err)
+			continue
+		}
+
+		note := "-"
+		if len(item.Unpriced) > 0 {
+			note = "no price for " + strings.Join(item.Unpriced, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			item.Instance, item.Disk, item.MachineType, item.VCPUs,
+			formatCost(item.Current), formatCost(item.New), formatDelta(item.Delta()), note)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nEstimated monthly license cost for %d disks on %d instances: %s now, %s after the change (%s %s)\n",
+		len(estimate.Items), estimate.Instances(), formatCost(estimate.CurrentTotal), formatCost(estimate.NewTotal),
+		formatDelta(estimate.NewTotal-estimate.CurrentTotal), estimate.Currency)
+}
+
+// formatCost formats an amount with two decimals
+func formatCost(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// formatDelta formats a change in cost with its sign
+func formatDelta(amount float64) string {
+	if amount >= 0 {
+		return "+" + formatCost(amount)
+	}
+	return formatCost(amount)
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package pricing
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gcp-instance-explorer/internal/api"
+)
+
+const testPrices = `
+currency: EUR
+vcpus:
+  a2-highgpu-1g: 12
+prices:
+  - license: rhel-cloud:rhel-9-server
+    maxVcpus: 4
+    hourly: 0.06
+  - license: rhel-cloud:rhel-9-server
+    minVcpus: 5
+    hourly: 0.13
+  - license: rhel-cloud:rhel-9-byos
+    monthly: 20
+`
+
+const licenseBase = "https://www.googleapis.com/compute/v1/projects/rhel-cloud/global/licenses/"
+
+func TestMachineVCPUs(t *testing.T) {
+	table, err := parsePriceTable([]byte(testPrices), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]int{
+		"e2-standard-2":         2,
+		"n2-highmem-16":         16,
+		"n2-custom-8-32768":     8,
+		"custom-4-16384":        4,
+		"c3-standard-4-lssd":    4,
+		"e2-medium":             2,
+		"e2-custom-micro-2048":  2,
+		"e2-custom-small-1024":  2,
+		"e2-custom-medium-4096": 2,
+		"e2-custom-4-8192":      4,
+		"a2-highgpu-1g":         12,
+	}
+	for machineType, want := range tests {
+		got, err := table.MachineVCPUs(machineType)
+		if err != nil || got != want {
+			t.Errorf("MachineVCPUs(%s) = %d, %v; want %d", machineType, got, err, want)
+		}
+	}
+
+	if _, err := table.MachineVCPUs("x4-megamem"); err == nil {
+		t.Errorf("unknown machine type did not fail")
+	}
+}
+
+func TestEstimatePlan(t *testing.T) {
+	table, err := parsePriceTable([]byte(testPrices), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := &api.ConversionPlan{Items: []api.PlanItem{
+		{
+			Instance:        "small",
+			MachineType:     "e2-standard-4",
+			CurrentLicenses: []string{licenseBase + "rhel-9-byos"},
+			NewLicenses:     []string{licenseBase + "rhel-9-server"},
+		},
+		{
+			Instance:        "big",
+			MachineType:     "n2-standard-8",
+			CurrentLicenses: []string{licenseBase + "rhel-9-byos", licenseBase + "rhel-9-sap"},
+			NewLicenses:     []string{licenseBase + "rhel-9-server", licenseBase + "rhel-9-sap"},
+		},
+		{Instance: "old-plan", NewLicenses: []string{licenseBase + "rhel-9-server"}},
+		{Instance: "old-plan", Disk: "old-plan-data", NewLicenses: []string{licenseBase + "rhel-9-server"}},
+		{Instance: "skipped", MachineType: "e2-standard-2", Skipped: "no rule"},
+	}}
+
+	estimate := table.EstimatePlan(plan)
+	if len(estimate.Items) != 4 {
+		t.Fatalf("got %d estimates, want 4 (skipped items are left out)", len(estimate.Items))
+	}
+
+	small, big, old := estimate.Items[0], estimate.Items[1], estimate.Items[2]
+	if small.Current != 20 || !near(small.New, 0.06*730) {
+		t.Errorf("small = %+v", small)
+	}
+	if big.VCPUs != 8 || !near(big.New, 0.13*730) || len(big.Unpriced) != 1 || big.Unpriced[0] != "rhel-cloud:rhel-9-sap" {
+		t.Errorf("big = %+v", big)
+	}
+	if old.Err == "" {
+		t.Errorf("item without machine type was estimated: %+v", old)
+	}
+	if estimate.CurrentTotal != 40 || !near(estimate.NewTotal, (0.06+0.13)*730) {
+		t.Errorf("totals = %v, %v", estimate.CurrentTotal, estimate.NewTotal)
+	}
+
+	var out bytes.Buffer
+	DisplayEstimate(estimate, &out)
+	if !strings.Contains(out.String(), "for 4 disks on 3 instances: 40.00 now, 138.70 after the change (+98.70 EUR)") {
+		t.Errorf("unexpected estimate output:\n%s", out.String())
+	}
+}
+
+func TestParsePriceTableRejectsBadPrices(t *testing.T) {
+	for _, data := range []string{
+		"prices:\n  - license: rhel-9-server\n    hourly: 1\n",
+		"prices:\n  - license: rhel-cloud:rhel-9-server\n    minVcpus: 8\n    maxVcpus: 4\n",
+		"prices:\n  - license: rhel-cloud:rhel-9-server\n    hourly: -1\n",
+	} {
+		if _, err := parsePriceTable([]byte(data), "test"); err == nil {
+			t.Errorf("accepted %q", data)
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return a-b < 0.0001 && b-a < 0.0001
+}
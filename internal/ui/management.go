@@ -9,6 +9,8 @@ import (
 	"strings"
 
 	"gcp-instance-explorer/internal/api"
+	"gcp-instance-explorer/internal/auth"
+	"gcp-instance-explorer/internal/pricing"
 
 	"google.golang.org/api/compute/v1"
 )
@@ -46,7 +48,8 @@ func SelectInstance(instances []api.Instance) (*api.Instance, error) {
 
 // ManageInstances displays management options and handles user choices
 // Returns true if a refresh is needed, false otherwise
-func ManageInstances(ctx context.Context, instances []api.Instance, computeService *compute.Service, projectID string) bool {
+func ManageInstances(ctx context.Context, instances []api.Instance, session *auth.Session, projectID string) bool {
+	computeService := session.Compute
 	for {
 		fmt.Println("\nManagement Options:")
 		fmt.Println("[1] Turn ON an instance")
@@ -54,6 +57,8 @@ func ManageInstances(ctx context.Context, instances []api.Instance, computeServi
 		fmt.Println("[3] BYOS to PAYG Mass Mover")
 		fmt.Println("[4] Refresh instance list")
 		fmt.Println("[5] Export list to file")
+		fmt.Println("[6] PAYG to BYOS Mass Mover")
+		fmt.Println("[7] Roll back a conversion from its journal")
 		fmt.Println("[0] Exit")
 
 		fmt.Print("\nEnter choice: ")
@@ -81,14 +86,20 @@ func ManageInstances(ctx context.Context, instances []api.Instance, computeServi
 			handleStopInstance(ctx, instances, computeService)
 			return true // Refresh the instance list and return to main menu
 		case 3:
-			handleBYOStoPAYG(ctx, instances, computeService, projectID)
+			handleConversion(ctx, instances, session, projectID, api.ToPAYG)
 			return true // Refresh the instance list after conversion
 		case 4:
 			fmt.Println("Refreshing instance list...")
 			return true // Refresh the instance list and return to main menu
 		case 5:
-			handleExportInstances(ctx, instances, projectID)
+			handleExportInstances(ctx, instances, session, projectID)
 			continue // Return to management menu without refreshing
+		case 6:
+			handleConversion(ctx, instances, session, projectID, api.ToBYOS)
+			return true // Refresh the instance list after conversion
+		case 7:
+			handleRollback(ctx, session, projectID)
+			return true // Refresh the instance list after rollback
 		default:
 			fmt.Println("Invalid choice")
 			continue
@@ -113,7 +124,7 @@ func handleStartInstance(ctx context.Context, instances []api.Instance, computeS
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Println("Instance start initiated successfully")
+		fmt.Println("Instance started successfully")
 	}
 }
 
@@ -134,7 +145,7 @@ func handleStopInstance(ctx context.Context, instances []api.Instance, computeSe
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Println("Instance stop initiated successfully")
+		fmt.Println("Instance stopped successfully")
 	}
 }
 
@@ -169,51 +180,151 @@ func handleReplaceLicense(ctx context.Context, instances []api.Instance, compute
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Println("License replacement initiated successfully")
+		fmt.Println("License metadata updated successfully")
 	}
 }
 
 // handleExportInstances handles exporting instances to a YAML file
-func handleExportInstances(ctx context.Context, instances []api.Instance, projectID string) {
+func handleExportInstances(ctx context.Context, instances []api.Instance, session *auth.Session, projectID string) {
 	if len(instances) == 0 {
 		fmt.Println("No instances to export.")
 		return
 	}
 
-	err := api.ExportInstancesToYAML(instances, projectID)
+	header := api.NewExportHeader(projectID, session.ResolvePrincipal(ctx), "")
+	err := api.ExportInstancesToYAML(instances, header, "")
 	if err != nil {
 		fmt.Printf("Error exporting instances: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Instances exported to %s-instances.yml\n", projectID)
+	fmt.Printf("Instances exported to %s\n", api.DefaultExportFile(projectID))
 }
 
-// handleBYOStoPAYG handles the process of converting BYOS to PAYG
-func handleBYOStoPAYG(ctx context.Context, instances []api.Instance, computeService *compute.Service, projectID string) {
-	fmt.Println("\nBYOS to PAYG Mass Mover")
+// handleConversion handles the process of converting BYOS to PAYG or back
+func handleConversion(ctx context.Context, instances []api.Instance, session *auth.Session, projectID string, direction api.ConversionDirection) {
+	fmt.Printf("\n%s to %s Mass Mover\n", direction.From(), direction.Label())
 	fmt.Println("-----------------------")
 
 	// Check for matching instances from file
-	matchedInstances, err := api.CheckInstancesFromFile(projectID, instances)
+	matchedInstances, err := api.CheckInstancesFromFile(projectID, instances, api.DefaultFileCheckOptions())
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
-	// Display the instances that will be converted
-	fmt.Printf("\nFound %d instances to convert:\n", len(matchedInstances))
-	for _, instance := range matchedInstances {
-		fmt.Printf("%s  %s  %s  %s\n",
-			instance.Zone,
-			instance.Name,
-			strings.Join(instance.LicenseCodes, ", "),
-			instance.Status)
+	// Resolve exactly what will change before anything is touched
+	fmt.Printf("\nResolving conversion plan for %d instances...\n", len(matchedInstances))
+	plan, err := api.PlanConversion(ctx, matchedInstances, direction, session.Compute)
+	if err != nil {
+		fmt.Printf("Error building conversion plan: %v\n", err)
+		return
 	}
 
-	// Confirm with user
-	fmt.Print("\nAre these the instances you want to convert to PAYG? (y/n): ")
+	reviewAndApplyPlan(ctx, plan, session, projectID)
+}
+
+// handleRollback restores the original licenses recorded in a conversion journal
+func handleRollback(ctx context.Context, session *auth.Session, projectID string) {
+	fmt.Println("\nRoll back a conversion")
+	fmt.Println("----------------------")
+
+	fmt.Print("\nEnter the journal file of the run to roll back: ")
 	reader := bufio.NewReader(os.Stdin)
+	journalPath, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Printf("Error reading input: %v\n", err)
+		return
+	}
+
+	journalPath = strings.TrimSpace(journalPath)
+	if journalPath == "" {
+		fmt.Println("Rollback cancelled.")
+		return
+	}
+
+	plan, err := api.PlanRollback(ctx, journalPath, nil, session.Compute)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if plan.Project != projectID {
+		fmt.Printf("Error: journal belongs to project %s, not %s\n", plan.Project, projectID)
+		return
+	}
+
+	reviewAndApplyPlan(ctx, plan, session, projectID)
+}
+
+// reviewAndApplyPlan shows a plan, offers to save it, checks permissions, and applies and verifies
+// it once confirmed
+func reviewAndApplyPlan(ctx context.Context, plan *api.ConversionPlan, session *auth.Session, projectID string) {
+	computeService := session.Compute
+	direction := plan.Direction
+	fmt.Printf("\nConversion plan (%d of %d instances will be converted):\n\n",
+		len(plan.Convertible()), len(plan.Items))
+	api.DisplayPlan(plan, os.Stdout)
+
+	// Show what the change costs next to the plan when a price table was loaded
+	if table := pricing.Active(); table != nil && len(plan.Convertible()) > 0 {
+		fmt.Println("\nEstimated monthly license cost:")
+		fmt.Println()
+		pricing.DisplayEstimate(table.EstimatePlan(plan), os.Stdout)
+	}
+
+	if len(plan.Convertible()) == 0 {
+		fmt.Println("\nNo instances in the plan can be converted.")
+		return
+	}
+
+	// Offer to save the plan for review before applying it
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("\nSave this plan to a file? Enter a filename or leave blank to skip: ")
+	planFile, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Printf("Error reading input: %v\n", err)
+		return
+	}
+
+	planFile = strings.TrimSpace(planFile)
+	if planFile != "" {
+		if err := api.SavePlan(plan, planFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Plan saved to %s\n", planFile)
+	}
+
+	// Refuse up front when the account cannot change disk licenses in this project
+	fmt.Printf("\nChecking permissions on project %s...\n", projectID)
+	missing, err := api.PreflightConversion(ctx, projectID, session.CRM)
+	switch {
+	case err != nil:
+		// Going on without the check needs an explicit answer
+		fmt.Printf("Warning: permissions could not be checked: %v\n", err)
+		fmt.Print("Continue without the permission check? (y/n): ")
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Printf("Error reading input: %v\n", err)
+			return
+		}
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Conversion cancelled, nothing was changed.")
+			return
+		}
+	case len(missing) > 0:
+		fmt.Printf("Error: %s is missing these permissions, nothing was changed:\n", session.ResolvePrincipal(ctx))
+		for _, permission := range missing {
+			fmt.Printf("  - %s\n", permission)
+		}
+		return
+	default:
+		fmt.Println("All permissions needed to change disk licenses are granted.")
+	}
+
+	// Confirm with user
+	fmt.Printf("\nDo you want to apply this plan and convert these instances to %s? (y/n): ", direction.Label())
 	input, err := reader.ReadString('\n')
 	if err != nil {
 		fmt.Printf("Error reading input: %v\n", err)
@@ -227,8 +338,18 @@ func handleBYOStoPAYG(ctx context.Context, instances []api.Instance, computeServ
 	}
 
 	// Perform conversion
-	fmt.Println("\nConverting instances to PAYG licensing...")
-	conversions, err := api.ConvertToPAYG(ctx, matchedInstances, computeService)
+	fmt.Printf("\nConverting instances to %s licensing...\n", direction.Label())
+	journal, err := api.OpenJournal(api.DefaultJournalPath(projectID, direction))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer journal.Close()
+	fmt.Printf("Recording progress in journal %s\n", journal.Path)
+
+	options := api.DefaultConvertOptions()
+	options.Journal = journal
+	conversions, err := api.ApplyPlan(ctx, plan, computeService, options)
 	if err != nil {
 		fmt.Printf("Error during conversion: %v\n", err)
 		return
@@ -242,20 +363,7 @@ func handleBYOStoPAYG(ctx context.Context, instances []api.Instance, computeServ
 	fmt.Println("\nConversion Results:")
 	fmt.Println("-----------------")
 
-	successful := 0
-	for _, conversion := range verifiedConversions {
-		status := "✓ Success"
-		if !conversion.Success {
-			status = "✗ Failed"
-		} else {
-			successful++
-		}
-
-		fmt.Printf("%s  %s  %s\n", status, conversion.Instance.Name, conversion.Instance.Zone)
-		fmt.Printf("  Before: %s\n", conversion.OriginalOS)
-		fmt.Printf("  After:  %s\n", conversion.NewOS)
-		fmt.Println()
-	}
+	successful := api.DisplayConversionResults(verifiedConversions, os.Stdout)
 
 	fmt.Printf("\nConverted %d/%d instances successfully.\n", successful, len(verifiedConversions))
 
@@ -1,20 +1,92 @@
 package models
 
 type Project struct {
-    ID   string `json:"id"`
-    Name string `json:"name"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
+// Instance is a Compute Engine instance as used for display, export and conversion.
+// Licenses are project:code values such as rhel-cloud:rhel-9-byos.
 type Instance struct {
-    Name         string `json:"name"`
-    Zone         string `json:"zone"`
-    Status       string `json:"status"`
-    MachineType  string `json:"machineType"`
-    NetworkInterfaces []NetworkInterface `json:"networkInterfaces"`
+	Name              string             `json:"name"`
+	Zone              string             `json:"zone"`
+	Project           string             `json:"project"`
+	ID                string             `json:"id,omitempty"`
+	SelfLink          string             `json:"selfLink,omitempty"`
+	MachineType       string             `json:"machineType"`
+	Status            string             `json:"status"`
+	CPUPlatform       string             `json:"cpuPlatform,omitempty"`
+	CreationTimestamp string             `json:"creationTimestamp,omitempty"`
+	IP                string             `json:"ip,omitempty"`          // First external IP, for display
+	LicenseCodes      []string           `json:"licenses,omitempty"`    // Licenses of the boot disk
+	DiskType          string             `json:"diskType,omitempty"`    // Boot disk interface and type, e.g. SCSI-PERSISTENT
+	DiskSizeGB        int64              `json:"diskSizeGb,omitempty"`  // Boot disk size
+	SourceImage       string             `json:"sourceImage,omitempty"` // Image the boot disk was created from
+	GuestOSFeatures   []string           `json:"guestOsFeatures,omitempty"`
+	Labels            map[string]string  `json:"labels,omitempty"`
+	MetadataKeys      []string           `json:"metadataKeys,omitempty"` // Keys only; values may hold secrets
+	ServiceAccounts   []string           `json:"serviceAccounts,omitempty"`
+	Scheduling        Scheduling         `json:"scheduling"`
+	NetworkInterfaces []NetworkInterface `json:"networkInterfaces,omitempty"`
+	Disks             []AttachedDisk     `json:"disks,omitempty"`
+	ManagedBy         string             `json:"managedBy,omitempty"` // Managed instance group that recreates the instance from its template
+}
+
+// AttachedDisk is one disk attached to an instance
+type AttachedDisk struct {
+	Name            string   `json:"name"`
+	DeviceName      string   `json:"deviceName,omitempty"`
+	Source          string   `json:"source"`
+	Boot            bool     `json:"boot"`
+	Type            string   `json:"type"`                // PERSISTENT or SCRATCH
+	Interface       string   `json:"interface,omitempty"` // SCSI or NVME
+	Mode            string   `json:"mode,omitempty"`      // READ_WRITE or READ_ONLY
+	DiskType        string   `json:"diskType,omitempty"`  // pd-balanced, pd-ssd, ...
+	SizeGB          int64    `json:"sizeGb"`
+	Licenses        []string `json:"licenses,omitempty"`
+	SourceImage     string   `json:"sourceImage,omitempty"`
+	GuestOSFeatures []string `json:"guestOsFeatures,omitempty"`
+}
+
+// Scheduling holds the instance's scheduling options
+type Scheduling struct {
+	ProvisioningModel string `json:"provisioningModel,omitempty"` // STANDARD or SPOT
+	Preemptible       bool   `json:"preemptible,omitempty"`
+	OnHostMaintenance string `json:"onHostMaintenance,omitempty"`
+	AutomaticRestart  bool   `json:"automaticRestart"`
 }
 
 type NetworkInterface struct {
-    Name    string `json:"name"`
-    Network string `json:"network"`
-    IP      string `json:"networkIP"`
-}
\ No newline at end of file
+	Name        string   `json:"name"`
+	Network     string   `json:"network"`
+	IP          string   `json:"networkIP"`
+	ExternalIPs []string `json:"externalIPs,omitempty"`
+}
+
+// BootDisk returns the disk marked as boot, or the first disk when none is marked
+func (i *Instance) BootDisk() *AttachedDisk {
+	for n := range i.Disks {
+		if i.Disks[n].Boot {
+			return &i.Disks[n]
+		}
+	}
+	if len(i.Disks) > 0 {
+		return &i.Disks[0]
+	}
+	return nil
+}
+
+// DiskLicenses lists the licenses of the non-boot disks as disk=license
+func (i *Instance) DiskLicenses() []string {
+	boot := i.BootDisk()
+	var licenses []string
+	for n := range i.Disks {
+		if &i.Disks[n] == boot {
+			continue
+		}
+		for _, license := range i.Disks[n].Licenses {
+			licenses = append(licenses, i.Disks[n].Name+"="+license)
+		}
+	}
+	return licenses
+}